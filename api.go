@@ -0,0 +1,560 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiParam is a request parameter. Parameters are read from the query string or from a form, multipart or JSON body,
+// so each can be given either way.
+type apiParam struct {
+	name     string
+	kind     string // string, integer, boolean or file
+	required bool
+	values   []string
+	doc      string
+}
+
+// apiOperation describes an action for the OpenAPI document and for checking requests. role is the role it needs
+// a login with, if any, response is a key of apiResponses, and body is the content type of a request body that is
+// read as a whole instead of as parameters.
+type apiOperation struct {
+	method   string
+	path     string
+	summary  string
+	role     string
+	params   []apiParam
+	response string
+	body     string
+}
+
+var apiResponses = map[string]string{
+	"json":      "application/json",
+	"text":      "text/plain",
+	"binary":    "application/octet-stream",
+	"gzip":      "application/gzip",
+	"events":    "text/event-stream",
+	"svg":       "image/svg+xml",
+	"html":      "text/html",
+	"websocket": "",
+}
+
+var stageNames = []string{"clean", "clone", "prepare", "pull", "build", "test", "package", "scan", "push"}
+
+func apiID(doc string) apiParam {
+	return apiParam{"id", "integer", true, nil, doc}
+}
+
+var apiRedirect = apiParam{"redirect", "string", false, nil, "Answer with a 303 redirect to this location"}
+
+var projectSettingParams = []apiParam{
+	{"name", "string", true, nil, ""},
+	{"labels", "string", false, nil, "Comma separated labels"},
+	{"url", "string", true, nil, "Source URL"},
+	{"branch", "string", false, nil, ""},
+	{"destination", "string", false, nil, "Registry to push images to"},
+	{"tag", "string", false, nil, "Image tag"},
+	{"buildSpec", "string", false, nil, ""},
+	{"packageSpec", "string", false, nil, ""},
+	{"testSpec", "string", false, nil, ""},
+	{"testReport", "string", false, nil, ""},
+	{"artifacts", "string", false, nil, "Comma separated artifact paths"},
+	{"caches", "string", false, nil, "Comma separated cache paths"},
+	{"poll", "integer", false, nil, "Minutes between polls of the source"},
+	{"hold", "boolean", false, nil, "Hold pushes for approval"},
+	{"cpus", "string", false, nil, ""},
+	{"memory", "string", false, nil, "e.g. 2g"},
+	{"diskQuota", "integer", false, nil, "Workspace quota in MB"},
+	{"scanner", "string", false, []string{"", "trivy", "grype"}, ""},
+	{"scanFail", "string", false, nil, "Severity that fails a scan"},
+	{"signing", "string", false, []string{"", "key", "keyless"}, ""},
+	{"sbom", "string", false, []string{"", "cyclonedx", "spdx"}, ""},
+	{"sbomAttach", "boolean", false, nil, ""},
+	{"tagPattern", "string", false, nil, ""},
+	{"pathFilter", "string", false, nil, ""},
+	{"snapshot", "boolean", false, nil, "Snapshot failed workspaces"},
+	{"sourceKind", "string", false, []string{"", "git", "hg", "svn", "tarball"}, ""},
+}
+
+var apiOperations = []apiOperation{
+	{method: "GET", path: "/user/current", summary: "Name of the logged in user", response: "text"},
+	{method: "GET", path: "/user/sso", summary: "Single sign-on providers", response: "json"},
+	{method: "GET", path: "/user/oidc/login", summary: "Log in with the OIDC provider", params: []apiParam{apiRedirect}, response: "html"},
+	{method: "GET", path: "/user/oidc/callback", summary: "OIDC login callback", params: []apiParam{
+		{"code", "string", false, nil, ""}, {"state", "string", false, nil, ""},
+		{"error", "string", false, nil, ""}, {"error_description", "string", false, nil, ""},
+	}, response: "html"},
+	{method: "POST", path: "/user/login", summary: "Log in, setting the RACS_TOKEN cookie", params: []apiParam{
+		{"username", "string", true, nil, ""}, {"password", "string", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/user/logout", summary: "Log out", params: []apiParam{apiRedirect}, response: "text"},
+	{method: "GET", path: "/setup", summary: "Form to set up a server that has no users yet", params: []apiParam{{"token", "string", false, nil, ""}}, response: "html"},
+	{method: "POST", path: "/setup/complete", summary: "Create the admin user and write the config file", params: []apiParam{
+		{"token", "string", true, nil, "From the server's log"}, {"username", "string", true, nil, ""}, {"password", "string", true, nil, "At least 8 characters"},
+		{"data", "string", false, nil, "Data directory, used after a restart"}, {"url", "string", false, nil, "External URL of racs"},
+		{"registry", "string", false, nil, "Name of a default registry"}, {"registryURL", "string", false, nil, ""},
+		{"registryUser", "string", false, nil, ""}, {"registryPassword", "string", false, nil, ""}, apiRedirect,
+	}, response: "json"},
+
+	{method: "GET", path: "/project/list", summary: "List projects", params: []apiParam{{"label", "string", false, nil, ""}}, response: "json"},
+	{method: "GET", path: "/project/status", summary: "Project status", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "GET", path: "/project/events", summary: "Stream of project and task events", response: "events"},
+	{method: "POST", path: "/project/create", summary: "Create a project, answering with its id", role: "admin", params: []apiParam{
+		{"name", "string", true, nil, ""}, {"url", "string", true, nil, ""}, {"branch", "string", false, nil, ""},
+		{"destination", "string", false, nil, ""}, {"tag", "string", false, nil, ""},
+		{"sourceKind", "string", false, []string{"", "git", "hg", "svn", "tarball"}, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/update", summary: "Update a project's settings", role: "admin",
+		params: append([]apiParam{apiID("Project"), apiRedirect}, projectSettingParams...), response: "text"},
+	{method: "POST", path: "/project/triggers", summary: "Set the projects a project's builds trigger", role: "admin", params: []apiParam{
+		apiID("Project"), {"triggers", "string", false, nil, "Comma separated pairs of project id and state"}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/upload", summary: "Upload a container spec or context file", role: "admin", params: []apiParam{
+		apiID("Project"), {"name", "string", true, nil, "e.g. BuildSpec or context/settings.xml"},
+		{"file", "file", false, nil, ""}, {"value", "string", false, nil, "Content, instead of a file"}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/build", summary: "Build a project from a stage", params: []apiParam{
+		apiID("Project"), {"stage", "string", true, stageNames, ""}, {"labels", "string", false, nil, ""},
+	}, response: "text"},
+	{method: "POST", path: "/project/run", summary: "Start a build, answering with its id and stages", params: []apiParam{
+		apiID("Project"), {"run", "string", false, nil, "full, from:STAGE or only:STAGE"}, {"labels", "string", false, nil, ""},
+		{"variants", "string", false, nil, "Comma separated variants to build instead of the project"},
+	}, response: "json"},
+	{method: "GET", path: "/project/build/status", summary: "Build state and tasks", params: []apiParam{
+		{"build", "integer", true, nil, ""},
+	}, response: "json"},
+	{method: "POST", path: "/project/delete", summary: "Delete a project", params: []apiParam{
+		apiID("Project"), {"confirm", "string", false, nil, "YES to delete it"}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/approve", summary: "Approve a held push", role: "admin", params: []apiParam{apiID("Project")}, response: "text"},
+	{method: "POST", path: "/project/reject", summary: "Reject a held push", role: "admin", params: []apiParam{apiID("Project")}, response: "text"},
+	{method: "GET", path: "/project/caches", summary: "Project caches and their sizes", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "POST", path: "/project/caches/clear", summary: "Clear a project's caches", role: "admin", params: []apiParam{
+		apiID("Project"), {"path", "string", false, nil, "Cache to clear, or all"}, apiRedirect,
+	}, response: "text"},
+	{method: "GET", path: "/project/variables", summary: "Project variables", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "POST", path: "/project/variables/set", summary: "Set a project variable", role: "admin", params: []apiParam{
+		apiID("Project"), {"name", "string", true, nil, ""}, {"kind", "string", false, []string{"", "env", "arg", "sign"}, ""},
+		{"value", "string", false, nil, ""}, {"secret", "boolean", false, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/variables/delete", summary: "Delete a project variable", role: "admin", params: []apiParam{
+		apiID("Project"), {"name", "string", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/webhook/secret", summary: "Set a project's webhook secret", role: "admin", params: []apiParam{
+		apiID("Project"), {"secret", "string", false, nil, "Empty to remove it"}, apiRedirect,
+	}, response: "text"},
+	{method: "GET", path: "/project/webhook/deliveries", summary: "Recent webhook deliveries", params: []apiParam{
+		apiID("Project"), {"status", "string", false, nil, ""},
+	}, response: "json"},
+	{method: "GET", path: "/project/sbom", summary: "SBOM of a version", params: []apiParam{
+		apiID("Project"), {"version", "integer", false, nil, "Defaults to the latest"},
+	}, response: "json"},
+	{method: "GET", path: "/project/scan-results", summary: "Vulnerability scan results", params: []apiParam{
+		apiID("Project"), {"task", "integer", false, nil, ""},
+	}, response: "json"},
+	{method: "GET", path: "/project/tests", summary: "Test results", params: []apiParam{
+		apiID("Project"), {"task", "integer", false, nil, ""},
+	}, response: "json"},
+	{method: "GET", path: "/project/artifacts", summary: "Artifacts of a version", params: []apiParam{
+		apiID("Project"), {"version", "integer", false, nil, ""},
+	}, response: "json"},
+	{method: "GET", path: "/project/artifacts/download", summary: "Download an artifact", params: []apiParam{
+		apiID("Project"), {"version", "integer", true, nil, ""}, {"path", "string", true, nil, ""},
+	}, response: "binary"},
+	{method: "GET", path: "/project/environments", summary: "Deployment environments", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "GET", path: "/project/environments/history", summary: "Deployments to an environment", params: []apiParam{
+		apiID("Project"), {"environment", "string", true, nil, ""},
+	}, response: "json"},
+	{method: "POST", path: "/project/deploy", summary: "Deploy a version to an environment", role: "admin", params: []apiParam{
+		apiID("Project"), {"environment", "string", true, nil, ""}, {"version", "integer", false, nil, ""},
+		{"image", "string", false, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "GET", path: "/project/parsers", summary: "Log parsers", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "POST", path: "/project/parsers/set", summary: "Set a log parser", role: "admin", params: []apiParam{
+		apiID("Project"), {"stage", "string", true, stageNames, ""}, {"name", "string", true, nil, ""},
+		{"pattern", "string", true, nil, "Regular expression"}, {"mode", "string", false, []string{"", "first", "last", "count", "sum"}, "Defaults to last"}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/parsers/delete", summary: "Delete a log parser", role: "admin", params: []apiParam{
+		apiID("Project"), {"stage", "string", true, stageNames, ""}, {"name", "string", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/labels/add", summary: "Add a project label", role: "admin", params: []apiParam{
+		apiID("Project"), {"label", "string", true, nil, ""},
+	}, response: "text"},
+	{method: "POST", path: "/project/labels/remove", summary: "Remove a project label", role: "admin", params: []apiParam{
+		apiID("Project"), {"label", "string", true, nil, ""},
+	}, response: "text"},
+	{method: "GET", path: "/labels/health", summary: "Build health by label", response: "json"},
+	{method: "POST", path: "/task/labels/add", summary: "Add a task label", role: "admin", params: []apiParam{
+		apiID("Task"), {"label", "string", true, nil, ""},
+	}, response: "text"},
+	{method: "POST", path: "/task/labels/remove", summary: "Remove a task label", role: "admin", params: []apiParam{
+		apiID("Task"), {"label", "string", true, nil, ""},
+	}, response: "text"},
+	{method: "GET", path: "/summary", summary: "Failing, running and queued projects", response: "json"},
+	{method: "POST", path: "/webhook", summary: "GitHub or GitLab push webhook", params: []apiParam{apiID("Project, in the query string")},
+		response: "text", body: "application/json"},
+	{method: "GET", path: "/search", summary: "Search projects and tasks", params: []apiParam{{"q", "string", false, nil, ""}}, response: "json"},
+	{method: "GET", path: "/search/builds", summary: "Search builds", params: searchParams, response: "json"},
+	{method: "GET", path: "/search/logs", summary: "Search finished tasks' log lines", params: []apiParam{
+		{"q", "string", true, nil, ""}, {"failed", "boolean", false, nil, "Only search failed tasks"},
+		{"project", "integer", false, nil, ""}, {"limit", "integer", false, nil, ""},
+	}, response: "json"},
+	{method: "POST", path: "/search/save", summary: "Save a build search", role: "admin",
+		params: append([]apiParam{{"name", "string", true, nil, ""}, apiRedirect}, searchParams...), response: "text"},
+	{method: "GET", path: "/search/saved", summary: "Saved build searches", response: "json"},
+	{method: "GET", path: "/search/run", summary: "Run a saved build search", params: []apiParam{{"name", "string", true, nil, ""}}, response: "json"},
+	{method: "POST", path: "/search/delete", summary: "Delete a saved build search", role: "admin", params: []apiParam{
+		{"name", "string", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "GET", path: "/project/badge", summary: "Build status badge, also at /project/badge/ID.svg", params: []apiParam{apiID("Project")}, response: "svg"},
+	{method: "POST", path: "/chaos/inject", summary: "Inject a fault (with -chaos)", params: []apiParam{
+		{"kind", "string", true, []string{"timeout", "db", "disconnect"}, ""}, {"stage", "string", false, stageNames, ""},
+		{"project", "integer", false, nil, ""}, {"count", "integer", false, nil, ""}, {"delay", "integer", false, nil, "Seconds"},
+	}, response: "json"},
+	{method: "GET", path: "/chaos/list", summary: "Injected faults", response: "json"},
+	{method: "POST", path: "/chaos/clear", summary: "Clear a fault, or all of them", params: []apiParam{{"id", "integer", false, nil, ""}}, response: "text"},
+	{method: "POST", path: "/project/after", summary: "Set the projects a project builds after", role: "admin", params: []apiParam{
+		apiID("Project"), {"after", "string", false, nil, "Comma separated project ids"}, apiRedirect,
+	}, response: "text"},
+	{method: "GET", path: "/project/graph", summary: "Project dependency graph", params: []apiParam{
+		{"format", "string", false, []string{"", "json", "dot"}, ""},
+	}, response: "json"},
+	{method: "GET", path: "/project/spec", summary: "Read a container spec", params: []apiParam{
+		apiID("Project"), {"spec", "string", true, []string{"build", "package", "test"}, ""},
+	}, response: "text"},
+	{method: "PUT", path: "/project/spec", summary: "Save a container spec, given as the body or content", role: "admin", params: []apiParam{
+		apiID("Project"), {"spec", "string", true, []string{"build", "package", "test"}, ""},
+		{"content", "string", false, nil, ""}, {"etag", "string", false, nil, "ETag the edit was based on"}, apiRedirect,
+	}, response: "json", body: "text/plain"},
+	{method: "GET", path: "/project/files", summary: "Uploaded files", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "GET", path: "/project/files/download", summary: "Download an uploaded file", role: "admin", params: []apiParam{
+		apiID("Project"), {"name", "string", true, nil, ""},
+	}, response: "binary"},
+	{method: "POST", path: "/project/files/delete", summary: "Delete an uploaded file", role: "admin", params: []apiParam{
+		apiID("Project"), {"name", "string", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/files/extract", summary: "Extract an uploaded archive into the build context", role: "admin", params: []apiParam{
+		apiID("Project"), {"path", "string", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/clone", summary: "Copy a project", role: "admin", params: []apiParam{
+		apiID("Project"), {"secrets", "boolean", false, nil, "Copy secret variables"},
+	}, response: "text"},
+	{method: "GET", path: "/templates", summary: "Project templates", response: "json"},
+	{method: "POST", path: "/template/save", summary: "Save a project as a template", role: "admin", params: []apiParam{
+		apiID("Project"), {"template", "string", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/template/create", summary: "Create a project from a template", role: "admin", params: []apiParam{
+		{"template", "string", true, nil, ""},
+	}, response: "text"},
+	{method: "POST", path: "/template/delete", summary: "Delete a template", role: "admin", params: []apiParam{
+		{"template", "string", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "GET", path: "/project/export", summary: "Export a project bundle", role: "admin", params: []apiParam{
+		apiID("Project"), {"secrets", "boolean", false, nil, ""}, {"history", "boolean", false, nil, ""},
+	}, response: "gzip"},
+	{method: "POST", path: "/project/import", summary: "Import a project bundle, given as the body or file", role: "admin", params: []apiParam{
+		{"file", "file", false, nil, ""}, {"name", "string", false, nil, ""}, {"url", "string", false, nil, ""},
+		{"branch", "string", false, nil, ""}, {"destination", "string", false, nil, ""}, {"tag", "string", false, nil, ""}, apiRedirect,
+	}, response: "json", body: "application/gzip"},
+	{method: "GET", path: "/project/proposals", summary: "Proposed container spec updates", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "POST", path: "/project/proposals/check", summary: "Check for container spec updates", role: "admin", params: []apiParam{apiID("Project")}, response: "text"},
+	{method: "POST", path: "/project/proposals/trial", summary: "Build a proposal", role: "admin", params: []apiParam{
+		apiID("Project"), {"proposal", "integer", true, nil, ""},
+	}, response: "text"},
+	{method: "GET", path: "/project/proposals/log", summary: "Log of a proposal's trial build", params: []apiParam{
+		apiID("Project"), {"proposal", "integer", true, nil, ""},
+	}, response: "text"},
+	{method: "POST", path: "/project/proposals/accept", summary: "Accept a proposal", role: "admin", params: []apiParam{
+		apiID("Project"), {"proposal", "integer", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/proposals/reject", summary: "Reject a proposal", role: "admin", params: []apiParam{
+		apiID("Project"), {"proposal", "integer", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "GET", path: "/admin/status", summary: "Server status", role: "admin", response: "json"},
+	{method: "POST", path: "/admin/prune/images", summary: "Prune unused images", role: "admin", response: "json"},
+	{method: "POST", path: "/admin/prune/workspaces", summary: "Prune idle workspaces", role: "admin", response: "json"},
+	{method: "GET", path: "/admin/maintenance", summary: "Maintenance mode and drain progress", role: "admin", response: "json"},
+	{method: "POST", path: "/admin/maintenance/start", summary: "Stop starting new builds and drain", role: "admin", params: []apiParam{
+		{"retryAfter", "integer", false, nil, "Seconds refused requests are told to wait (default 300)"},
+	}, response: "json"},
+	{method: "POST", path: "/admin/maintenance/stop", summary: "Start accepting builds again", role: "admin", response: "json"},
+	{method: "POST", path: "/admin/restart", summary: "Exit once drained, for the service manager to restart", role: "admin", response: "text"},
+	{method: "GET", path: "/admin/audit", summary: "Audit log", role: "admin", params: []apiParam{
+		{"user", "string", false, nil, ""}, {"action", "string", false, nil, ""}, {"project", "integer", false, nil, ""},
+		{"from", "string", false, nil, ""}, {"to", "string", false, nil, ""}, {"limit", "integer", false, nil, ""},
+	}, response: "json"},
+	{method: "GET", path: "/admin/containers", summary: "Containers started by racs", role: "admin", response: "json"},
+	{method: "POST", path: "/admin/containers/reap", summary: "Remove orphaned containers", role: "admin", response: "json"},
+	{method: "POST", path: "/api/v1/pipeline/lint", summary: "Check a pipeline definition, given as the body or pipeline", params: []apiParam{
+		{"pipeline", "string", false, nil, ""},
+	}, response: "json", body: "text/plain"},
+	{method: "POST", path: "/api/v1/pipeline/apply", summary: "Create or update the projects of a pipeline definition", role: "admin", params: []apiParam{
+		{"pipeline", "string", false, nil, ""},
+	}, response: "json", body: "text/plain"},
+	{method: "GET", path: "/project/retries", summary: "Stage retry policies", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "POST", path: "/project/retries/set", summary: "Set a stage's retry policy", role: "admin", params: []apiParam{
+		apiID("Project"), {"stage", "string", true, stageNames, ""}, {"count", "integer", true, nil, "0 to 10"},
+		{"backoff", "integer", false, nil, "Seconds, defaults to 10"}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/retries/delete", summary: "Delete a stage's retry policy", role: "admin", params: []apiParam{
+		apiID("Project"), {"stage", "string", true, stageNames, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "GET", path: "/project/variants", summary: "Build variants and their last builds", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "POST", path: "/project/variants/set", summary: "Add or change a build variant", role: "admin", params: []apiParam{
+		apiID("Project"), {"name", "string", true, nil, ""}, {"buildSpec", "string", false, nil, "Defaults to BuildSpec.NAME"},
+		{"triggers", "string", false, nil, "Comma separated poll, webhook and tag"}, apiRedirect,
+	}, response: "text"},
+	{method: "POST", path: "/project/variants/delete", summary: "Delete a build variant", role: "admin", params: []apiParam{
+		apiID("Project"), {"name", "string", true, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "GET", path: "/project/history", summary: "Revisions of a project's settings and specs", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "GET", path: "/project/revision", summary: "A revision of a project's settings and specs", params: []apiParam{
+		apiID("Project"), {"revision", "integer", true, nil, ""},
+	}, response: "json"},
+	{method: "GET", path: "/project/stats", summary: "Stage durations, success rates and failure streaks", params: []apiParam{
+		apiID("Project"), {"days", "integer", false, nil, "Defaults to 30"}, {"bucket", "string", false, []string{"", "day", "week"}, ""},
+	}, response: "json"},
+	{method: "GET", path: "/project/snapshots", summary: "Snapshots of failed workspaces", params: []apiParam{apiID("Project")}, response: "json"},
+	{method: "GET", path: "/task/snapshot", summary: "Download a workspace snapshot", role: "admin", params: []apiParam{apiID("Task")}, response: "gzip"},
+	{method: "POST", path: "/task/shell", summary: "Start a debug shell on a snapshot", role: "admin", params: []apiParam{apiID("Task")}, response: "json"},
+	{method: "POST", path: "/task/shell/exec", summary: "Run a command in a debug shell", role: "admin", params: []apiParam{
+		apiID("Task"), {"command", "string", true, nil, ""},
+	}, response: "text"},
+	{method: "POST", path: "/task/shell/stop", summary: "Stop a debug shell", role: "admin", params: []apiParam{apiID("Task")}, response: "text"},
+	{method: "GET", path: "/project/terminal", summary: "WebSocket terminal in the build environment", role: "admin", params: []apiParam{
+		apiID("Project"), {"task", "integer", false, nil, "Attach to this task's debug shell"},
+	}, response: "websocket"},
+	{method: "GET", path: "/task/logs", summary: "A task's log from an offset, with its state in X-Task-State", params: []apiParam{
+		apiID("Task"), {"offset", "integer", false, nil, ""},
+	}, response: "text"},
+	{method: "GET", path: "/task/logs/segments", summary: "A task's log as timed lines and foldable sections", params: []apiParam{
+		apiID("Task"), {"ansi", "string", false, []string{"keep", "strip"}, "Keep or strip terminal colours"},
+	}, response: "json"},
+	{method: "GET", path: "/task/logs/batch", summary: "Several tasks' logs", params: []apiParam{
+		{"tasks", "string", true, nil, "Comma separated pairs of task id and offset"},
+	}, response: "json"},
+	{method: "POST", path: "/registry/create", summary: "Add registry credentials", role: "admin", params: []apiParam{
+		{"name", "string", true, nil, ""}, {"url", "string", true, nil, ""}, {"user", "string", false, nil, ""},
+		{"password", "string", false, nil, ""}, {"provider", "string", false, nil, ""}, apiRedirect,
+	}, response: "text"},
+	{method: "GET", path: "/api/openapi.json", summary: "This OpenAPI document", response: "json"},
+	{method: "GET", path: "/api/docs", summary: "Swagger UI for this document", response: "html"},
+}
+
+var searchParams = []apiParam{
+	{"project", "integer", false, nil, ""}, {"label", "string", false, nil, ""}, {"state", "string", false, nil, ""},
+	{"branch", "string", false, nil, ""}, {"from", "string", false, nil, ""}, {"to", "string", false, nil, ""},
+	{"limit", "integer", false, nil, ""},
+}
+
+// apiLookup finds the operation for a request, falling back to another method of the same path, since actions
+// accept any method.
+func apiLookup(path, method string) *apiOperation {
+	var found *apiOperation
+	for i := range apiOperations {
+		op := &apiOperations[i]
+		if op.path != path {
+			continue
+		}
+		if op.method == method {
+			return op
+		}
+		if found == nil {
+			found = op
+		}
+	}
+	return found
+}
+
+// apiValidate checks a request's parameters against its operation. Empty values count as missing, as forms send
+// empty fields, and parameters an operation doesn't list are ignored.
+func apiValidate(op *apiOperation, r *http.Request, params map[string]string) error {
+	if len(op.body) > 0 {
+		kind, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if kind == op.body {
+			return nil
+		}
+	}
+	for _, param := range op.params {
+		value := strings.TrimSpace(params[param.name])
+		if param.kind == "file" {
+			continue
+		}
+		if len(value) == 0 {
+			if param.required {
+				return invalidParam(param.name, "%s is required", param.name)
+			}
+			continue
+		}
+		switch param.kind {
+		case "integer":
+			if _, err := strconv.Atoi(value); err != nil {
+				return invalidParam(param.name, "%s must be an integer", param.name)
+			}
+		case "boolean":
+			if value != "true" && value != "false" {
+				return invalidParam(param.name, "%s must be true or false", param.name)
+			}
+		}
+		if len(param.values) > 0 {
+			found := false
+			for _, v := range param.values {
+				found = found || strings.EqualFold(v, value)
+			}
+			if !found {
+				return invalidParam(param.name, "%s must be one of %s", param.name, strings.Join(param.values, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+func apiSchema(param apiParam) map[string]interface{} {
+	schema := map[string]interface{}{"type": param.kind}
+	if param.kind == "file" {
+		schema = map[string]interface{}{"type": "string", "format": "binary"}
+	}
+	if len(param.values) > 0 {
+		schema["enum"] = param.values
+	}
+	if len(param.doc) > 0 {
+		schema["description"] = param.doc
+	}
+	return schema
+}
+
+func apiDocument() map[string]interface{} {
+	apiServer := "/"
+	if len(publicURL) > 0 {
+		apiServer = publicURL
+	}
+	paths := make(map[string]interface{})
+	for _, op := range apiOperations {
+		operation := map[string]interface{}{
+			"summary":     op.summary,
+			"operationId": strings.ToLower(op.method) + strings.NewReplacer("/", "_", ".", "_", "-", "_").Replace(op.path),
+			"tags":        []string{strings.SplitN(strings.TrimPrefix(op.path, "/"), "/", 2)[0]},
+		}
+		if len(op.role) > 0 {
+			operation["security"] = []interface{}{map[string]interface{}{"token": []string{}}}
+			operation["description"] = fmt.Sprintf("Requires a login with the %s role. Without one, the login page is returned.", op.role)
+		}
+		properties := make(map[string]interface{})
+		required := make([]string, 0)
+		parameters := make([]interface{}, 0)
+		multipart := false
+		for _, param := range op.params {
+			multipart = multipart || param.kind == "file"
+			if param.required {
+				required = append(required, param.name)
+			}
+			properties[param.name] = apiSchema(param)
+			if param.kind != "file" && (op.method == "GET" || len(op.body) > 0) {
+				parameters = append(parameters, map[string]interface{}{
+					"name":     param.name,
+					"in":       "query",
+					"required": param.required,
+					"schema":   apiSchema(param),
+				})
+			}
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		content := make(map[string]interface{})
+		if len(op.body) > 0 {
+			content[op.body] = map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}
+		} else if op.method != "GET" && len(op.params) > 0 {
+			content["application/x-www-form-urlencoded"] = map[string]interface{}{"schema": schema}
+			content["application/json"] = map[string]interface{}{"schema": schema}
+		}
+		if multipart {
+			content["multipart/form-data"] = map[string]interface{}{"schema": schema}
+		}
+		if len(content) > 0 {
+			operation["requestBody"] = map[string]interface{}{"content": content}
+		}
+		responses := map[string]interface{}{
+			"default": map[string]interface{}{"description": "Error", "content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"}},
+			}},
+		}
+		if op.response == "websocket" {
+			responses["101"] = map[string]interface{}{"description": "Switching to a WebSocket"}
+		} else {
+			responses["200"] = map[string]interface{}{"description": "Success", "content": map[string]interface{}{
+				apiResponses[op.response]: map[string]interface{}{"schema": map[string]interface{}{}},
+			}}
+		}
+		operation["responses"] = responses
+		item, _ := paths[op.path].(map[string]interface{})
+		if item == nil {
+			item = make(map[string]interface{})
+			paths[op.path] = item
+		}
+		item[strings.ToLower(op.method)] = operation
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "racs",
+			"version":     "1",
+			"description": "Actions accept any method, and parameters either in the query string or in a form, multipart or JSON body.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": apiServer}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"code", "message", "details"},
+					"properties": map[string]interface{}{
+						"code":    map[string]interface{}{"type": "string", "example": "invalid_parameter"},
+						"message": map[string]interface{}{"type": "string"},
+						"details": map[string]interface{}{"type": "object", "description": "e.g. the param that was invalid"},
+					},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"token": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "RACS_TOKEN"},
+			},
+		},
+	}
+}
+
+func handleAPIOpenAPI(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.MarshalIndent(apiDocument(), "", "  ")
+	w.Write(j)
+}
+
+// apiDocsPage loads Swagger UI from a CDN, so it needs a browser with internet access.
+const apiDocsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8"/>
+<title>racs API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css"/>
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({url: "/api/openapi.json", dom_id: "#swagger-ui", withCredentials: true});
+</script>
+</body>
+</html>
+`
+
+func handleAPIDocs(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(apiDocsPage))
+}
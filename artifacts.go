@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func artifactKey(pid, version int, path string) string {
+	return fmt.Sprintf("artifacts/%d/%d/%s", pid, version, filepath.ToSlash(path))
+}
+
+func artifactDelete(pid int, query string, args ...interface{}) {
+	rows, err := db.Query(`SELECT version, path FROM artifacts WHERE `+query, args...)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	keys := make([]string, 0)
+	for rows.Next() {
+		var version int
+		var path string
+		rows.Scan(&version, &path)
+		keys = append(keys, artifactKey(pid, version, path))
+	}
+	rows.Close()
+	for _, key := range keys {
+		err := store.Delete(key)
+		if err != nil {
+			logger.Warn(err)
+		}
+	}
+	db.Exec(`DELETE FROM artifacts WHERE `+query, args...)
+}
+
+func storeArtifact(source, key string) (int64, string, error) {
+	in, err := os.Open(source)
+	if err != nil {
+		return 0, "", err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, in)
+	in.Close()
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), store.Put(key, source)
+}
+
+func artifactCollect(p *project, t *task) {
+	p.lock.RLock()
+	artifacts, version := p.artifacts, p.version+1
+	p.lock.RUnlock()
+	if len(strings.TrimSpace(artifacts)) == 0 {
+		return
+	}
+	workspace := fmt.Sprintf("%s/%d/workspace", projectAbs, p.id)
+	artifactDelete(p.id, `project = ? AND version = ?`, p.id, version)
+	count := 0
+	for _, pattern := range strings.Split(artifacts, ",") {
+		pattern = filepath.Clean(strings.TrimSpace(pattern))
+		if filepath.IsAbs(pattern) || strings.HasPrefix(pattern, "..") {
+			logger.Warnf("Project %d artifact pattern %s is outside the workspace", p.id, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(workspace, pattern))
+		if err != nil {
+			logger.Warn(err)
+			continue
+		}
+		for _, match := range matches {
+			if !workspaceFile(workspace, match) {
+				continue
+			}
+			path, _ := filepath.Rel(workspace, match)
+			size, sum, err := storeArtifact(match, artifactKey(p.id, version, path))
+			if err != nil {
+				logger.Error(err)
+				continue
+			}
+			db.Exec(`INSERT INTO artifacts(project, version, task, path, size, sha256, time) VALUES(?, ?, ?, ?, ?, ?, datetime('now'))`,
+				p.id, version, t.id, path, size, sum)
+			count += 1
+		}
+	}
+	logger.Infof("Project %d collected %d artifacts for version %d", p.id, count, version)
+}
+
+func handleProjectArtifacts(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	query := `SELECT version, task, path, size, sha256, time FROM artifacts WHERE project = ? ORDER BY version DESC, path`
+	args := []interface{}{id}
+	if len(params["version"]) > 0 {
+		version, _ := strconv.Atoi(params["version"])
+		query = `SELECT version, task, path, size, sha256, time FROM artifacts WHERE project = ? AND version = ? ORDER BY path`
+		args = append(args, version)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]interface{}, 0)
+	for rows.Next() {
+		var version int
+		var tid int
+		var path string
+		var size int64
+		var sum string
+		var time string
+		rows.Scan(&version, &tid, &path, &size, &sum, &time)
+		result = append(result, map[string]interface{}{
+			"version": version,
+			"task":    tid,
+			"path":    path,
+			"size":    size,
+			"sha256":  sum,
+			"time":    time,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectArtifactsDownload(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	version, _ := strconv.Atoi(params["version"])
+	path := params["path"]
+	var sum string
+	err := db.QueryRow(`SELECT sha256 FROM artifacts WHERE project = ? AND version = ? AND path = ?`, id, version, path).Scan(&sum)
+	if err != nil {
+		writeError(w, notFound("Artifact"))
+		return
+	}
+	file, err := store.Open(artifactKey(id, version, path), 0)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, notFound("Artifact"))
+		return
+	}
+	defer file.Close()
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	w.Header().Add("X-Artifact-Sha256", sum)
+	io.Copy(w, file)
+}
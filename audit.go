@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var auditActions = map[string]bool{
+	"/user/login":               true,
+	"/setup/complete":           true,
+	"/user/logout":              true,
+	"/project/create":           true,
+	"/project/update":           true,
+	"/project/delete":           true,
+	"/project/import":           true,
+	"/project/export":           true,
+	"/project/clone":            true,
+	"/template/save":            true,
+	"/template/create":          true,
+	"/template/delete":          true,
+	"/project/upload":           true,
+	"/project/spec":             true,
+	"/project/files/delete":     true,
+	"/project/files/extract":    true,
+	"/project/triggers":         true,
+	"/project/after":            true,
+	"/api/v1/pipeline/apply":    true,
+	"/project/build":            true,
+	"/project/run":              true,
+	"/project/webhook/secret":   true,
+	"/project/approve":          true,
+	"/project/reject":           true,
+	"/project/deploy":           true,
+	"/project/caches/clear":     true,
+	"/project/variables/set":    true,
+	"/project/variables/delete": true,
+	"/project/parsers/set":      true,
+	"/project/parsers/delete":   true,
+	"/project/retries/set":      true,
+	"/project/retries/delete":   true,
+	"/project/variants/set":     true,
+	"/project/variants/delete":  true,
+	"/project/proposals/check":  true,
+	"/project/proposals/trial":  true,
+	"/project/proposals/accept": true,
+	"/project/proposals/reject": true,
+	"/project/labels/add":       true,
+	"/project/labels/remove":    true,
+	"/task/labels/add":          true,
+	"/task/labels/remove":       true,
+	"/task/snapshot":            true,
+	"/task/shell":               true,
+	"/task/shell/exec":          true,
+	"/task/shell/stop":          true,
+	"/search/save":              true,
+	"/search/delete":            true,
+	"/registry/create":          true,
+	"/admin/containers/reap":    true,
+	"/admin/prune/images":       true,
+	"/admin/prune/workspaces":   true,
+	"/admin/maintenance/start":  true,
+	"/admin/maintenance/stop":   true,
+	"/admin/restart":            true,
+	"/chaos/inject":             true,
+	"/chaos/clear":              true,
+}
+
+var auditSecrets = map[string]bool{
+	"password":         true,
+	"registryPassword": true,
+	"token":            true,
+	"secret":           true,
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func auditRecord(path string, r *http.Request, u *user, params map[string]string, status int) {
+	recorded := make(map[string]string)
+	for name, value := range params {
+		if auditSecrets[name] || (name == "value" && (params["secret"] == "true" || path == "/project/upload")) || (name == "content" && path == "/project/spec") {
+			value = "******"
+		}
+		recorded[name] = value
+	}
+	if r.MultipartForm != nil {
+		for name, files := range r.MultipartForm.File {
+			for _, file := range files {
+				recorded["file:"+name] = file.Filename
+			}
+		}
+	}
+	j, _ := json.Marshal(recorded)
+	pid := 0
+	if strings.HasPrefix(path, "/project/") {
+		pid, _ = strconv.Atoi(params["id"])
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	name := u.Name
+	if path == "/user/login" || path == "/setup/complete" {
+		name = params["username"]
+	}
+	db.Exec(`INSERT INTO audit(time, user, ip, action, project, params, status) VALUES(datetime('now'), ?, ?, ?, ?, ?, ?)`,
+		name, ip, path, pid, string(j), status)
+}
+
+func handleAdminAudit(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/admin/audit", params) {
+		return
+	}
+	query := `SELECT id, time, user, ip, action, project, params, status FROM audit WHERE 1 = 1`
+	args := make([]interface{}, 0)
+	if len(params["user"]) > 0 {
+		query += ` AND user = ?`
+		args = append(args, params["user"])
+	}
+	if len(params["action"]) > 0 {
+		query += ` AND action = ?`
+		args = append(args, params["action"])
+	}
+	if len(params["project"]) > 0 {
+		pid, _ := strconv.Atoi(params["project"])
+		query += ` AND project = ?`
+		args = append(args, pid)
+	}
+	if len(params["from"]) > 0 {
+		query += ` AND time >= ?`
+		args = append(args, params["from"])
+	}
+	if to := params["to"]; len(to) > 0 {
+		if len(to) == len("2006-01-02") {
+			to += " 23:59:59"
+		}
+		query += ` AND time <= ?`
+		args = append(args, to)
+	}
+	limit, _ := strconv.Atoi(params["limit"])
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var id int
+		var time string
+		var name string
+		var ip string
+		var action string
+		var pid int
+		var recorded string
+		var status int
+		rows.Scan(&id, &time, &name, &ip, &action, &pid, &recorded, &status)
+		values := make(map[string]string)
+		json.Unmarshal([]byte(recorded), &values)
+		result = append(result, map[string]interface{}{
+			"id":      id,
+			"time":    time,
+			"user":    name,
+			"ip":      ip,
+			"action":  action,
+			"project": pid,
+			"params":  values,
+			"status":  status,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
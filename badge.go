@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var badgePath = regexp.MustCompile(`^/project/(\d+)/badge\.svg$`)
+
+type badgeSegment struct {
+	text  string
+	color string
+}
+
+func badgeSVG(segments ...badgeSegment) string {
+	var sb strings.Builder
+	total := 0
+	widths := make([]int, len(segments))
+	for i, segment := range segments {
+		widths[i] = len(segment.text)*7 + 10
+		total += widths[i]
+	}
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img">`, total)
+	fmt.Fprintf(&sb, `<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	fmt.Fprintf(&sb, `<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath><g clip-path="url(#r)">`, total)
+	x := 0
+	for i, segment := range segments {
+		fmt.Fprintf(&sb, `<rect x="%d" width="%d" height="20" fill="%s"/>`, x, widths[i], segment.color)
+		x += widths[i]
+	}
+	fmt.Fprintf(&sb, `<rect width="%d" height="20" fill="url(#s)"/></g>`, total)
+	sb.WriteString(`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+	x = 0
+	for i, segment := range segments {
+		text := html.EscapeString(segment.text)
+		center := x + widths[i]/2
+		fmt.Fprintf(&sb, `<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%d" y="14">%s</text>`, center, text, center, text)
+		x += widths[i]
+	}
+	sb.WriteString(`</g></svg>`)
+	return sb.String()
+}
+
+func handleProjectBadge(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	var built int
+	db.QueryRow(`SELECT COUNT(*) FROM tasks WHERE project = ? AND type = 'BUILDING' AND state != 'RUNNING'`, p.id).Scan(&built)
+	status := badgeSegment{"passing", "#4c1"}
+	if state := p.currentState(); state.failed() {
+		status = badgeSegment{"failing", "#e05d44"}
+	} else if state.running() {
+		status = badgeSegment{"building", "#dfb317"}
+	} else if built == 0 {
+		status = badgeSegment{"unknown", "#9f9f9f"}
+	}
+	w.Header().Add("Content-Type", "image/svg+xml")
+	w.Header().Add("Cache-Control", "no-cache, max-age=0")
+	w.Write([]byte(badgeSVG(
+		badgeSegment{"racs", "#555"},
+		status,
+		badgeSegment{"v" + strconv.Itoa(p.currentVersion()), "#007ec6"},
+	)))
+}
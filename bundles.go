@@ -0,0 +1,403 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const bundleFormat = 1
+
+// bundleEntries is the most entries a bundle may have, so that an import can't be made to create any number of files.
+const bundleEntries = 10000
+
+func bundleRows(query string, pid int) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0)
+	rows, err := db.Query(query, pid)
+	if err != nil {
+		logger.Error(err)
+		return result
+	}
+	defer rows.Close()
+	columns, _ := rows.Columns()
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		rows.Scan(pointers...)
+		row := make(map[string]interface{})
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[column] = values[i]
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+func bundleFile(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
+
+func projectExport(p *project, out io.Writer, secrets, history bool) error {
+	variables := make([]map[string]interface{}, 0)
+	for _, v := range p.variableList() {
+		variable := map[string]interface{}{
+			"name":   v.name,
+			"kind":   v.kind,
+			"secret": v.secret,
+		}
+		if !v.secret || secrets {
+			variable["value"] = v.value
+		}
+		variables = append(variables, variable)
+	}
+	bundle := map[string]interface{}{
+		"format":    bundleFormat,
+		"settings":  projectSettings(p),
+		"variables": variables,
+		"parsers":   bundleRows(`SELECT stage, name, pattern, mode FROM parsers WHERE project = ?`, p.id),
+		"retries":   bundleRows(`SELECT stage, count, backoff FROM retries WHERE project = ?`, p.id),
+		"variants":  bundleRows(`SELECT name, buildSpec, IFNULL(triggers, '') AS triggers FROM variants WHERE project = ?`, p.id),
+	}
+	if history {
+		bundle["tasks"] = bundleRows(`SELECT type, state, time, IFNULL(branch, '') AS branch, IFNULL(attempt, 0) AS attempt,
+			IFNULL(sha, '') AS sha, IFNULL(version, 0) AS version, IFNULL(duration, 0) AS duration,
+			IFNULL(finished, '') AS finished, IFNULL(exitCode, -1) AS exit
+			FROM tasks WHERE project = ? ORDER BY id`, p.id)
+	}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	j, _ := json.MarshalIndent(bundle, "", "  ")
+	if err := bundleFile(tw, "project.json", j); err != nil {
+		return err
+	}
+	for spec, content := range projectSpecs(p) {
+		if err := bundleFile(tw, "files/"+strings.TrimPrefix(filepath.Clean("/"+spec), "/"), []byte(content)); err != nil {
+			return err
+		}
+	}
+	root := fmt.Sprintf("%s/%d", projectAbs, p.id)
+	for _, dir := range []string{"context", "hooks"} {
+		err := filepath.Walk(root+"/"+dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return bundleFile(tw, "files/"+strings.TrimPrefix(path, root+"/"), content)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func bundleText(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return ""
+}
+
+// readBundle unpacks a bundle's project.json and its files into temporary uploads. The files it returns must be removed
+// by the caller if the import doesn't use them, even when there's an error.
+func readBundle(in io.Reader) (map[string]interface{}, map[string]string, error) {
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(gz)
+	var bundle map[string]interface{}
+	files := make(map[string]string)
+	var total int64
+	for count := 0; ; count++ {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, files, err
+		}
+		if count >= bundleEntries {
+			return nil, files, fmt.Errorf("bundle has over %d entries", bundleEntries)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		total += header.Size
+		if total > archiveLimit {
+			return nil, files, fmt.Errorf("bundle is over the limit of %d bytes", archiveLimit)
+		}
+		if header.Name == "project.json" {
+			content, err := ioutil.ReadAll(io.LimitReader(tr, specLimit*16))
+			if err != nil {
+				return nil, files, err
+			}
+			if err := json.Unmarshal(content, &bundle); err != nil {
+				return nil, files, fmt.Errorf("project.json: %v", err)
+			}
+		} else if strings.HasPrefix(header.Name, "files/") {
+			// Files are checked against the upload slots once the project's settings are known.
+			temp, err := ioutil.TempFile("uploads", "upload-")
+			if err != nil {
+				return nil, files, err
+			}
+			_, err = io.Copy(temp, io.LimitReader(tr, contextLimit+1))
+			temp.Close()
+			if err != nil {
+				os.Remove(temp.Name())
+				return nil, files, err
+			}
+			name := strings.TrimPrefix(header.Name, "files/")
+			if previous, ok := files[name]; ok {
+				os.Remove(previous)
+			}
+			files[name] = temp.Name()
+		}
+	}
+	if bundle == nil {
+		return nil, files, fmt.Errorf("bundle has no project.json")
+	}
+	if format, _ := bundle["format"].(float64); int(format) != bundleFormat {
+		return nil, files, fmt.Errorf("unsupported bundle format %v", bundle["format"])
+	}
+	return bundle, files, nil
+}
+
+func projectImport(bundle map[string]interface{}, files map[string]string, overrides map[string]string, author string) (*project, []string, error) {
+	settings := make(map[string]string)
+	if values, ok := bundle["settings"].(map[string]interface{}); ok {
+		for name, value := range values {
+			settings[name] = bundleText(value)
+		}
+	}
+	for name, value := range overrides {
+		if len(value) > 0 {
+			settings[name] = value
+		}
+	}
+	if !validLimits(settings) {
+		return nil, nil, fmt.Errorf("invalid resource limits")
+	}
+	if !validScan(settings) {
+		return nil, nil, fmt.Errorf("invalid scanner settings")
+	}
+	if !validSigning(settings) {
+		return nil, nil, fmt.Errorf("invalid signing setting")
+	}
+	if !validSBOM(settings) {
+		return nil, nil, fmt.Errorf("invalid SBOM format")
+	}
+	if !validSource(settings) {
+		return nil, nil, fmt.Errorf("invalid source kind")
+	}
+	for _, name := range []string{"buildSpec", "packageSpec"} {
+		if len(settings[name]) == 0 {
+			settings[name] = strings.ToUpper(name[:1]) + name[1:]
+		}
+	}
+	p := projectCreate(settings["name"], settings["url"], settings["branch"], settings["destination"], settings["tag"], author)
+	p.lock.Lock()
+	p.applySettings(settings)
+	p.lock.Unlock()
+	skipped := make([]string, 0)
+	variables, _ := bundle["variables"].([]interface{})
+	for _, value := range variables {
+		row, _ := value.(map[string]interface{})
+		v := &variable{bundleText(row["name"]), bundleText(row["value"]), bundleText(row["kind"]), row["secret"] == true}
+		if _, ok := row["value"]; !ok || !variableName.MatchString(v.name) || !variableKinds[v.kind] {
+			skipped = append(skipped, "variable:"+v.name)
+			continue
+		}
+		p.setVariable(v)
+		db.Exec(`REPLACE INTO variables(project, name, value, kind, secret) VALUES(?, ?, ?, ?, ?)`, p.id, v.name, v.value, v.kind, v.secret)
+	}
+	parsers, _ := bundle["parsers"].([]interface{})
+	for _, value := range parsers {
+		row, _ := value.(map[string]interface{})
+		if _, err := regexp.Compile(bundleText(row["pattern"])); err != nil {
+			skipped = append(skipped, "parser:"+bundleText(row["name"]))
+			continue
+		}
+		db.Exec(`REPLACE INTO parsers(project, stage, name, pattern, mode) VALUES(?, ?, ?, ?, ?)`,
+			p.id, bundleText(row["stage"]), bundleText(row["name"]), bundleText(row["pattern"]), bundleText(row["mode"]))
+	}
+	retries, _ := bundle["retries"].([]interface{})
+	for _, value := range retries {
+		row, _ := value.(map[string]interface{})
+		count, _ := row["count"].(float64)
+		backoff, _ := row["backoff"].(float64)
+		db.Exec(`REPLACE INTO retries(project, stage, count, backoff) VALUES(?, ?, ?, ?)`, p.id, bundleText(row["stage"]), int(count), int(backoff))
+	}
+	variants, _ := bundle["variants"].([]interface{})
+	for _, value := range variants {
+		row, _ := value.(map[string]interface{})
+		if !variantName.MatchString(bundleText(row["name"])) {
+			skipped = append(skipped, "variant:"+bundleText(row["name"]))
+			continue
+		}
+		db.Exec(`REPLACE INTO variants(project, name, buildSpec, triggers) VALUES(?, ?, ?, ?)`,
+			p.id, bundleText(row["name"]), strings.TrimPrefix(filepath.Clean("/"+bundleText(row["buildSpec"])), "/"), bundleText(row["triggers"]))
+	}
+	for name, upload := range files {
+		name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+		path := fmt.Sprintf("%s/%d/%s", projectAbs, p.id, name)
+		if slot := uploadSlotFor(p, name); slot == nil {
+			skipped = append(skipped, "file:"+name)
+		} else if _, err := slot.check(upload); err != nil {
+			skipped = append(skipped, "file:"+name)
+		} else {
+			makeDir(filepath.Dir(path))
+			if err := os.Rename(upload, path); err != nil {
+				logger.Error(err)
+				skipped = append(skipped, "file:"+name)
+			} else {
+				applyMode(path, fileMode)
+			}
+		}
+		os.Remove(upload)
+	}
+	tasks, _ := bundle["tasks"].([]interface{})
+	for _, value := range tasks {
+		row, _ := value.(map[string]interface{})
+		attempt, _ := row["attempt"].(float64)
+		version, _ := row["version"].(float64)
+		duration, _ := row["duration"].(float64)
+		// Bundles from before exit codes were recorded don't have them.
+		exit, ok := row["exit"].(float64)
+		if !ok {
+			exit = -1
+		}
+		var id int
+		err := db.QueryRow(`INSERT INTO tasks(project, type, state, time, started, finished, branch, attempt, sha, version, duration, exitCode)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+			p.id, bundleText(row["type"]), bundleText(row["state"]), bundleText(row["time"]), bundleText(row["time"]), bundleText(row["finished"]),
+			bundleText(row["branch"]), int(attempt), bundleText(row["sha"]), int(version), duration, int(exit)).Scan(&id)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		p.addTask(&task{id, bundleText(row["type"]), bundleText(row["state"]), bundleText(row["time"]), 0, make(map[string]string), int(attempt),
+			bundleText(row["finished"]), duration, int(exit)})
+	}
+	projectRevise(p, author)
+	logger.Infof("Project %d imported by %s", p.id, author)
+	return p, skipped, nil
+}
+
+func projectOverrides(params map[string]string) map[string]string {
+	return map[string]string{
+		"name":        params["name"],
+		"url":         params["url"],
+		"branch":      params["branch"],
+		"destination": params["destination"],
+		"tag":         params["tag"],
+	}
+}
+
+func writeCreated(w http.ResponseWriter, params map[string]string, p *project, skipped []string) {
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(201)
+	j, _ := json.Marshal(map[string]interface{}{
+		"id":      p.id,
+		"skipped": skipped,
+	})
+	w.Write(j)
+}
+
+func handleProjectExport(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/export", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	w.Header().Add("Content-Type", "application/gzip")
+	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="racs-project-%d.tar.gz"`, p.id))
+	err := projectExport(p, w, params["secrets"] == "true", params["history"] == "true")
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func handleProjectImport(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/import", params) {
+		return
+	}
+	var in io.Reader = r.Body
+	if r.MultipartForm != nil {
+		files := r.MultipartForm.File["file"]
+		if len(files) == 0 {
+			writeError(w, badRequest("No bundle"))
+			return
+		}
+		file, err := files[0].Open()
+		if err != nil {
+			logger.Error(err)
+			writeError(w, err)
+			return
+		}
+		defer file.Close()
+		in = file
+	}
+	bundle, files, err := readBundle(in)
+	if err != nil {
+		for _, upload := range files {
+			os.Remove(upload)
+		}
+		writeError(w, badRequest("%v", err))
+		return
+	}
+	p, skipped, err := projectImport(bundle, files, projectOverrides(params), u.Name)
+	if err != nil {
+		for _, upload := range files {
+			os.Remove(upload)
+		}
+		writeError(w, badRequest("%v", err))
+		return
+	}
+	writeCreated(w, params, p, skipped)
+}
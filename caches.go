@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func projectCaches(p *project) []string {
+	caches := make([]string, 0)
+	for _, cache := range strings.FieldsFunc(p.caches, func(c rune) bool {
+		return c == ',' || c == '\n'
+	}) {
+		cache = strings.TrimSpace(cache)
+		if filepath.IsAbs(cache) {
+			caches = append(caches, filepath.Clean(cache))
+		} else if len(cache) > 0 {
+			logger.Warnf("Project %d ignoring relative cache path %s", p.id, cache)
+		}
+	}
+	return caches
+}
+
+func cacheDir(p *project, cache string) string {
+	name := strings.Replace(strings.Trim(cache, "/"), "/", "_", -1)
+	dir := fmt.Sprintf("%s/%d/cache/%s", projectAbs, p.id, name)
+	makeDir(dir)
+	return dir
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func handleProjectCaches(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	result := make([]map[string]interface{}, 0)
+	for _, cache := range projectCaches(p) {
+		result = append(result, map[string]interface{}{
+			"path": cache,
+			"size": dirSize(cacheDir(p, cache)),
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectCachesClear(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/caches/clear", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	path := params["path"]
+	for _, cache := range projectCaches(p) {
+		if len(path) == 0 || path == cache {
+			dir := cacheDir(p, cache)
+			logger.Infof("Project %d clearing cache %s", p.id, cache)
+			err := os.RemoveAll(dir)
+			if err != nil {
+				logger.Error(err)
+			}
+			makeDir(dir)
+		}
+	}
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type fault struct {
+	id      int
+	kind    string
+	project int
+	stage   string
+	count   int
+	delay   time.Duration
+}
+
+var chaosEnabled bool = false
+var chaosLock sync.Mutex
+var chaosFaults = make([]*fault, 0)
+var chaosNext = 1
+
+func chaosTake(p *project, state state) *fault {
+	chaosLock.Lock()
+	defer chaosLock.Unlock()
+	for i, f := range chaosFaults {
+		if f.project != 0 && f.project != p.id {
+			continue
+		}
+		if len(f.stage) > 0 && stageStates[f.stage] != state {
+			continue
+		}
+		f.count -= 1
+		if f.count <= 0 {
+			chaosFaults = append(chaosFaults[:i], chaosFaults[i+1:]...)
+		}
+		logger.Warnf("Chaos injecting %s into project %d %s", f.kind, p.id, state.String())
+		return f
+	}
+	return nil
+}
+
+func chaosRun(f *fault, cmd *exec.Cmd) error {
+	if f == nil || f.kind != "timeout" {
+		return cmd.Run()
+	}
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	timer := time.AfterFunc(f.delay, func() {
+		cmd.Process.Kill()
+	})
+	err = cmd.Wait()
+	if !timer.Stop() {
+		return errors.New("chaos: stage timed out")
+	}
+	return err
+}
+
+func chaosDenied(w http.ResponseWriter, u *user, path string, params map[string]string) bool {
+	if !chaosEnabled {
+		writeError(w, statusError(404, "Failure injection is not enabled"))
+		return true
+	}
+	return checkLogin(u, "admin", w, path, params)
+}
+
+func handleChaosInject(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if chaosDenied(w, u, "/chaos/inject", params) {
+		return
+	}
+	kind := params["kind"]
+	if kind == "disconnect" {
+		logger.Warn("Chaos disconnecting event clients")
+		clients.events <- nil
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+		return
+	}
+	if kind != "timeout" && kind != "db" {
+		writeError(w, invalidParam("kind", "kind must be timeout, db or disconnect"))
+		return
+	}
+	if _, ok := stageStates[params["stage"]]; len(params["stage"]) > 0 && !ok {
+		writeError(w, invalidParam("stage", "Unknown stage %s", params["stage"]))
+		return
+	}
+	pid, _ := strconv.Atoi(params["project"])
+	count, _ := strconv.Atoi(params["count"])
+	if count <= 0 {
+		count = 1
+	}
+	delay, _ := strconv.Atoi(params["delay"])
+	if delay <= 0 {
+		delay = 1
+	}
+	chaosLock.Lock()
+	f := &fault{chaosNext, kind, pid, params["stage"], count, time.Duration(delay) * time.Second}
+	chaosNext += 1
+	chaosFaults = append(chaosFaults, f)
+	chaosLock.Unlock()
+	logger.Warnf("Chaos armed %s for project %d stage %s (%d times)", f.kind, f.project, f.stage, f.count)
+	w.WriteHeader(200)
+	w.Write([]byte(strconv.Itoa(f.id)))
+}
+
+func handleChaosList(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if chaosDenied(w, u, "/chaos/list", params) {
+		return
+	}
+	chaosLock.Lock()
+	result := make([]map[string]interface{}, 0)
+	for _, f := range chaosFaults {
+		result = append(result, map[string]interface{}{
+			"id":      f.id,
+			"kind":    f.kind,
+			"project": f.project,
+			"stage":   f.stage,
+			"count":   f.count,
+			"delay":   int(f.delay.Seconds()),
+		})
+	}
+	chaosLock.Unlock()
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleChaosClear(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if chaosDenied(w, u, "/chaos/clear", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	chaosLock.Lock()
+	faults := make([]*fault, 0)
+	for _, f := range chaosFaults {
+		if id != 0 && f.id != id {
+			faults = append(faults, f)
+		}
+	}
+	chaosFaults = faults
+	chaosLock.Unlock()
+	w.WriteHeader(200)
+	w.Write([]byte("OK"))
+}
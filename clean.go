@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+type cleanStats struct {
+	files   int
+	bytes   int64
+	skipped int
+}
+
+func removeTree(out io.Writer, path string, device uint64, stats *cleanStats) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok && uint64(sys.Dev) != device {
+		fmt.Fprintf(out, "skipping mount point %s\n", path)
+		stats.skipped += 1
+		return nil
+	}
+	if info.IsDir() {
+		if info.Mode().Perm()&0700 != 0700 {
+			os.Chmod(path, info.Mode().Perm()|0700)
+		}
+		dir, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err = removeTree(out, filepath.Join(path, name), device, stats)
+			if err != nil {
+				return err
+			}
+		}
+	} else if info.Mode().IsRegular() {
+		stats.bytes += info.Size()
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		if info.IsDir() && stats.skipped > 0 {
+			// A mount point still exists below this directory.
+			return nil
+		}
+		return err
+	}
+	stats.files += 1
+	return nil
+}
+
+// withinDir reports whether path is root or inside it, going by the names alone.
+func withinDir(root, path string) bool {
+	path, _ = filepath.Abs(path)
+	root, _ = filepath.Abs(root)
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// workspaceFile reports whether path is a regular file in a workspace. Builds write their workspace, so a path in it
+// can be a symlink, or be in a symlinked directory, to a host file that racs must not read.
+func workspaceFile(workspace, path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	root, err := filepath.EvalSymlinks(workspace)
+	return err == nil && withinDir(root, resolved)
+}
+
+func cleanPath(out io.Writer, path, root string) error {
+	path, _ = filepath.Abs(path)
+	root, _ = filepath.Abs(root)
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("refusing to remove %s: not inside %s", path, root)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("unable to determine device of " + root)
+	}
+	stats := &cleanStats{}
+	err = removeTree(out, path, uint64(sys.Dev), stats)
+	fmt.Fprintf(out, "removed %d entries, freed %d bytes", stats.files, stats.bytes)
+	if stats.skipped > 0 {
+		fmt.Fprintf(out, ", skipped %d mount points", stats.skipped)
+	}
+	fmt.Fprintln(out)
+	return err
+}
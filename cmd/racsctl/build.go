@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const pollInterval = 2 * time.Second
+
+// tail prints what has been added to a task's log since offset, and returns the new offset and the task's state.
+func tail(c *client, task int, offset int64) (int64, string, error) {
+	data, response, err := c.get("/task/logs", url.Values{"id": {strconv.Itoa(task)}, "offset": {strconv.FormatInt(offset, 10)}})
+	if err != nil {
+		return offset, "", err
+	}
+	os.Stdout.Write(data)
+	return offset + int64(len(data)), response.Header.Get("X-Task-State"), nil
+}
+
+func buildStatus(c *client, build int) (map[string]interface{}, error) {
+	data, _, err := c.get("/project/build/status", url.Values{"build": {strconv.Itoa(build)}})
+	if err != nil {
+		return nil, err
+	}
+	var status map[string]interface{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("/project/build/status: %v", err)
+	}
+	return status, nil
+}
+
+// wait polls a build until it finishes, returning 0 if it succeeded and 1 if it failed. With logs, each stage's log is
+// printed as it runs.
+func wait(c *client, build int, logs bool) int {
+	offsets := make(map[int]int64)
+	finished := make(map[int]bool)
+	for {
+		status, err := buildStatus(c, build)
+		if err != nil {
+			return fail(err)
+		}
+		state := text(status["state"])
+		if logs {
+			tasks, _ := status["tasks"].([]interface{})
+			for _, t := range tasks {
+				task, _ := t.(map[string]interface{})
+				id := number(task["id"])
+				if finished[id] {
+					continue
+				}
+				if _, ok := offsets[id]; !ok {
+					fmt.Fprintf(os.Stderr, "racsctl: %s (task %d)\n", text(task["type"]), id)
+				}
+				offset, taskState, err := tail(c, id, offsets[id])
+				if err != nil {
+					return fail(err)
+				}
+				offsets[id] = offset
+				finished[id] = taskState != "RUNNING"
+			}
+		}
+		if state != "RUNNING" {
+			fmt.Fprintf(os.Stderr, "racsctl: build %d %s\n", build, state)
+			if state == "SUCCESS" {
+				return 0
+			}
+			return 1
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func mainBuild(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	c := clientFlags(flags)
+	run := flags.String("run", "full", "Stages to run: full, from:STAGE or only:STAGE")
+	labels := flags.String("labels", "", "Labels for the build's tasks")
+	waitFlag := flags.Bool("wait", false, "Wait for the build to finish and exit with its result")
+	logs := flags.Bool("logs", false, "Print the build's logs as it runs (implies -wait)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: racsctl build [options] PROJECT")
+		flags.PrintDefaults()
+		return 2
+	}
+	if _, err := strconv.Atoi(flags.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "racsctl: invalid project id %s\n", flags.Arg(0))
+		return 2
+	}
+	data, _, err := c.post("/project/run", url.Values{"id": {flags.Arg(0)}, "run": {*run}, "labels": {*labels}})
+	if err != nil {
+		return fail(err)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fail(fmt.Errorf("/project/run: %v", err))
+	}
+	build := number(result["build"])
+	if !*waitFlag && !*logs {
+		fmt.Println(build)
+		return 0
+	}
+	stages, _ := result["stages"].([]interface{})
+	names := make([]string, 0)
+	for _, stage := range stages {
+		names = append(names, text(stage))
+	}
+	fmt.Fprintf(os.Stderr, "racsctl: build %d queued: %s\n", build, strings.Join(names, ", "))
+	return wait(c, build, *logs)
+}
+
+func mainWait(args []string) int {
+	flags := flag.NewFlagSet("wait", flag.ExitOnError)
+	c := clientFlags(flags)
+	logs := flags.Bool("logs", false, "Print the build's logs as it runs")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: racsctl wait [options] BUILD")
+		flags.PrintDefaults()
+		return 2
+	}
+	build, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "racsctl: invalid build id %s\n", flags.Arg(0))
+		return 2
+	}
+	return wait(c, build, *logs)
+}
+
+func mainLogs(args []string) int {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	c := clientFlags(flags)
+	follow := flags.Bool("f", false, "Follow the log until the task finishes")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: racsctl logs [options] TASK")
+		flags.PrintDefaults()
+		return 2
+	}
+	task, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "racsctl: invalid task id %s\n", flags.Arg(0))
+		return 2
+	}
+	var offset int64
+	for {
+		var state string
+		offset, state, err = tail(c, task, offset)
+		if err != nil {
+			return fail(err)
+		}
+		if !*follow || state != "RUNNING" {
+			return 0
+		}
+		time.Sleep(pollInterval)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type client struct {
+	server string
+	token  string
+}
+
+func (c *client) request(method, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, strings.TrimSuffix(c.server, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.token) > 0 {
+		request.AddCookie(&http.Cookie{Name: "RACS_TOKEN", Value: c.token})
+	}
+	return request, nil
+}
+
+// call makes a request and returns its body, or an error for a failed request. The server answers a request it
+// needs a login for with its login page rather than an error status.
+func (c *client) call(method, path string, body io.Reader, contentType string) ([]byte, *http.Response, error) {
+	request, err := c.request(method, path, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(contentType) > 0 {
+		request.Header.Set("Content-Type", contentType)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if kind, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); kind == "application/xhtml+xml" {
+		return nil, nil, fmt.Errorf("%s: login required, give a token with -token or RACS_TOKEN", strings.SplitN(path, "?", 2)[0])
+	}
+	if response.StatusCode >= 400 {
+		message := strings.TrimSpace(string(data))
+		var e map[string]interface{}
+		if json.Unmarshal(data, &e) == nil && len(text(e["message"])) > 0 {
+			message = text(e["message"])
+		}
+		if len(message) == 0 {
+			message = response.Status
+		}
+		return nil, nil, fmt.Errorf("%s: %s", strings.SplitN(path, "?", 2)[0], message)
+	}
+	return data, response, nil
+}
+
+func (c *client) get(path string, query url.Values) ([]byte, *http.Response, error) {
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return c.call("GET", path, nil, "")
+}
+
+func (c *client) post(path string, form url.Values) ([]byte, *http.Response, error) {
+	return c.call("POST", path, strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+}
+
+// fail reports an error from a request, exiting with status 3 so that scripts can tell it from a failed build.
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "racsctl: %v\n", err)
+	return 3
+}
+
+func env(name, fallback string) string {
+	if value := os.Getenv(name); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
+
+func clientFlags(flags *flag.FlagSet) *client {
+	c := &client{}
+	flags.StringVar(&c.server, "server", env("RACS_SERVER", "http://localhost:8080"), "racs server URL")
+	flags.StringVar(&c.token, "token", os.Getenv("RACS_TOKEN"), "racs login token (the RACS_TOKEN cookie)")
+	return c
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: racsctl <command> [options]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  login USER                  Log in and print a token for RACS_TOKEN")
+	fmt.Fprintln(os.Stderr, "  projects                    List projects")
+	fmt.Fprintln(os.Stderr, "  create NAME URL BRANCH      Create a project")
+	fmt.Fprintln(os.Stderr, "  upload PROJECT FILE [NAME]  Upload a container spec or context file")
+	fmt.Fprintln(os.Stderr, "  build PROJECT               Start a build")
+	fmt.Fprintln(os.Stderr, "  wait BUILD                  Wait for a build to finish")
+	fmt.Fprintln(os.Stderr, "  logs TASK                   Print a task's log")
+	fmt.Fprintln(os.Stderr, "  watch PROJECT               Follow a project's build until it finishes")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Run racsctl <command> -h for a command's options.")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "login":
+		os.Exit(mainLogin(os.Args[2:]))
+	case "projects":
+		os.Exit(mainProjects(os.Args[2:]))
+	case "create":
+		os.Exit(mainCreate(os.Args[2:]))
+	case "upload":
+		os.Exit(mainUpload(os.Args[2:]))
+	case "build":
+		os.Exit(mainBuild(os.Args[2:]))
+	case "wait":
+		os.Exit(mainWait(os.Args[2:]))
+	case "logs":
+		os.Exit(mainLogs(os.Args[2:]))
+	case "watch":
+		os.Exit(mainWatch(os.Args[2:]))
+	default:
+		usage()
+	}
+}
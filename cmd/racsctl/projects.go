@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+func terminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// password reads a password from RACS_PASSWORD, or else a line of standard input, without echoing it when that is a
+// terminal.
+func password() (string, error) {
+	if value := os.Getenv("RACS_PASSWORD"); len(value) > 0 {
+		return value, nil
+	}
+	if terminal(os.Stdin) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		stty := exec.Command("stty", "-echo")
+		stty.Stdin = os.Stdin
+		if stty.Run() == nil {
+			defer func() {
+				stty := exec.Command("stty", "echo")
+				stty.Stdin = os.Stdin
+				stty.Run()
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func mainLogin(args []string) int {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	c := clientFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: racsctl login [options] USER")
+		flags.PrintDefaults()
+		return 2
+	}
+	secret, err := password()
+	if err != nil {
+		return fail(err)
+	}
+	_, response, err := c.post("/user/login", url.Values{"username": {flags.Arg(0)}, "password": {secret}})
+	if err != nil {
+		return fail(err)
+	}
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == "RACS_TOKEN" {
+			fmt.Println(cookie.Value)
+			return 0
+		}
+	}
+	return fail(fmt.Errorf("/user/login: no token in response"))
+}
+
+func mainProjects(args []string) int {
+	flags := flag.NewFlagSet("projects", flag.ExitOnError)
+	c := clientFlags(flags)
+	asJSON := flags.Bool("json", false, "Print the server's JSON rather than a table")
+	label := flags.String("label", "", "Only list projects with this label")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: racsctl projects [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+	data, _, err := c.get("/project/list", nil)
+	if err != nil {
+		return fail(err)
+	}
+	var list []map[string]interface{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fail(fmt.Errorf("/project/list: %v", err))
+	}
+	projects := make([]map[string]interface{}, 0)
+	for _, p := range list {
+		if len(*label) > 0 {
+			labels, _ := p["labels"].([]interface{})
+			found := false
+			for _, l := range labels {
+				found = found || text(l) == *label
+			}
+			if !found {
+				continue
+			}
+		}
+		projects = append(projects, p)
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		return number(projects[i]["id"]) < number(projects[j]["id"])
+	})
+	if *asJSON {
+		out, _ := json.MarshalIndent(projects, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSTATE\tVERSION\tBRANCH")
+	for _, p := range projects {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", number(p["id"]), text(p["name"]), text(p["state"]), text(p["version"]), text(p["branch"]))
+	}
+	tw.Flush()
+	return 0
+}
+
+func mainCreate(args []string) int {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	c := clientFlags(flags)
+	destination := flags.String("destination", "", "Registry destination to push images to")
+	tag := flags.String("tag", "", "Image tag")
+	source := flags.String("source", "git", "Source kind: git, hg, svn or tarball")
+	flags.Parse(args)
+	if flags.NArg() != 3 {
+		fmt.Fprintln(os.Stderr, "Usage: racsctl create [options] NAME URL BRANCH")
+		flags.PrintDefaults()
+		return 2
+	}
+	data, _, err := c.post("/project/create", url.Values{
+		"name":        {flags.Arg(0)},
+		"url":         {flags.Arg(1)},
+		"branch":      {flags.Arg(2)},
+		"destination": {*destination},
+		"tag":         {*tag},
+		"sourceKind":  {*source},
+	})
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Println(strings.TrimSpace(string(data)))
+	return 0
+}
+
+func mainUpload(args []string) int {
+	flags := flag.NewFlagSet("upload", flag.ExitOnError)
+	c := clientFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 2 && flags.NArg() != 3 {
+		fmt.Fprintln(os.Stderr, "Usage: racsctl upload [options] PROJECT FILE [NAME]")
+		fmt.Fprintln(os.Stderr, "NAME defaults to the file's name, e.g. BuildSpec or context/settings.xml")
+		flags.PrintDefaults()
+		return 2
+	}
+	if _, err := strconv.Atoi(flags.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "racsctl: invalid project id %s\n", flags.Arg(0))
+		return 2
+	}
+	name := filepath.Base(flags.Arg(1))
+	if flags.NArg() == 3 {
+		name = flags.Arg(2)
+	}
+	file, err := os.Open(flags.Arg(1))
+	if err != nil {
+		return fail(err)
+	}
+	defer file.Close()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("id", flags.Arg(0))
+	form.WriteField("name", name)
+	part, _ := form.CreateFormFile("file", filepath.Base(flags.Arg(1)))
+	if _, err := io.Copy(part, file); err != nil {
+		return fail(err)
+	}
+	form.Close()
+	if _, _, err := c.call("POST", "/project/upload", &body, form.FormDataContentType()); err != nil {
+		return fail(err)
+	}
+	return 0
+}
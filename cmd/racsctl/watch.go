@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var stages = []string{"clean", "clone", "prepare", "pull", "build", "test", "package", "scan", "push"}
+
+var stageKinds = map[string]string{
+	"CLEANING":  "clean",
+	"CLONING":   "clone",
+	"PREPARING": "prepare",
+	"PULLING":   "pull",
+	"BUILDING":  "build",
+	"TESTING":   "test",
+	"PACKAGING": "package",
+	"SCANNING":  "scan",
+	"PUSHING":   "push",
+}
+
+type watcher struct {
+	id      int
+	name    string
+	state   string
+	started bool
+	stages  map[string]string
+	start   time.Time
+	tty     bool
+	last    string
+}
+
+func running(state string) bool {
+	return strings.HasSuffix(state, "ING")
+}
+
+func number(value interface{}) int {
+	f, _ := value.(float64)
+	return int(f)
+}
+
+func text(value interface{}) string {
+	s, _ := value.(string)
+	return s
+}
+
+func (w *watcher) begin() {
+	if !w.started {
+		w.started = true
+		w.start = time.Now()
+	}
+}
+
+// settle decides whether a project that is not running has finished its build.
+func (w *watcher) settle() (int, bool) {
+	switch {
+	case !w.started || running(w.state):
+		return 0, false
+	case w.state == "PUSH_SUCCESS" || w.state == "PENDING_APPROVAL":
+		return 0, true
+	case strings.HasSuffix(w.state, "_ERROR") || w.state == "APPROVAL_REJECTED" || w.state == "DISK_FULL" || strings.HasPrefix(w.state, "DELETE"):
+		return 1, true
+	}
+	return 0, false
+}
+
+func (w *watcher) handle(event map[string]interface{}) (int, bool) {
+	switch text(event["event"]) {
+	case "project/list":
+		projects, _ := event["projects"].([]interface{})
+		for _, p := range projects {
+			project, _ := p.(map[string]interface{})
+			if number(project["id"]) == w.id {
+				w.name = text(project["name"])
+				w.state = text(project["state"])
+				if running(w.state) {
+					w.begin()
+					if stage, ok := stageKinds[w.state]; ok {
+						w.stages[stage] = "running"
+					}
+				}
+				// Events may have been missed while reconnecting, so check for a finished build.
+				return w.settle()
+			}
+		}
+		fmt.Fprintf(os.Stderr, "racsctl: project %d not found\n", w.id)
+		return 1, true
+	case "project/state":
+		if number(event["id"]) != w.id {
+			return 0, false
+		}
+		w.state = text(event["state"])
+		if running(w.state) {
+			w.begin()
+		} else if !strings.HasSuffix(w.state, "_ERROR") {
+			// Failed stages are reported by task/state, which says whether the stage will be retried.
+			if strings.HasSuffix(w.state, "_SUCCESS") {
+				for stage, state := range w.stages {
+					if state == "running" {
+						w.stages[stage] = "success"
+					}
+				}
+			}
+			return w.settle()
+		}
+	case "task/create":
+		if number(event["project"]) != w.id {
+			return 0, false
+		}
+		w.begin()
+		if stage, ok := stageKinds[text(event["type"])]; ok {
+			w.stages[stage] = "running"
+		}
+	case "task/state":
+		if number(event["project"]) != w.id || !w.started {
+			return 0, false
+		}
+		stage := ""
+		for name, state := range w.stages {
+			if state == "running" {
+				stage = name
+			}
+		}
+		switch text(event["state"]) {
+		case "SUCCESS":
+			w.stages[stage] = "success"
+		case "ERROR":
+			if retry, _ := event["retry"].(bool); retry {
+				w.stages[stage] = "retrying"
+				return 0, false
+			}
+			w.stages[stage] = "error"
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func (w *watcher) render() {
+	symbols := map[string]string{"success": "✓", "error": "✗", "running": "▶", "retrying": "↻"}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s (%d) %s ", w.name, w.id, w.state)
+	for _, stage := range stages {
+		symbol, ok := symbols[w.stages[stage]]
+		if !ok {
+			symbol = "·"
+		}
+		fmt.Fprintf(&sb, " %s %s", stage, symbol)
+	}
+	if w.started {
+		fmt.Fprintf(&sb, "  %s", time.Since(w.start).Round(time.Second))
+	}
+	line := sb.String()
+	if w.tty {
+		fmt.Printf("\r\033[K%s", line)
+	} else if line != w.last {
+		fmt.Println(line)
+	}
+	w.last = line
+}
+
+func (w *watcher) follow(c *client) (int, bool, error) {
+	request, err := c.request("GET", "/project/events", nil)
+	if err != nil {
+		return 0, false, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return 0, false, fmt.Errorf("/project/events: %s", response.Status)
+	}
+	lines := make(chan string)
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-stop:
+				return
+			}
+		}
+		close(lines)
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return 0, false, fmt.Errorf("event stream closed")
+			}
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var event map[string]interface{}
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event) != nil {
+				continue
+			}
+			code, done := w.handle(event)
+			w.render()
+			if done {
+				return code, true, nil
+			}
+		case <-ticker.C:
+			if w.tty {
+				w.render()
+			}
+		}
+	}
+}
+
+func desktopNotify(title, message string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %q with title %q", message, title))
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("notify-send", title, message)
+	default:
+		return
+	}
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "racsctl: notification failed: %v\n", err)
+	}
+}
+
+func mainWatch(args []string) int {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	c := clientFlags(flags)
+	notify := flags.Bool("notify", false, "Show a desktop notification when the build finishes")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: racsctl watch [options] PROJECT")
+		flags.PrintDefaults()
+		return 2
+	}
+	id, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "racsctl: invalid project id %s\n", flags.Arg(0))
+		return 2
+	}
+	w := &watcher{id: id, stages: make(map[string]string)}
+	if info, err := os.Stdout.Stat(); err == nil {
+		w.tty = info.Mode()&os.ModeCharDevice != 0
+	}
+	for {
+		code, done, err := w.follow(c)
+		if done {
+			if w.tty {
+				fmt.Println()
+			}
+			if *notify {
+				result := "succeeded"
+				if code != 0 {
+					result = "failed"
+				}
+				desktopNotify("racs", fmt.Sprintf("%s build %s (%s)", w.name, result, w.state))
+			}
+			return code
+		}
+		if w.tty {
+			fmt.Println()
+		}
+		fmt.Fprintf(os.Stderr, "racsctl: %v, reconnecting\n", err)
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type reap struct {
+	container string
+	project   int
+	reason    string
+	time      time.Time
+}
+
+var reapLock sync.Mutex
+var reaps = make([]*reap, 0)
+
+// reapLabel says whether a container with a label of some value may still be in use, and which project it belongs to.
+type reapLabel struct {
+	running func(value int) bool
+	project func(value int) int
+}
+
+// projectIn is whether a project exists and is in one of the states.
+func projectIn(pid int, states func(s state) bool) bool {
+	p := projectGet(pid)
+	return p != nil && states(p.currentState())
+}
+
+func labelProject(pid int) int {
+	return pid
+}
+
+// reapLabels are the labels of the containers racs runs. Build, hook and terminal containers are labelled with their
+// project's id, and debug shells with their snapshot's task id.
+var reapLabels = map[string]reapLabel{
+	// Only BUILDING runs a build container.
+	"racs.project": {func(pid int) bool { return projectIn(pid, func(s state) bool { return s == BUILDING }) }, labelProject},
+	// Container hooks run before and after any stage.
+	"racs.hook":     {func(pid int) bool { return projectIn(pid, state.running) }, labelProject},
+	"racs.terminal": {terminalOpen, labelProject},
+	"racs.debug":    {debugRunning, snapshotProject},
+}
+
+func containerLabels(p *project) []string {
+	return []string{"--label", "racs.project=" + strconv.Itoa(p.id)}
+}
+
+// imageLabels marks the images racs builds for a project, so that pruning leaves other images on the host alone.
+func imageLabels(p *project) []string {
+	return []string{"--label", "racs.image=" + strconv.Itoa(p.id)}
+}
+
+func hookLabels(p *project) []string {
+	return []string{"--label", "racs.hook=" + strconv.Itoa(p.id)}
+}
+
+func reapContainers(reason string) int {
+	count := 0
+	for label, kind := range reapLabels {
+		count += reapLabelled(label, kind, reason)
+	}
+	return count
+}
+
+// reapLabelled removes the containers with a label that can't be in use any more.
+func reapLabelled(label string, kind reapLabel, reason string) int {
+	output, err := exec.Command("podman", "ps", "-a", "--filter", "label="+label,
+		"--format", fmt.Sprintf(`{{.ID}} {{index .Labels %q}}`, label)).Output()
+	if err != nil {
+		logger.Error(err)
+		return 0
+	}
+	count := 0
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, _ := strconv.Atoi(fields[1])
+		if kind.running(value) {
+			continue
+		}
+		pid := kind.project(value)
+		err := exec.Command("podman", "rm", "-f", fields[0]).Run()
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		logger.Warnf("Reaped container %s of project %d (%s)", fields[0], pid, reason)
+		reapLock.Lock()
+		reaps = append(reaps, &reap{fields[0], pid, reason, time.Now()})
+		if len(reaps) > 100 {
+			reaps = reaps[1:]
+		}
+		reapLock.Unlock()
+		projectEvent(map[string]interface{}{
+			"event":     "container/reap",
+			"container": fields[0],
+			"project":   pid,
+			"reason":    reason,
+		})
+		count += 1
+	}
+	return count
+}
+
+func reapRoutine() {
+	reapContainers("startup")
+	for {
+		time.Sleep(5 * time.Minute)
+		reapContainers("periodic")
+	}
+}
+
+func handleAdminContainers(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/admin/containers", params) {
+		return
+	}
+	reapLock.Lock()
+	result := make([]map[string]interface{}, 0)
+	for i := len(reaps) - 1; i >= 0; i-- {
+		result = append(result, map[string]interface{}{
+			"container": reaps[i].container,
+			"project":   reaps[i].project,
+			"reason":    reaps[i].reason,
+			"time":      reaps[i].time.UTC().Format("2006-01-02 15:04:05"),
+		})
+	}
+	reapLock.Unlock()
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleAdminContainersReap(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/admin/containers/reap", params) {
+		return
+	}
+	count := reapContainers("manual")
+	w.WriteHeader(200)
+	w.Write([]byte(strconv.Itoa(count)))
+}
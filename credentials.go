@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var providerName = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+type credentials struct {
+	Username string
+	Secret   string
+}
+
+func providerCredentials(provider, url string) (*credentials, error) {
+	if !providerName.MatchString(provider) {
+		return nil, fmt.Errorf("Invalid credential provider %s", provider)
+	}
+	cmd := exec.Command("docker-credential-"+provider, "get")
+	cmd.Stdin = strings.NewReader(url)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker-credential-%s: %v", provider, err)
+	}
+	c := &credentials{}
+	err = json.Unmarshal(out, c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func providerLogin(r *registry) error {
+	c, err := providerCredentials(r.provider, r.url)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("podman", "login", r.url, "-u", c.Username, "--password-stdin")
+	cmd.Stdin = strings.NewReader(c.Secret)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("podman login %s: %v %s", r.url, err, out)
+	}
+	return nil
+}
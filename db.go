@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type database struct {
+	*sql.DB
+	dialect string
+}
+
+var dbDriver, dbSource string
+
+var replaceKeys = map[string][]string{
+	"registries": {"name"},
+	"variables":  {"project", "name"},
+	"parsers":    {"project", "stage", "name"},
+	"metadata":   {"task", "name"},
+	"searches":   {"name"},
+	"retries":    {"project", "stage"},
+	"templates":  {"name"},
+	"webhooks":   {"project"},
+	"users":      {"name"},
+	"variants":   {"project", "name"},
+}
+
+var replaceInto = regexp.MustCompile(`^\s*REPLACE INTO (\w+)\(([^)]*)\)`)
+var userColumn = regexp.MustCompile(`\buser\b`)
+
+// rewrite turns a query written for SQLite into one for the database's dialect. Only the SQL itself is rewritten, not
+// string literals or quoted names in it.
+func (d *database) rewrite(query string) (string, error) {
+	if d.dialect != "postgres" {
+		return query, nil
+	}
+	if match := replaceInto.FindStringSubmatch(query); match != nil {
+		keys, ok := replaceKeys[match[1]]
+		if !ok {
+			return "", fmt.Errorf("REPLACE INTO %s needs its key in replaceKeys to run on postgres", match[1])
+		}
+		updates := make([]string, 0)
+		for _, column := range strings.Split(match[2], ",") {
+			column = strings.TrimSpace(column)
+			isKey := false
+			for _, key := range keys {
+				isKey = isKey || key == column
+			}
+			if !isKey {
+				updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+			}
+		}
+		query = "INSERT" + strings.TrimPrefix(strings.TrimSpace(query), "REPLACE")
+		query += fmt.Sprintf(" ON CONFLICT(%s) DO UPDATE SET %s", strings.Join(keys, ", "), strings.Join(updates, ", "))
+	}
+	// A literal can't hold datetime('now') unescaped, so this only matches the function call.
+	query = strings.Replace(query, "datetime('now')", "to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')", -1)
+	var sb strings.Builder
+	n := 0
+	for len(query) > 0 {
+		end := sqlCodeEnd(query)
+		sb.WriteString(rewriteCode(query[:end], &n))
+		query = query[end:]
+		if len(query) > 0 {
+			end = sqlQuotedEnd(query)
+			sb.WriteString(query[:end])
+			query = query[end:]
+		}
+	}
+	return sb.String(), nil
+}
+
+// rewriteCode rewrites SQL outside of quotes, numbering its ? placeholders on from n.
+func rewriteCode(code string, n *int) string {
+	code = strings.Replace(code, "IFNULL(", "COALESCE(", -1)
+	code = strings.Replace(code, "INTEGER PRIMARY KEY", "SERIAL PRIMARY KEY", -1)
+	code = strings.Replace(code, " STRING", " TEXT", -1)
+	code = strings.Replace(code, " BLOB", " BYTEA", -1)
+	code = strings.Replace(code, "ADD COLUMN ", "ADD COLUMN IF NOT EXISTS ", -1)
+	code = userColumn.ReplaceAllString(code, `"user"`)
+	var sb strings.Builder
+	for _, c := range code {
+		if c == '?' {
+			*n += 1
+			fmt.Fprintf(&sb, "$%d", *n)
+		} else {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// sqlCodeEnd is where the SQL at the start of query ends, at its first string literal or quoted name.
+func sqlCodeEnd(query string) int {
+	if i := strings.IndexAny(query, `'"`); i >= 0 {
+		return i
+	}
+	return len(query)
+}
+
+// sqlQuotedEnd is where the string literal or quoted name at the start of query ends, after its closing quote. Quotes
+// are escaped by doubling them.
+func sqlQuotedEnd(query string) int {
+	quote := query[0]
+	for i := 1; i < len(query); i++ {
+		if query[i] != quote {
+			continue
+		}
+		if i+1 < len(query) && query[i+1] == quote {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(query)
+}
+
+func (d *database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	query, err := d.rewrite(query)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	return d.DB.Exec(query, args...)
+}
+
+func (d *database) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	query, err := d.rewrite(query)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	return d.DB.Query(query, args...)
+}
+
+// QueryRow sends a query that can't be rewritten as it is, for the database to reject so that Scan returns the error.
+func (d *database) QueryRow(query string, args ...interface{}) *sql.Row {
+	rewritten, err := d.rewrite(query)
+	if err != nil {
+		logger.Error(err)
+		return d.DB.QueryRow(query, args...)
+	}
+	return d.DB.QueryRow(rewritten, args...)
+}
+
+func openDatabase(driver, source string) (*database, error) {
+	switch driver {
+	case "sqlite3", "postgres":
+	default:
+		return nil, fmt.Errorf("Unsupported database driver %s", driver)
+	}
+	conn, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	return &database{conn, driver}, nil
+}
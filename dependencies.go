@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// afters maps each project to the projects that build after it, which are prepared again once it has pushed. Unlike
+// triggers, they keep building from their own specs. It is guarded by projectsLock.
+var afters = make(map[*project]map[*project]bool)
+
+// setAfter makes t build after p, with projectsLock held for writing.
+func setAfter(p, t *project) {
+	if afters[p] == nil {
+		afters[p] = make(map[*project]bool)
+	}
+	afters[p][t] = true
+}
+
+// afterTargets copies the projects that build after the project.
+func (p *project) afterTargets() []*project {
+	projectsLock.RLock()
+	defer projectsLock.RUnlock()
+	targets := make([]*project, 0, len(afters[p]))
+	for t := range afters[p] {
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// afterSources returns the ids of the projects the project builds after, in order.
+func (p *project) afterSources() []int {
+	projectsLock.RLock()
+	defer projectsLock.RUnlock()
+	ids := make([]int, 0)
+	for upstream, targets := range afters {
+		if targets[p] {
+			ids = append(ids, upstream.id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// setTrigger makes p's builds trigger t from a stage, with projectsLock held for writing.
+func setTrigger(p, t *project, s state) {
+	p.triggers[t] = s
+	switch s {
+	case PREPARING:
+		t.prepareDep = p
+	case PACKAGING:
+		t.packageDep = p
+	}
+}
+
+// clearTrigger stops p's builds triggering t, with projectsLock held for writing.
+func clearTrigger(p, t *project) {
+	switch p.triggers[t] {
+	case PREPARING:
+		if t.prepareDep == p {
+			t.prepareDep = nil
+		}
+	case PACKAGING:
+		if t.packageDep == p {
+			t.packageDep = nil
+		}
+	}
+	delete(p.triggers, t)
+}
+
+// triggerCycle returns the chain of project ids from source back to itself if
+// giving source the targets would create a cycle of triggers and afters, with projectsLock held.
+func triggerCycle(source *project, targets map[*project]state) []int {
+	visited := make(map[*project]bool)
+	var walk func(p *project, path []int) []int
+	walk = func(p *project, path []int) []int {
+		path = append(path, p.id)
+		if p == source {
+			return path
+		}
+		if visited[p] {
+			return nil
+		}
+		visited[p] = true
+		for t := range p.triggers {
+			if cycle := walk(t, path); cycle != nil {
+				return cycle
+			}
+		}
+		for t := range afters[p] {
+			if cycle := walk(t, path); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	for t := range targets {
+		if cycle := walk(t, []int{source.id}); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// projectSetAfter replaces the projects p builds after, unless that would create a cycle, which it returns instead.
+func projectSetAfter(p *project, after map[*project]bool) []int {
+	projectsLock.Lock()
+	for upstream := range after {
+		if cycle := triggerCycle(upstream, map[*project]state{p: PREPARING}); cycle != nil {
+			projectsLock.Unlock()
+			return cycle
+		}
+	}
+	for _, targets := range afters {
+		delete(targets, p)
+	}
+	for upstream := range after {
+		setAfter(upstream, p)
+	}
+	projectsLock.Unlock()
+	db.Exec(`DELETE FROM afters WHERE project = ?`, p.id)
+	for upstream := range after {
+		db.Exec(`INSERT INTO afters(project, upstream) VALUES(?, ?)`, p.id, upstream.id)
+	}
+	return nil
+}
+
+// projectSetTriggers replaces the projects p triggers, unless that would create a cycle, which it returns instead.
+func projectSetTriggers(p *project, triggers map[*project]state) []int {
+	projectsLock.Lock()
+	defer projectsLock.Unlock()
+	if cycle := triggerCycle(p, triggers); cycle != nil {
+		return cycle
+	}
+	for target := range p.triggers {
+		clearTrigger(p, target)
+	}
+	db.Exec(`DELETE FROM triggers WHERE project = ?`, p.id)
+	for t, s := range triggers {
+		setTrigger(p, t, s)
+		db.Exec(`INSERT INTO triggers(project, target, state) VALUES(?, ?, ?)`, p.id, t.id, s.String())
+	}
+	return nil
+}
+
+func cycleError(cycle []int) error {
+	ids := make([]string, len(cycle))
+	for i, id := range cycle {
+		ids[i] = strconv.Itoa(id)
+	}
+	return conflict("Trigger cycle: %s", strings.Join(ids, " -> "))
+}
+
+func writeCycle(w http.ResponseWriter, cycle []int) {
+	writeError(w, cycleError(cycle))
+}
+
+func handleProjectAfter(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/after", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	after := make(map[*project]bool)
+	for _, field := range strings.Split(params["after"], ",") {
+		uid, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			continue
+		}
+		upstream := projectGet(uid)
+		if upstream == nil {
+			writeError(w, notFound(fmt.Sprintf("Project %d", uid)))
+			return
+		}
+		if upstream == p {
+			writeError(w, invalidParam("after", "A project can't build after itself"))
+			return
+		}
+		after[upstream] = true
+	}
+	if cycle := projectSetAfter(p, after); cycle != nil {
+		writeCycle(w, cycle)
+		return
+	}
+	projectRevise(p, u.Name)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleProjectGraph(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	nodes := make([]map[string]interface{}, 0)
+	edges := make([]map[string]interface{}, 0)
+	for _, p := range projectAll() {
+		state := p.currentState()
+		p.lock.RLock()
+		nodes = append(nodes, map[string]interface{}{
+			"id":    p.id,
+			"name":  p.name,
+			"state": state.String(),
+		})
+		p.lock.RUnlock()
+		for t, s := range p.triggerTargets() {
+			edges = append(edges, map[string]interface{}{
+				"from":  p.id,
+				"to":    t.id,
+				"state": s.String(),
+			})
+		}
+		for _, t := range p.afterTargets() {
+			edges = append(edges, map[string]interface{}{
+				"from":  p.id,
+				"to":    t.id,
+				"state": "AFTER",
+			})
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i]["from"].(int) != edges[j]["from"].(int) {
+			return edges[i]["from"].(int) < edges[j]["from"].(int)
+		}
+		return edges[i]["to"].(int) < edges[j]["to"].(int)
+	})
+	if params["format"] == "dot" {
+		var sb strings.Builder
+		sb.WriteString("digraph racs {\n")
+		for _, node := range nodes {
+			fmt.Fprintf(&sb, "\t%d [label=%q];\n", node["id"], fmt.Sprintf("%s\n%s", node["name"], node["state"]))
+		}
+		for _, edge := range edges {
+			fmt.Fprintf(&sb, "\t%d -> %d [label=%q];\n", edge["from"], edge["to"], edge["state"])
+		}
+		sb.WriteString("}\n")
+		w.Header().Add("Content-Type", "text/vnd.graphviz")
+		w.Write([]byte(sb.String()))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"nodes": nodes,
+		"edges": edges,
+	})
+	w.Write(j)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var diskMinimum int
+var imagePrune bool
+
+var graphRoot string
+var graphRootOnce sync.Once
+
+// podmanRoot returns where podman stores images, or "" if podman can't say.
+func podmanRoot() string {
+	graphRootOnce.Do(func() {
+		output, err := exec.Command("podman", "info", "--format", "{{.Store.GraphRoot}}").Output()
+		if err != nil {
+			logger.Warnf("Unable to find podman storage: %v", err)
+			return
+		}
+		graphRoot = strings.TrimSpace(string(output))
+	})
+	return graphRoot
+}
+
+// diskCheck fails stages that write to the workspace or image storage when either has less than -disk-minimum MB
+// free, so they stop before they start rather than part way through.
+func diskCheck(state state) error {
+	if diskMinimum <= 0 {
+		return nil
+	}
+	switch state {
+	case CLONING, PREPARING, BUILDING, TESTING, PACKAGING:
+	default:
+		return nil
+	}
+	for _, path := range []string{projectAbs, podmanRoot()} {
+		if len(path) == 0 {
+			continue
+		}
+		free, err := diskFree(path)
+		if err != nil {
+			logger.Warnf("Unable to check free space of %s: %v", path, err)
+			continue
+		}
+		if free/(1024*1024) < int64(diskMinimum) {
+			return fmt.Errorf("%s has %d MB free, less than the minimum of %d MB", path, free/(1024*1024), diskMinimum)
+		}
+	}
+	return nil
+}
+
+// pruneImages removes the images of deleted projects and dangling racs images, which are left by rebuilding a tagged
+// image. Only dangling images older than until are removed, so builds in progress keep theirs, and images racs didn't
+// build are never removed.
+func pruneImages(until time.Duration) ([]string, int, error) {
+	images, err := racsImages()
+	if err != nil {
+		return nil, 0, err
+	}
+	removed := make([]string, 0)
+	for _, image := range images {
+		if projectGet(image.project) != nil {
+			continue
+		}
+		if err := exec.Command("podman", "rmi", "-f", image.id).Run(); err != nil {
+			logger.Error(err)
+			continue
+		}
+		removed = append(removed, image.name)
+	}
+	args := []string{"image", "prune", "-f", "--filter", "label=racs.image"}
+	if until > 0 {
+		args = append(args, "--filter", fmt.Sprintf("until=%s", until))
+	}
+	output, err := exec.Command("podman", args...).Output()
+	if err != nil {
+		logger.Error(err)
+	}
+	return removed, len(strings.Fields(string(output))), nil
+}
+
+func pruneRoutine() {
+	for {
+		removed, dangling, err := pruneImages(5 * time.Minute)
+		if err != nil {
+			logger.Error(err)
+		} else if len(removed) > 0 || dangling > 0 {
+			logger.Infof("Pruned %d orphaned and %d dangling images", len(removed), dangling)
+		}
+		time.Sleep(60 * time.Second)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("free disk space is only known on Linux")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var environmentName = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+func projectImage(p *project, version int) string {
+	p.lock.RLock()
+	tag := strings.Replace(p.tag, "$VERSION", strconv.Itoa(version), -1)
+	destination := p.destination
+	p.lock.RUnlock()
+	r := registries[destination]
+	if r == nil {
+		return fmt.Sprintf("project-%d", p.id)
+	}
+	return fmt.Sprintf("%s/%s", r.url, tag)
+}
+
+func projectDeploy(p *project, environment string, version int, image, author string) {
+	db.Exec(`INSERT INTO deployments(project, environment, version, image, user, time) VALUES(?, ?, ?, ?, ?, datetime('now'))`,
+		p.id, environment, version, image, author)
+	logger.Infof("Project %d version %d deployed to %s by %s", p.id, version, environment, author)
+	projectEvent(map[string]interface{}{
+		"event":       "project/deploy",
+		"id":          p.id,
+		"environment": environment,
+		"version":     version,
+		"image":       image,
+		"user":        author,
+	})
+}
+
+func handleProjectEnvironments(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	rows, err := db.Query(`SELECT environment, version, image, user, time FROM deployments
+		WHERE id IN (SELECT MAX(id) FROM deployments WHERE project = ? GROUP BY environment) ORDER BY environment`, id)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]interface{}, 0)
+	for rows.Next() {
+		var environment string
+		var version int
+		var image string
+		var author string
+		var time string
+		rows.Scan(&environment, &version, &image, &author, &time)
+		result = append(result, map[string]interface{}{
+			"environment": environment,
+			"version":     version,
+			"image":       image,
+			"user":        author,
+			"time":        time,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectEnvironmentHistory(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	environment := params["environment"]
+	rows, err := db.Query(`SELECT environment, version, image, user, time FROM deployments
+		WHERE project = ? AND (? = '' OR environment = ?) ORDER BY id DESC`, id, environment, environment)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]interface{}, 0)
+	for rows.Next() {
+		var environment string
+		var version int
+		var image string
+		var author string
+		var time string
+		rows.Scan(&environment, &version, &image, &author, &time)
+		result = append(result, map[string]interface{}{
+			"environment": environment,
+			"version":     version,
+			"image":       image,
+			"user":        author,
+			"time":        time,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectDeploy(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/deploy", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	environment := params["environment"]
+	if p == nil {
+		writeError(w, notFound("Project"))
+	} else if !environmentName.MatchString(environment) {
+		writeError(w, invalidParam("environment", "Invalid environment name %s", environment))
+	} else {
+		version := p.currentVersion()
+		if len(params["version"]) > 0 {
+			version, _ = strconv.Atoi(params["version"])
+		}
+		image := params["image"]
+		if len(image) == 0 {
+			image = projectImage(p, version)
+		}
+		projectDeploy(p, environment, version, image, u.Name)
+		redirect := params["redirect"]
+		if len(redirect) > 0 {
+			w.Header().Add("Location", redirect)
+			w.WriteHeader(303)
+		} else {
+			w.WriteHeader(200)
+			w.Write([]byte("OK"))
+		}
+	}
+}
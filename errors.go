@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// httpError is an error with the status a request that fails with it is answered with. code is a stable name for
+// the kind of error, for clients to check rather than the message.
+type httpError struct {
+	status  int
+	code    string
+	message string
+	details map[string]interface{}
+}
+
+// errorResponse is the body errors are answered with.
+type errorResponse struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details"`
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+var errorCodes = map[int]string{
+	400: "invalid_request",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not_found",
+	409: "conflict",
+	412: "precondition_failed",
+	413: "too_large",
+	422: "unprocessable",
+	428: "precondition_required",
+	429: "rate_limited",
+	502: "bad_gateway",
+	503: "unavailable",
+}
+
+func statusError(status int, message string) *httpError {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = "internal"
+	}
+	return &httpError{status, code, message, nil}
+}
+
+func badRequest(format string, args ...interface{}) *httpError {
+	return statusError(400, fmt.Sprintf(format, args...))
+}
+
+// invalidParam is a bad request naming the parameter that was wrong.
+func invalidParam(name string, format string, args ...interface{}) *httpError {
+	return &httpError{400, "invalid_parameter", fmt.Sprintf(format, args...), map[string]interface{}{"param": name}}
+}
+
+func notFound(what string) *httpError {
+	return statusError(404, what+" not found")
+}
+
+func conflict(format string, args ...interface{}) *httpError {
+	return statusError(409, fmt.Sprintf(format, args...))
+}
+
+// writeError answers a request with an error as {"code", "message", "details"}. Errors other than httpErrors are
+// internal errors.
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(*httpError)
+	if !ok {
+		e = &httpError{500, "internal", err.Error(), nil}
+	}
+	details := e.details
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	j, _ := json.Marshal(errorResponse{e.code, e.message, details})
+	w.Write(j)
+}
@@ -4,8 +4,9 @@ go 1.16
 
 require (
 	github.com/bgentry/speakeasy v0.1.0 // indirect
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/msteinert/pam v0.0.0-20201130170657-e61372126161
-	github.com/withmandala/go-log v0.1.0 // indirect
-	golang.org/x/crypto v0.0.0-20220112180741-5e0467b6c7ce // indirect
+	github.com/withmandala/go-log v0.1.0
+	golang.org/x/crypto v0.0.0-20220112180741-5e0467b6c7ce
 )
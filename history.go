@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func projectSettings(p *project) map[string]string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return map[string]string{
+		"name":        p.name,
+		"labels":      p.labels,
+		"url":         p.url,
+		"branch":      p.branch,
+		"destination": p.destination,
+		"tag":         p.tag,
+		"buildSpec":   p.buildSpec,
+		"packageSpec": p.packageSpec,
+		"caches":      p.caches,
+		"poll":        strconv.Itoa(p.poll),
+		"hold":        strconv.FormatBool(p.hold),
+		"testSpec":    p.testSpec,
+		"testReport":  p.testReport,
+		"artifacts":   p.artifacts,
+		"cpus":        p.cpus,
+		"memory":      p.memory,
+		"diskQuota":   strconv.Itoa(p.diskQuota),
+		"scanner":     p.scanner,
+		"scanFail":    p.scanFail,
+		"signing":     p.signing,
+		"sbom":        p.sbom,
+		"sbomAttach":  strconv.FormatBool(p.sbomAttach),
+		"tagPattern":  p.tagPattern,
+		"pathFilter":  p.pathFilter,
+		"snapshot":    strconv.FormatBool(p.snapshot),
+		"sourceKind":  p.sourceKind,
+	}
+}
+
+func projectConfig(p *project) map[string]string {
+	config := projectSettings(p)
+	for target, state := range p.triggerTargets() {
+		config[fmt.Sprintf("trigger:%d", target.id)] = state.String()
+	}
+	for _, upstream := range p.afterSources() {
+		config[fmt.Sprintf("after:%d", upstream)] = "AFTER"
+	}
+	for _, v := range p.variableList() {
+		value := v.value
+		if v.secret {
+			h := sha256.Sum256([]byte(v.value))
+			value = "secret:" + hex.EncodeToString(h[:8])
+		}
+		config[fmt.Sprintf("%s:%s", v.kind, v.name)] = value
+	}
+	parserConfig(p.id, config)
+	retryConfig(p.id, config)
+	variantConfig(p.id, config)
+	for _, spec := range append([]string{config["buildSpec"], config["packageSpec"], config["testSpec"]}, variantSpecs(p.id)...) {
+		if len(spec) == 0 {
+			continue
+		}
+		content, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/%s", projectAbs, p.id, spec))
+		if err == nil {
+			config["spec:"+spec] = string(content)
+		}
+	}
+	return config
+}
+
+func projectRevise(p *project, author string) int {
+	config := projectConfig(p)
+	var id int
+	var last string
+	db.QueryRow(`SELECT id, config FROM revisions WHERE project = ? ORDER BY id DESC LIMIT 1`, p.id).Scan(&id, &last)
+	j, _ := json.Marshal(config)
+	if id != 0 && last == string(j) {
+		return id
+	}
+	err := db.QueryRow(`INSERT INTO revisions(project, user, time, config)
+		VALUES(?, ?, datetime('now'), ?) RETURNING id`, p.id, author, string(j)).Scan(&id)
+	if err != nil {
+		logger.Error(err)
+		return 0
+	}
+	logger.Infof("Project %d revision %d by %s", p.id, id, author)
+	return id
+}
+
+func lineDiff(a, b string) string {
+	x := strings.Split(a, "\n")
+	y := strings.Split(b, "\n")
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			sb.WriteString(" " + x[i] + "\n")
+			i++
+			j++
+		case j < len(y) && (i == len(x) || lcs[i][j+1] >= lcs[i+1][j]):
+			sb.WriteString("+" + y[j] + "\n")
+			j++
+		default:
+			sb.WriteString("-" + x[i] + "\n")
+			i++
+		}
+	}
+	return sb.String()
+}
+
+func configDiff(old, new map[string]string) []interface{} {
+	keys := make([]string, 0)
+	for key := range old {
+		keys = append(keys, key)
+	}
+	for key := range new {
+		if _, ok := old[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	changes := make([]interface{}, 0)
+	for _, key := range keys {
+		before, after := old[key], new[key]
+		if before == after {
+			continue
+		}
+		if strings.HasPrefix(key, "spec:") {
+			changes = append(changes, map[string]interface{}{
+				"field": key,
+				"diff":  lineDiff(before, after),
+			})
+		} else {
+			changes = append(changes, map[string]interface{}{
+				"field": key,
+				"old":   before,
+				"new":   after,
+			})
+		}
+	}
+	return changes
+}
+
+func handleProjectHistory(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	rows, err := db.Query(`SELECT id, user, time, config FROM revisions WHERE project = ? ORDER BY id`, p.id)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	previous := map[string]string{}
+	for rows.Next() {
+		var revision int
+		var author string
+		var time string
+		var j string
+		rows.Scan(&revision, &author, &time, &j)
+		config := map[string]string{}
+		json.Unmarshal([]byte(j), &config)
+		result = append(result, map[string]interface{}{
+			"revision": revision,
+			"user":     author,
+			"time":     time,
+			"changes":  configDiff(previous, config),
+		})
+		previous = config
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectRevision(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	revision, _ := strconv.Atoi(params["revision"])
+	var author string
+	var time string
+	var j string
+	err := db.QueryRow(`SELECT user, time, config FROM revisions WHERE project = ? AND id = ?`, id, revision).Scan(&author, &time, &j)
+	if err != nil {
+		writeError(w, notFound("Revision"))
+		return
+	}
+	config := map[string]string{}
+	json.Unmarshal([]byte(j), &config)
+	w.Header().Add("Content-Type", "application/json")
+	j2, _ := json.Marshal(map[string]interface{}{
+		"revision": revision,
+		"user":     author,
+		"time":     time,
+		"config":   config,
+	})
+	w.Write(j2)
+}
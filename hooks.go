@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var hookName = regexp.MustCompile(`^hooks/(pre|post)-(clean|clone|prepare|pull|build|test|package|scan|push)$`)
+var hookContainer = regexp.MustCompile(`(?m)^\s*#\s*racs-hook:\s*container\s*$`)
+
+var hookSlot = &uploadSlot{specLimit, validateHook}
+
+func validateHook(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(b) || strings.ContainsRune(string(b), 0) {
+		return fmt.Errorf("hook is not a text file")
+	}
+	if !strings.HasPrefix(string(b), "#!") {
+		return fmt.Errorf("hook must start with an interpreter line, e.g. #!/bin/sh")
+	}
+	return nil
+}
+
+func stageName(s state) string {
+	for name, stage := range stageStates {
+		if stage == s {
+			return name
+		}
+	}
+	return ""
+}
+
+// runHooks runs the project's pre or post hook for a stage, if it has one, writing its output to the task log. Hooks see
+// the request's workspace and images, which are a variant's or preview's own.
+func runHooks(p *project, phase string, state state, request taskRequest, out io.Writer) error {
+	stage := stageName(state)
+	if len(stage) == 0 {
+		return nil
+	}
+	name, path := projectFile(p, fmt.Sprintf("hooks/%s-%s", phase, stage))
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	applyMode(path, fileMode|0111)
+	env := []string{
+		"RACS_PROJECT=" + strconv.Itoa(p.id),
+		"RACS_STAGE=" + stage,
+		"RACS_PHASE=" + phase,
+		"RACS_TRIGGER=" + request.trigger,
+		"RACS_VERSION=" + strconv.Itoa(p.version),
+		"RACS_IMAGE=" + imageName("project", p, request),
+	}
+	var cmd *exec.Cmd
+	if hookContainer.Match(content) {
+		args := []string{"run", "--network=host", "--rm=true",
+			"-v", workspaceDir(p, request) + ":/workspace",
+			"-v", fmt.Sprintf("%s/%d/hooks:/hooks:ro", projectAbs, p.id),
+		}
+		for _, e := range env {
+			args = append(args, "-e", e)
+		}
+		args = append(args, hookLabels(p)...)
+		var secrets []string
+		p.lock.RLock()
+		args = append(args, p.limitArgs(true)...)
+		args, secrets = p.variableArgs("env", "-e", args, secrets, !previewRef(request.ref))
+		p.lock.RUnlock()
+		args = append(args, imageName("builder", p, request), "/hooks/"+filepath.Base(name))
+		cmd = exec.Command("podman", args...)
+		cmd.Env = append(os.Environ(), secrets...)
+	} else {
+		for _, v := range p.variableList() {
+			if v.kind == "env" && (!v.secret || !previewRef(request.ref)) {
+				env = append(env, v.name+"="+v.value)
+			}
+		}
+		cmd = exec.Command(path)
+		cmd.Dir = fmt.Sprintf("%s/%d", projectAbs, p.id)
+		cmd.Env = append(os.Environ(), env...)
+	}
+	fmt.Fprintf(out, "##[group]%s hook\n", phase)
+	fmt.Fprintf(out, "\u001B[1m%s\u001B[0m\n", cmd.String())
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("%s failed: %v", name, err)
+		fmt.Fprintln(out, err)
+	}
+	fmt.Fprintln(out, "##[endgroup]")
+	return err
+}
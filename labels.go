@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func splitLabels(labels string) []string {
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, label := range strings.Split(labels, ",") {
+		label = strings.TrimSpace(label)
+		key := strings.ToUpper(label)
+		if len(label) > 0 && !seen[key] {
+			seen[key] = true
+			result = append(result, label)
+		}
+	}
+	return result
+}
+
+func containsFold(labels []string, label string) bool {
+	for _, l := range labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelsStore replaces a project's labels in project_labels.
+func labelsStore(pid int, labels []string) {
+	db.Exec(`DELETE FROM project_labels WHERE project = ?`, pid)
+	for _, label := range labels {
+		db.Exec(`INSERT INTO project_labels(project, label) VALUES(?, ?)`, pid, label)
+	}
+}
+
+// labelsAll are the labels of every project, by project id.
+func labelsAll() map[int][]string {
+	labels := make(map[int][]string)
+	rows, err := db.Query(`SELECT project, label FROM project_labels ORDER BY project, label`)
+	if err != nil {
+		logger.Error(err)
+		return labels
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pid int
+		var label string
+		rows.Scan(&pid, &label)
+		labels[pid] = append(labels[pid], label)
+	}
+	return labels
+}
+
+// labelledProjects are the ids of the projects with any of the labels, ignoring case.
+func labelledProjects(labels []string) map[int]bool {
+	ids := make(map[int]bool)
+	args := make([]interface{}, 0)
+	for _, label := range labels {
+		args = append(args, strings.ToUpper(label))
+	}
+	query := `SELECT DISTINCT project FROM project_labels WHERE UPPER(label) IN (?` + strings.Repeat(`, ?`, len(labels)-1) + `)`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		logger.Error(err)
+		return ids
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pid int
+		rows.Scan(&pid)
+		ids[pid] = true
+	}
+	return ids
+}
+
+func (p *project) currentLabels() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.labels
+}
+
+func projectSetLabels(p *project, labels []string, author string) {
+	p.lock.Lock()
+	p.labels = strings.Join(labels, ",")
+	p.lock.Unlock()
+	labelsStore(p.id, labels)
+	projectRevise(p, author)
+	projectEvent(map[string]interface{}{
+		"event":  "project/update",
+		"id":     p.id,
+		"labels": strings.Join(labels, ","),
+	})
+}
+
+func handleProjectLabelsAdd(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/labels/add", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	labels := splitLabels(p.currentLabels() + "," + params["label"])
+	projectSetLabels(p, labels, u.Name)
+	w.WriteHeader(200)
+	w.Write([]byte(p.currentLabels()))
+}
+
+func handleProjectLabelsRemove(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/labels/remove", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	remove := splitLabels(params["label"])
+	labels := make([]string, 0)
+	for _, label := range splitLabels(p.currentLabels()) {
+		keep := true
+		for _, r := range remove {
+			keep = keep && !strings.EqualFold(label, r)
+		}
+		if keep {
+			labels = append(labels, label)
+		}
+	}
+	projectSetLabels(p, labels, u.Name)
+	w.WriteHeader(200)
+	w.Write([]byte(p.currentLabels()))
+}
+
+func handleLabelsHealth(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	groups := make(map[string]map[string]interface{})
+	for _, p := range projectAll() {
+		labels := splitLabels(p.currentLabels())
+		if len(labels) == 0 {
+			labels = []string{""}
+		}
+		for _, label := range labels {
+			key := strings.ToUpper(label)
+			group := groups[key]
+			if group == nil {
+				group = map[string]interface{}{
+					"label":    key,
+					"projects": 0,
+					"failing":  0,
+					"running":  0,
+					"passing":  0,
+				}
+				groups[key] = group
+			}
+			group["projects"] = group["projects"].(int) + 1
+			if p.currentState().failed() {
+				group["failing"] = group["failing"].(int) + 1
+			} else if p.currentState().running() {
+				group["running"] = group["running"].(int) + 1
+			} else {
+				group["passing"] = group["passing"].(int) + 1
+			}
+		}
+	}
+	result := make([]map[string]interface{}, 0)
+	for _, group := range groups {
+		result = append(result, group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["label"].(string) < result[j]["label"].(string)
+	})
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ldapURL string
+var ldapUserDN string
+var ldapGroupAttribute string
+
+// berTLV encodes a BER element. LDAP needs only a few of its types, so racs encodes them itself.
+func berTLV(tag byte, content []byte) []byte {
+	if len(content) < 0x80 {
+		return append([]byte{tag, byte(len(content))}, content...)
+	}
+	length := make([]byte, 0)
+	for n := len(content); n > 0; n >>= 8 {
+		length = append([]byte{byte(n)}, length...)
+	}
+	return append(append([]byte{tag, byte(0x80 | len(length))}, length...), content...)
+}
+
+func berInt(tag byte, value int) []byte {
+	content := []byte{byte(value)}
+	for value >>= 8; value > 0; value >>= 8 {
+		content = append([]byte{byte(value)}, content...)
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berTLV(tag, content)
+}
+
+func berSequence(tag byte, elements ...[]byte) []byte {
+	content := make([]byte, 0)
+	for _, element := range elements {
+		content = append(content, element...)
+	}
+	return berTLV(tag, content)
+}
+
+// berNext splits the first BER element from data, returning its tag, its content and the rest of data.
+func berNext(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errors.New("LDAP response is truncated")
+	}
+	tag, length, header := data[0], int(data[1]), 2
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size > 4 || len(data) < 2+size {
+			return 0, nil, nil, errors.New("LDAP response has a bad length")
+		}
+		length = 0
+		for _, b := range data[2 : 2+size] {
+			length = length<<8 | int(b)
+		}
+		header += size
+	}
+	if len(data) < header+length {
+		return 0, nil, nil, errors.New("LDAP response is truncated")
+	}
+	return tag, data[header : header+length], data[header+length:], nil
+}
+
+func berRead(in *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := make([]byte, length&0x7f)
+		if len(size) > 4 {
+			return nil, errors.New("LDAP response has a bad length")
+		}
+		if _, err := io.ReadFull(in, size); err != nil {
+			return nil, err
+		}
+		header = append(header, size...)
+		length = 0
+		for _, b := range size {
+			length = length<<8 | int(b)
+		}
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(in, content); err != nil {
+		return nil, err
+	}
+	return append(header, content...), nil
+}
+
+// ldapEscape escapes a user name for use as an attribute value in a DN.
+func ldapEscape(value string) string {
+	escaped := ""
+	for i, c := range value {
+		if strings.ContainsRune(`,+"\<>;=`, c) || (i == 0 && (c == '#' || c == ' ')) {
+			escaped += `\`
+		}
+		escaped += string(c)
+	}
+	return escaped
+}
+
+// ldapResult reads the next message from the server, returning its operation and the operation's content.
+func ldapResult(in *bufio.Reader) (byte, []byte, error) {
+	message, err := berRead(in)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, content, _, err := berNext(message)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, _, op, err := berNext(content)
+	if err != nil {
+		return 0, nil, err
+	}
+	tag, op, _, err := berNext(op)
+	return tag, op, err
+}
+
+func ldapCode(op []byte) error {
+	_, code, rest, err := berNext(op)
+	if err != nil {
+		return err
+	}
+	if len(code) == 1 && code[0] == 0 {
+		return nil
+	}
+	_, _, rest, _ = berNext(rest)
+	_, message, _, _ := berNext(rest)
+	if len(code) == 1 && code[0] == 49 {
+		return errors.New("invalid credentials")
+	}
+	return fmt.Errorf("LDAP error %v %s", code, message)
+}
+
+// ldapLogin binds to the LDAP server as the user, then reads the groups the user is a member of.
+func ldapLogin(username, password string) ([]string, error) {
+	if len(username) == 0 || len(password) == 0 {
+		// An empty password would be an unauthenticated bind, which servers allow.
+		return nil, errors.New("invalid credentials")
+	}
+	server, err := url.Parse(ldapURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	switch server.Scheme {
+	case "ldaps":
+		host := server.Host
+		if len(server.Port()) == 0 {
+			host += ":636"
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: server.Hostname()})
+	case "ldap":
+		host := server.Host
+		if len(server.Port()) == 0 {
+			host += ":389"
+		}
+		conn, err = dialer.Dial("tcp", host)
+	default:
+		return nil, fmt.Errorf("LDAP URL must be ldap:// or ldaps://")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	in := bufio.NewReader(conn)
+	dn := strings.Replace(ldapUserDN, "%s", ldapEscape(username), -1)
+	bind := berSequence(0x30, berInt(0x02, 1), berSequence(0x60, berInt(0x02, 3), berTLV(0x04, []byte(dn)), berTLV(0x80, []byte(password))))
+	if _, err := conn.Write(bind); err != nil {
+		return nil, err
+	}
+	tag, op, err := ldapResult(in)
+	if err != nil {
+		return nil, err
+	}
+	if tag != 0x61 {
+		return nil, errors.New("LDAP server sent an unexpected response")
+	}
+	if err := ldapCode(op); err != nil {
+		return nil, err
+	}
+	// A base object search of the user's own entry, with the filter (objectClass=*).
+	search := berSequence(0x30, berInt(0x02, 2), berSequence(0x63,
+		berTLV(0x04, []byte(dn)), berInt(0x0a, 0), berInt(0x0a, 0), berInt(0x02, 0), berInt(0x02, 0), berTLV(0x01, []byte{0}),
+		berTLV(0x87, []byte("objectClass")), berSequence(0x30, berTLV(0x04, []byte(ldapGroupAttribute)))))
+	if _, err := conn.Write(search); err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0)
+	for {
+		tag, op, err := ldapResult(in)
+		if err != nil {
+			return nil, err
+		}
+		if tag == 0x65 {
+			return groups, ldapCode(op)
+		}
+		if tag != 0x64 {
+			continue
+		}
+		_, _, attributes, _ := berNext(op)
+		_, attributes, _, _ = berNext(attributes)
+		for len(attributes) > 0 {
+			var attribute, values []byte
+			_, attribute, attributes, err = berNext(attributes)
+			if err != nil {
+				return nil, err
+			}
+			_, _, values, _ = berNext(attribute)
+			_, values, _, _ = berNext(values)
+			for len(values) > 0 {
+				var value []byte
+				_, value, values, err = berNext(values)
+				if err != nil {
+					return nil, err
+				}
+				groups = append(groups, ldapGroups(string(value))...)
+			}
+		}
+	}
+}
+
+// ldapGroups names a group both by its DN and by its first RDN's value, so -sso-roles can use either, e.g.
+// cn=racs-admins,ou=groups,dc=example,dc=com and racs-admins.
+func ldapGroups(dn string) []string {
+	names := []string{dn}
+	first := strings.SplitN(dn, ",", 2)[0]
+	if i := strings.Index(first, "="); i >= 0 {
+		names = append(names, first[i+1:])
+	}
+	return names
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var memoryLimit = regexp.MustCompile(`(?i)^[0-9]+[bkmg]?$`)
+
+func validLimits(params map[string]string) bool {
+	if value := strings.TrimSpace(params["cpus"]); len(value) > 0 {
+		cpus, err := strconv.ParseFloat(value, 64)
+		if err != nil || cpus <= 0 {
+			return false
+		}
+	}
+	if value := strings.TrimSpace(params["memory"]); len(value) > 0 && !memoryLimit.MatchString(value) {
+		return false
+	}
+	if value := params["diskQuota"]; len(value) > 0 {
+		quota, err := strconv.Atoi(value)
+		if err != nil || quota < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// limitArgs limits a container to the project's CPUs and memory, with p.lock held.
+func (p *project) limitArgs(run bool) []string {
+	args := make([]string, 0)
+	if len(p.cpus) > 0 {
+		if run {
+			args = append(args, "--cpus", p.cpus)
+		} else {
+			// podman build has no --cpus, so the same limit is expressed as a CFS quota.
+			cpus, _ := strconv.ParseFloat(p.cpus, 64)
+			args = append(args, "--cpu-period", "100000", "--cpu-quota", strconv.Itoa(int(cpus*100000)))
+		}
+	}
+	if len(p.memory) > 0 {
+		args = append(args, "--memory", p.memory)
+	}
+	return args
+}
+
+func quotaCheck(p *project, state state) error {
+	p.lock.RLock()
+	quota := p.diskQuota
+	p.lock.RUnlock()
+	if quota <= 0 {
+		return nil
+	}
+	switch state {
+	case PULLING, BUILDING, TESTING, PACKAGING:
+	default:
+		return nil
+	}
+	size := dirSize(fmt.Sprintf("%s/%d/workspace", projectAbs, p.id)) / (1024 * 1024)
+	if size > int64(quota) {
+		logger.Warnf("Project %d workspace is %d MB, over its %d MB quota", p.id, size, quota)
+		return fmt.Errorf("workspace is %d MB, over the project's disk quota of %d MB", size, quota)
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type lintIssue struct {
+	line    int
+	field   string
+	message string
+}
+
+type linter struct {
+	errors   []lintIssue
+	warnings []lintIssue
+}
+
+var pipelineFields = map[string]string{
+	"name":        "string",
+	"url":         "string",
+	"branch":      "string",
+	"destination": "string",
+	"tag":         "string",
+	"labels":      "list",
+	"buildSpec":   "string",
+	"packageSpec": "string",
+	"testSpec":    "string",
+	"testReport":  "string",
+	"scanner":     "string",
+	"scanFail":    "string",
+	"signing":     "string",
+	"sbom":        "string",
+	"sbomAttach":  "string",
+	"tagPattern":  "list",
+	"pathFilter":  "list",
+	"snapshot":    "string",
+	"sourceKind":  "string",
+	"artifacts":   "list",
+	"caches":      "list",
+	"poll":        "string",
+	"hold":        "string",
+	"triggers":    "node",
+	"after":       "list",
+	"variables":   "node",
+	"parsers":     "node",
+	"specs":       "node",
+}
+
+func (l *linter) error(n *yamlNode, field, format string, args ...interface{}) {
+	l.errors = append(l.errors, lintIssue{n.line, field, fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) warn(n *yamlNode, field, format string, args ...interface{}) {
+	l.warnings = append(l.warnings, lintIssue{n.line, field, fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) scalar(n *yamlNode, field string) (string, bool) {
+	if n.scalar == nil {
+		l.error(n, field, "must be a single value")
+		return "", false
+	}
+	return *n.scalar, true
+}
+
+func (l *linter) relative(n *yamlNode, field, path string) {
+	clean := filepath.Clean(path)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		l.error(n, field, "%s must be inside the project", path)
+	}
+}
+
+func lintProject(l *linter, root *yamlNode, prefix string) {
+	if root.fields == nil {
+		l.error(root, prefix, "must be a mapping of project settings")
+		return
+	}
+	fields := root.fields
+	for _, key := range root.keys {
+		kind, ok := pipelineFields[key]
+		if !ok {
+			l.warn(fields[key], prefix+key, "unknown setting")
+		} else if kind == "string" {
+			l.scalar(fields[key], prefix+key)
+		} else if kind == "list" {
+			if _, ok := fields[key].strings(); !ok {
+				l.error(fields[key], prefix+key, "must be a list of values")
+			}
+		}
+	}
+	if n := fields["name"]; n == nil || n.scalar == nil || len(*n.scalar) == 0 {
+		l.error(root, prefix+"name", "is required")
+	}
+	if n := fields["url"]; n == nil || n.scalar == nil || len(*n.scalar) == 0 {
+		l.error(root, prefix+"url", "is required")
+	}
+	if n := fields["branch"]; n == nil || n.scalar == nil || len(*n.scalar) == 0 {
+		l.error(root, prefix+"branch", "is required")
+	}
+	if n := fields["destination"]; n != nil && n.scalar != nil && len(*n.scalar) > 0 && registries[*n.scalar] == nil {
+		l.warn(n, prefix+"destination", "registry %s does not exist", *n.scalar)
+	}
+	if n := fields["tag"]; n != nil && n.scalar != nil && len(*n.scalar) > 0 && !strings.Contains(*n.scalar, "$VERSION") {
+		l.warn(n, prefix+"tag", "does not contain $VERSION, every push will overwrite the same tag")
+	}
+	if n := fields["poll"]; n != nil && n.scalar != nil {
+		if poll, err := strconv.Atoi(*n.scalar); err != nil || poll < 0 {
+			l.error(n, prefix+"poll", "must be a number of seconds")
+		}
+	}
+	if n := fields["hold"]; n != nil && n.scalar != nil {
+		if _, err := strconv.ParseBool(*n.scalar); err != nil {
+			l.error(n, prefix+"hold", "must be true or false")
+		}
+	}
+	if n := fields["scanner"]; n != nil && n.scalar != nil && !validScan(map[string]string{"scanner": *n.scalar}) {
+		l.error(n, prefix+"scanner", "must be trivy or grype")
+	}
+	if n := fields["signing"]; n != nil && n.scalar != nil && !validSigning(map[string]string{"signing": *n.scalar}) {
+		l.error(n, prefix+"signing", "must be key or keyless")
+	}
+	if n := fields["sbom"]; n != nil && n.scalar != nil && !validSBOM(map[string]string{"sbom": *n.scalar}) {
+		l.error(n, prefix+"sbom", "must be cyclonedx or spdx")
+	}
+	if n := fields["sbomAttach"]; n != nil && n.scalar != nil {
+		if _, err := strconv.ParseBool(*n.scalar); err != nil {
+			l.error(n, prefix+"sbomAttach", "must be true or false")
+		}
+	}
+	if n := fields["sourceKind"]; n != nil && n.scalar != nil && !validSource(map[string]string{"sourceKind": *n.scalar}) {
+		l.error(n, prefix+"sourceKind", "must be git, hg, svn or tarball")
+	}
+	if n := fields["snapshot"]; n != nil && n.scalar != nil {
+		if _, err := strconv.ParseBool(*n.scalar); err != nil {
+			l.error(n, prefix+"snapshot", "must be true or false")
+		}
+	}
+	if n := fields["scanFail"]; n != nil && n.scalar != nil {
+		if !validScan(map[string]string{"scanFail": *n.scalar}) {
+			l.error(n, prefix+"scanFail", "must be critical, high, medium or low")
+		} else if fields["scanner"] == nil || fields["scanner"].scalar == nil || len(*fields["scanner"].scalar) == 0 {
+			l.warn(n, prefix+"scanFail", "is ignored without a scanner")
+		}
+	}
+	for _, key := range []string{"buildSpec", "packageSpec", "testSpec", "testReport"} {
+		if n := fields[key]; n != nil && n.scalar != nil && len(*n.scalar) > 0 {
+			l.relative(n, prefix+key, *n.scalar)
+		}
+	}
+	if n := fields["testReport"]; n != nil && (fields["testSpec"] == nil || fields["testSpec"].scalar == nil || len(*fields["testSpec"].scalar) == 0) {
+		l.warn(n, prefix+"testReport", "is ignored without a testSpec")
+	}
+	if n := fields["artifacts"]; n != nil {
+		patterns, _ := n.strings()
+		for _, pattern := range patterns {
+			l.relative(n, prefix+"artifacts", pattern)
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				l.error(n, prefix+"artifacts", "invalid pattern %s", pattern)
+			}
+		}
+	}
+	if n := fields["caches"]; n != nil {
+		caches, _ := n.strings()
+		for _, cache := range caches {
+			if !filepath.IsAbs(cache) {
+				l.error(n, prefix+"caches", "cache path %s must be absolute", cache)
+			}
+		}
+	}
+	if n := fields["triggers"]; n != nil {
+		lintTriggers(l, n, prefix+"triggers")
+	}
+	if n := fields["after"]; n != nil {
+		after, _ := n.strings()
+		for _, name := range after {
+			if lintProjectRef(name) == nil {
+				l.warn(n, prefix+"after", "project %s does not exist", name)
+			}
+		}
+	}
+	if n := fields["variables"]; n != nil {
+		lintVariables(l, n, prefix+"variables")
+	}
+	if n := fields["parsers"]; n != nil {
+		lintParsers(l, n, prefix+"parsers")
+	}
+	if n := fields["specs"]; n != nil {
+		lintSpecs(l, n, prefix+"specs", fields)
+	}
+}
+
+func lintProjectRef(ref string) *project {
+	if id, err := strconv.Atoi(ref); err == nil {
+		return projectGet(id)
+	}
+	for _, p := range projectAll() {
+		if p.currentName() == ref {
+			return p
+		}
+	}
+	return nil
+}
+
+func lintTriggers(l *linter, n *yamlNode, field string) {
+	if n.items == nil {
+		l.error(n, field, "must be a list of triggers")
+		return
+	}
+	for i, item := range n.items {
+		itemField := fmt.Sprintf("%s[%d]", field, i)
+		if item.fields == nil {
+			l.error(item, itemField, "must have a project and a stage")
+			continue
+		}
+		target := item.fields["project"]
+		if target == nil || target.scalar == nil {
+			l.error(item, itemField+".project", "is required")
+		} else if lintProjectRef(*target.scalar) == nil {
+			l.warn(target, itemField+".project", "project %s does not exist", *target.scalar)
+		}
+		stage := item.fields["stage"]
+		if stage == nil || stage.scalar == nil {
+			l.error(item, itemField+".stage", "is required")
+		} else if _, ok := stageStates[*stage.scalar]; !ok {
+			l.error(stage, itemField+".stage", "unknown stage %s", *stage.scalar)
+		}
+	}
+}
+
+func lintVariables(l *linter, n *yamlNode, field string) {
+	if n.fields == nil {
+		l.error(n, field, "must be a mapping of variable names")
+		return
+	}
+	for _, name := range n.keys {
+		v := n.fields[name]
+		if !variableName.MatchString(name) {
+			l.error(v, field+"."+name, "invalid variable name")
+		}
+		if v.fields == nil {
+			continue
+		}
+		for _, key := range v.keys {
+			switch key {
+			case "value":
+				l.scalar(v.fields[key], field+"."+name+".value")
+			case "kind":
+				if kind, _ := l.scalar(v.fields[key], field+"."+name+".kind"); !variableKinds[kind] {
+					l.error(v.fields[key], field+"."+name+".kind", "must be env, arg or sign")
+				}
+			case "secret":
+				if secret, ok := l.scalar(v.fields[key], field+"."+name+".secret"); ok {
+					if _, err := strconv.ParseBool(secret); err != nil {
+						l.error(v.fields[key], field+"."+name+".secret", "must be true or false")
+					}
+				}
+			default:
+				l.warn(v.fields[key], field+"."+name+"."+key, "unknown setting")
+			}
+		}
+		if secret := v.fields["secret"]; secret != nil && secret.scalar != nil && *secret.scalar == "true" {
+			if value := v.fields["value"]; value != nil && value.scalar != nil && len(*value.scalar) > 0 {
+				l.warn(value, field+"."+name+".value", "secret value is stored in the pipeline file")
+			}
+		}
+	}
+}
+
+func lintParsers(l *linter, n *yamlNode, field string) {
+	if n.items == nil {
+		l.error(n, field, "must be a list of parsers")
+		return
+	}
+	for i, item := range n.items {
+		itemField := fmt.Sprintf("%s[%d]", field, i)
+		if item.fields == nil {
+			l.error(item, itemField, "must have a stage, name and pattern")
+			continue
+		}
+		if stage := item.fields["stage"]; stage == nil || stage.scalar == nil {
+			l.error(item, itemField+".stage", "is required")
+		} else if _, ok := stageStates[*stage.scalar]; !ok {
+			l.error(stage, itemField+".stage", "unknown stage %s", *stage.scalar)
+		}
+		if name := item.fields["name"]; name == nil || name.scalar == nil || len(*name.scalar) == 0 {
+			l.error(item, itemField+".name", "is required")
+		} else if !variableName.MatchString(*name.scalar) {
+			l.error(name, itemField+".name", "invalid parser name")
+		}
+		if pattern := item.fields["pattern"]; pattern == nil || pattern.scalar == nil {
+			l.error(item, itemField+".pattern", "is required")
+		} else if _, err := regexp.Compile(*pattern.scalar); err != nil {
+			l.error(pattern, itemField+".pattern", "%v", err)
+		}
+		if mode := item.fields["mode"]; mode != nil && mode.scalar != nil {
+			switch *mode.scalar {
+			case "first", "last", "count", "sum":
+			default:
+				l.error(mode, itemField+".mode", "must be first, last, count or sum")
+			}
+		}
+	}
+}
+
+func lintSpecs(l *linter, n *yamlNode, field string, fields map[string]*yamlNode) {
+	if n.fields == nil {
+		l.error(n, field, "must be a mapping of spec file names to contents")
+		return
+	}
+	for _, name := range n.keys {
+		spec := n.fields[name]
+		l.relative(spec, field+"."+name, name)
+		if clean := strings.TrimPrefix(filepath.Clean("/"+name), "/"); strings.HasPrefix(clean, "workspace/") || strings.HasPrefix(clean, "context/") {
+			l.error(spec, field+"."+name, "%s is in the repository and cannot be set here", name)
+		}
+		content, ok := l.scalar(spec, field+"."+name)
+		if !ok {
+			continue
+		} else if len(content) > specLimit {
+			l.error(spec, field+"."+name, "spec is over the limit of %d bytes", specLimit)
+		}
+		for _, issue := range specIssues(content) {
+			l.errors = append(l.errors, lintIssue{spec.line + issue.line, field + "." + name, issue.message})
+		}
+	}
+	for _, key := range []string{"buildSpec", "packageSpec", "testSpec"} {
+		if ref := fields[key]; ref != nil && ref.scalar != nil && len(*ref.scalar) > 0 && n.fields[*ref.scalar] == nil {
+			l.warn(ref, strings.TrimSuffix(field, "specs")+key, "spec %s is not included in specs", *ref.scalar)
+		}
+	}
+}
+
+func lintPipeline(content string) *linter {
+	l := &linter{make([]lintIssue, 0), make([]lintIssue, 0)}
+	root, err := parseYAML(content)
+	if err != nil {
+		line := 0
+		fmt.Sscanf(err.Error(), "line %d:", &line)
+		l.errors = append(l.errors, lintIssue{line, "", err.Error()})
+		return l
+	}
+	if list := root.fields["projects"]; root.fields != nil && list != nil {
+		if list.items == nil {
+			l.error(list, "projects", "must be a list of projects")
+		}
+		for i, item := range list.items {
+			lintProject(l, item, fmt.Sprintf("projects[%d].", i))
+		}
+	} else {
+		lintProject(l, root, "")
+	}
+	return l
+}
+
+func lintIssues(issues []lintIssue) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0)
+	for _, issue := range issues {
+		result = append(result, map[string]interface{}{
+			"line":    issue.line,
+			"field":   issue.field,
+			"message": issue.message,
+		})
+	}
+	return result
+}
+
+func handlePipelineLint(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	content, ok := params["pipeline"]
+	if !ok {
+		body, _ := ioutil.ReadAll(r.Body)
+		content = string(body)
+	}
+	writeLint(w, lintPipeline(content))
+}
+
+// writeLint sends the problems found in a pipeline file, with status 422 if there are any errors.
+func writeLint(w http.ResponseWriter, l *linter) {
+	w.Header().Add("Content-Type", "application/json")
+	if len(l.errors) > 0 {
+		w.WriteHeader(422)
+	}
+	j, _ := json.Marshal(map[string]interface{}{
+		"valid":    len(l.errors) == 0,
+		"errors":   lintIssues(l.errors),
+		"warnings": lintIssues(l.warnings),
+	})
+	w.Write(j)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Only the end of a long log is indexed, since that's where a failed task's errors are.
+const logIndexLines = 5000
+const logIndexWidth = 500
+
+var ansiEscape = regexp.MustCompile("\u001B\\[[0-9;?]*[A-Za-z]")
+
+// Sections are marked as in GitHub Actions, with either ##[group]TITLE or ::group::TITLE lines, which the routine
+// also writes around hooks.
+var groupStart = regexp.MustCompile(`^(?:##\[group\]|::group::)(.*)$`)
+var groupEnd = regexp.MustCompile(`^(?:##\[endgroup\]|::endgroup::)\s*$`)
+
+// logWriter writes a task's output to its log, and the offset and time of each line to the log's line index.
+type logWriter struct {
+	lock   sync.Mutex
+	log    *os.File
+	lines  *os.File
+	offset int64
+	midway bool
+}
+
+func createLog(id int) (*logWriter, error) {
+	log, err := createFile(taskLogKey(id))
+	if err != nil {
+		return nil, err
+	}
+	lines, err := createFile(taskLinesKey(id))
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	return &logWriter{log: log, lines: lines}, nil
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, c := range b {
+		if !w.midway {
+			fmt.Fprintf(w.lines, "%d %d\n", w.offset+int64(i), now)
+		}
+		w.midway = c != '\n'
+	}
+	n, err := w.log.Write(b)
+	w.offset += int64(n)
+	return n, err
+}
+
+func (w *logWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *logWriter) Close() error {
+	w.lines.Close()
+	return w.log.Close()
+}
+
+// taskFile reads a task's file while it's local and from storage once it's archived.
+func taskFile(key string) ([]byte, error) {
+	if content, err := ioutil.ReadFile(key); !os.IsNotExist(err) {
+		return content, err
+	}
+	archived, err := store.Open(key, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer archived.Close()
+	return ioutil.ReadAll(archived)
+}
+
+type logSection struct {
+	title    string
+	line     int
+	started  int64
+	ended    int64
+	segments []interface{}
+}
+
+func logTime(millis int64) interface{} {
+	if millis == 0 {
+		return nil
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04:05")
+}
+
+func (s *logSection) segment() map[string]interface{} {
+	duration := 0.0
+	if s.started > 0 && s.ended > s.started {
+		duration = float64(s.ended-s.started) / 1000
+	}
+	return map[string]interface{}{
+		"section":  s.title,
+		"line":     s.line,
+		"time":     logTime(s.started),
+		"duration": duration,
+		"segments": s.segments,
+	}
+}
+
+// logSegments splits a log into lines with the time each started, nesting the lines of each section under it.
+// Overwritten progress output only keeps the text after its last carriage return, and escapes are removed unless
+// ansi is set.
+func logSegments(log, index []byte, ansi bool) []interface{} {
+	times := make(map[int64]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(index))
+	for scanner.Scan() {
+		var offset, millis int64
+		if _, err := fmt.Sscan(scanner.Text(), &offset, &millis); err == nil {
+			times[offset] = millis
+		}
+	}
+	root := &logSection{}
+	stack := []*logSection{root}
+	var offset int64
+	var last int64
+	for number, line := range strings.SplitAfter(string(log), "\n") {
+		millis := times[offset]
+		offset += int64(len(line))
+		if len(line) == 0 {
+			break
+		}
+		if millis > 0 {
+			last = millis
+		}
+		text := strings.TrimRight(line, "\r\n")
+		if i := strings.LastIndex(text, "\r"); i >= 0 {
+			text = text[i+1:]
+		}
+		plain := ansiEscape.ReplaceAllString(text, "")
+		if !ansi {
+			text = plain
+		}
+		current := stack[len(stack)-1]
+		if match := groupStart.FindStringSubmatch(plain); match != nil {
+			stack = append(stack, &logSection{title: strings.TrimSpace(match[1]), line: number + 1, started: millis})
+			continue
+		}
+		if groupEnd.MatchString(plain) {
+			if len(stack) > 1 {
+				current.ended = millis
+				stack = stack[:len(stack)-1]
+				parent := stack[len(stack)-1]
+				parent.segments = append(parent.segments, current.segment())
+			}
+			continue
+		}
+		current.segments = append(current.segments, map[string]interface{}{
+			"line": number + 1,
+			"time": logTime(millis),
+			"text": text,
+		})
+	}
+	// Sections still open when the log ends run until its last line.
+	for len(stack) > 1 {
+		current := stack[len(stack)-1]
+		current.ended = last
+		stack = stack[:len(stack)-1]
+		parent := stack[len(stack)-1]
+		parent.segments = append(parent.segments, current.segment())
+	}
+	if root.segments == nil {
+		return make([]interface{}, 0)
+	}
+	return root.segments
+}
+
+// truncateRunes cuts s to at most n bytes without splitting a UTF-8 character.
+func truncateRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// logIndex stores the finished task's log lines, without terminal escapes, so they can be searched without reading
+// every log. Lines indexed before for the task are replaced.
+func logIndex(p *project, t *task) {
+	file, err := os.Open(taskLogKey(t.id))
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	defer file.Close()
+	lines := make([]string, 0)
+	first := 1
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(ansiEscape.ReplaceAllString(scanner.Text(), ""))
+		line = truncateRunes(line, logIndexWidth)
+		lines = append(lines, line)
+		if len(lines) > logIndexLines {
+			lines = lines[1:]
+			first += 1
+		}
+	}
+	db.Exec(`DELETE FROM log_lines WHERE task = ?`, t.id)
+	// Rows are inserted in batches, each within SQLite's limit of 999 parameters.
+	for start := 0; start < len(lines); start += 200 {
+		end := start + 200
+		if end > len(lines) {
+			end = len(lines)
+		}
+		query := `INSERT INTO log_lines(task, project, number, text) VALUES`
+		args := make([]interface{}, 0)
+		for i := start; i < end; i++ {
+			if len(lines[i]) == 0 {
+				continue
+			}
+			if len(args) > 0 {
+				query += `,`
+			}
+			query += ` (?, ?, ?, ?)`
+			args = append(args, t.id, p.id, first+i, lines[i])
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if _, err := db.Exec(query, args...); err != nil {
+			logger.Error(err)
+			return
+		}
+	}
+}
+
+// handleSearchLogs finds lines containing q. The LIKE '%q%' can't use an index, so every indexed line is scanned, at
+// most logIndexLines for each task; project narrows the scan to one project's lines through log_lines_project.
+func handleSearchLogs(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	q := strings.TrimSpace(params["q"])
+	if len(q) == 0 {
+		writeError(w, invalidParam("q", "q is required"))
+		return
+	}
+	pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(q))
+	query := `SELECT log_lines.task, log_lines.project, log_lines.number, log_lines.text, tasks.type, tasks.state, tasks.time,
+		IFNULL(tasks.build, 0) FROM log_lines JOIN tasks ON tasks.id = log_lines.task WHERE LOWER(log_lines.text) LIKE ? ESCAPE '\'`
+	args := []interface{}{"%" + pattern + "%"}
+	if len(params["project"]) > 0 {
+		id, _ := strconv.Atoi(params["project"])
+		query += ` AND log_lines.project = ?`
+		args = append(args, id)
+	}
+	if params["failed"] == "true" {
+		query += ` AND tasks.state = 'ERROR'`
+	}
+	limit, _ := strconv.Atoi(params["limit"])
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query += ` ORDER BY log_lines.task DESC, log_lines.number LIMIT ?`
+	args = append(args, limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var tid int
+		var pid int
+		var number int
+		var text string
+		var kind string
+		var state string
+		var time string
+		var build int
+		rows.Scan(&tid, &pid, &number, &text, &kind, &state, &time, &build)
+		name := ""
+		if p := projectGet(pid); p != nil {
+			name = p.name
+		}
+		result = append(result, map[string]interface{}{
+			"task":    tid,
+			"project": pid,
+			"name":    name,
+			"type":    kind,
+			"state":   state,
+			"time":    time,
+			"build":   build,
+			"line":    number,
+			"text":    text,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleTaskLogsSegments(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	var kind string
+	var state string
+	if err := db.QueryRow(`SELECT type, state FROM tasks WHERE id = ?`, id).Scan(&kind, &state); err != nil {
+		writeError(w, notFound("Task"))
+		return
+	}
+	log, err := taskFile(taskLogKey(id))
+	if err != nil {
+		logger.Warn(err)
+	}
+	// Tasks from before line times were recorded don't have an index, so their lines have no time.
+	index, _ := taskFile(taskLinesKey(id))
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"id":       id,
+		"stage":    kind,
+		"state":    state,
+		"segments": logSegments(log, index, params["ansi"] != "strip"),
+	})
+	w.Write(j)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maintenanceActions start new builds, so they're refused while the server drains.
+var maintenanceActions = map[string]bool{
+	"/project/build":           true,
+	"/project/run":             true,
+	"/webhook":                 true,
+	"/project/proposals/trial": true,
+}
+
+var maintenanceLock sync.Mutex
+var maintenanceSince time.Time
+var maintenanceRetry int
+
+func inMaintenance() bool {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+	return !maintenanceSince.IsZero()
+}
+
+// maintenanceRefuse answers requests that would start a build with 503 while in maintenance mode, with how long to
+// wait before trying again.
+func maintenanceRefuse(w http.ResponseWriter, path string) bool {
+	if !maintenanceActions[path] {
+		return false
+	}
+	maintenanceLock.Lock()
+	since, retry := maintenanceSince, maintenanceRetry
+	maintenanceLock.Unlock()
+	if since.IsZero() {
+		return false
+	}
+	w.Header().Add("Retry-After", strconv.Itoa(retry))
+	writeError(w, statusError(503, "Server is in maintenance mode"))
+	return true
+}
+
+// maintenanceStatus reports how far draining has got. The server is drained when no project is running a stage or
+// has stages queued.
+func maintenanceStatus() map[string]interface{} {
+	maintenanceLock.Lock()
+	since, retry := maintenanceSince, maintenanceRetry
+	maintenanceLock.Unlock()
+	running := make([]int, 0)
+	queued := 0
+	for _, p := range projectAll() {
+		if p.currentState().running() {
+			running = append(running, p.id)
+		}
+		queued += len(p.queue)
+	}
+	status := map[string]interface{}{
+		"maintenance": !since.IsZero(),
+		"running":     running,
+		"queued":      queued,
+		"drained":     len(running) == 0 && queued == 0,
+	}
+	if !since.IsZero() {
+		status["since"] = since.UTC().Format("2006-01-02 15:04:05")
+		status["retryAfter"] = retry
+	}
+	return status
+}
+
+func writeMaintenance(w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(maintenanceStatus())
+	w.Write(j)
+}
+
+func handleAdminMaintenance(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/admin/maintenance", params) {
+		return
+	}
+	writeMaintenance(w)
+}
+
+func handleAdminMaintenanceStart(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/admin/maintenance/start", params) {
+		return
+	}
+	retry := 300
+	if value := params["retryAfter"]; len(value) > 0 {
+		retry, _ = strconv.Atoi(value)
+		if retry <= 0 {
+			writeError(w, invalidParam("retryAfter", "retryAfter must be a positive number of seconds"))
+			return
+		}
+	}
+	maintenanceLock.Lock()
+	if maintenanceSince.IsZero() {
+		maintenanceSince = time.Now()
+	}
+	maintenanceRetry = retry
+	maintenanceLock.Unlock()
+	logger.Infof("Maintenance mode started by %s", u.Name)
+	writeMaintenance(w)
+}
+
+func handleAdminMaintenanceStop(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/admin/maintenance/stop", params) {
+		return
+	}
+	maintenanceLock.Lock()
+	maintenanceSince = time.Time{}
+	maintenanceLock.Unlock()
+	logger.Infof("Maintenance mode stopped by %s", u.Name)
+	writeMaintenance(w)
+}
+
+// handleAdminRestart exits once the server has drained, for its service manager to start it again, e.g. after an update.
+func handleAdminRestart(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/admin/restart", params) {
+		return
+	}
+	status := maintenanceStatus()
+	if status["maintenance"] != true {
+		writeError(w, conflict("Server is not in maintenance mode"))
+		return
+	}
+	if status["drained"] != true {
+		writeError(w, &httpError{409, "conflict", "Server has not drained", status})
+		return
+	}
+	logger.Infof("Restart requested by %s", u.Name)
+	w.WriteHeader(202)
+	w.Write([]byte("Restarting"))
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	go func() {
+		time.Sleep(time.Second)
+		db.Close()
+		os.Exit(0)
+	}()
+}
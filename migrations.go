@@ -0,0 +1,371 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS users(
+		name STRING PRIMARY KEY,
+		passwd STRING,
+		salt STRING,
+		role STRING
+	)`,
+	`CREATE TABLE IF NOT EXISTS registries(
+		name STRING PRIMARY KEY,
+		url STRING,
+		user STRING,
+		password STRING
+	)`,
+	`CREATE TABLE IF NOT EXISTS projects(
+		id INTEGER PRIMARY KEY,
+		name STRING,
+		source STRING,
+		branch STRING,
+		destination STRING,
+		tag STRING,
+		buildSpec STRING,
+		packageSpec STRING,
+		state STRING,
+		version INTEGER
+	)`,
+	`ALTER TABLE projects ADD COLUMN buildHash BLOB`,
+	`ALTER TABLE projects ADD COLUMN labels STRING`,
+	`CREATE TABLE IF NOT EXISTS tasks(
+		id INTEGER PRIMARY KEY,
+		project INTEGER,
+		type STRING,
+		state STRING,
+		time STRING
+	)`,
+	`CREATE TABLE IF NOT EXISTS members(
+		project INTEGER,
+		user STRING,
+		role STRING
+	)`,
+	`CREATE TABLE IF NOT EXISTS triggers(
+		project INTEGER,
+		target INTEGER,
+		state STRING
+	)`,
+	`CREATE TABLE IF NOT EXISTS revisions(
+		id INTEGER PRIMARY KEY,
+		project INTEGER,
+		user STRING,
+		time STRING,
+		config STRING
+	)`,
+	`ALTER TABLE tasks ADD COLUMN revision INTEGER`,
+	`ALTER TABLE projects ADD COLUMN caches STRING`,
+	`ALTER TABLE projects ADD COLUMN poll INTEGER`,
+	`ALTER TABLE projects ADD COLUMN head STRING`,
+	`ALTER TABLE projects ADD COLUMN hold BOOLEAN`,
+	`ALTER TABLE projects ADD COLUMN testSpec STRING`,
+	`ALTER TABLE projects ADD COLUMN testReport STRING`,
+	`CREATE TABLE IF NOT EXISTS tests(
+		task INTEGER,
+		project INTEGER,
+		suite STRING,
+		class STRING,
+		name STRING,
+		status STRING,
+		duration REAL,
+		message STRING
+	)`,
+	`ALTER TABLE projects ADD COLUMN artifacts STRING`,
+	`CREATE TABLE IF NOT EXISTS artifacts(
+		project INTEGER,
+		version INTEGER,
+		task INTEGER,
+		path STRING,
+		size INTEGER,
+		sha256 STRING,
+		time STRING
+	)`,
+	`CREATE TABLE IF NOT EXISTS deployments(
+		id INTEGER PRIMARY KEY,
+		project INTEGER,
+		environment STRING,
+		version INTEGER,
+		image STRING,
+		user STRING,
+		time STRING
+	)`,
+	`CREATE TABLE IF NOT EXISTS parsers(
+		project INTEGER,
+		stage STRING,
+		name STRING,
+		pattern STRING,
+		mode STRING,
+		PRIMARY KEY(project, stage, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS metadata(
+		task INTEGER,
+		project INTEGER,
+		name STRING,
+		value STRING,
+		PRIMARY KEY(task, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS approvals(
+		project INTEGER,
+		version INTEGER,
+		user STRING,
+		time STRING,
+		approved BOOLEAN
+	)`,
+	`CREATE TABLE IF NOT EXISTS variables(
+		project INTEGER,
+		name STRING,
+		value STRING,
+		kind STRING,
+		secret BOOLEAN,
+		PRIMARY KEY(project, name)
+	)`,
+	`ALTER TABLE registries ADD COLUMN provider STRING`,
+	`ALTER TABLE tasks ADD COLUMN branch STRING`,
+	`CREATE TABLE IF NOT EXISTS task_labels(
+		task INTEGER,
+		label STRING
+	)`,
+	`CREATE TABLE IF NOT EXISTS searches(
+		name STRING PRIMARY KEY,
+		user STRING,
+		query STRING
+	)`,
+	`ALTER TABLE tasks ADD COLUMN attempt INTEGER`,
+	`CREATE TABLE IF NOT EXISTS retries(
+		project INTEGER,
+		stage STRING,
+		count INTEGER,
+		backoff INTEGER,
+		PRIMARY KEY(project, stage)
+	)`,
+	`ALTER TABLE projects ADD COLUMN cpus STRING`,
+	`ALTER TABLE projects ADD COLUMN memory STRING`,
+	`ALTER TABLE projects ADD COLUMN diskQuota INTEGER`,
+	`ALTER TABLE tasks ADD COLUMN sha STRING`,
+	`ALTER TABLE tasks ADD COLUMN version INTEGER`,
+	`ALTER TABLE tasks ADD COLUMN duration REAL`,
+	`CREATE TABLE IF NOT EXISTS audit(
+		id INTEGER PRIMARY KEY,
+		time STRING,
+		user STRING,
+		ip STRING,
+		action STRING,
+		project INTEGER,
+		params STRING,
+		status INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS proposals(
+		id INTEGER PRIMARY KEY,
+		project INTEGER,
+		time STRING,
+		state STRING,
+		base STRING,
+		specs STRING,
+		updates STRING,
+		trial STRING,
+		log STRING
+	)`,
+	`CREATE TABLE IF NOT EXISTS templates(
+		name STRING PRIMARY KEY,
+		user STRING,
+		time STRING,
+		project INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS builds(
+		id INTEGER PRIMARY KEY,
+		project INTEGER,
+		run STRING,
+		user STRING,
+		state STRING,
+		time STRING,
+		finished STRING
+	)`,
+	`ALTER TABLE tasks ADD COLUMN build INTEGER`,
+	`ALTER TABLE projects ADD COLUMN scanner STRING`,
+	`ALTER TABLE projects ADD COLUMN scanFail STRING`,
+	`CREATE TABLE IF NOT EXISTS vulnerabilities(
+		task INTEGER,
+		project INTEGER,
+		id STRING,
+		package STRING,
+		installed STRING,
+		fixed STRING,
+		severity STRING,
+		title STRING
+	)`,
+	`ALTER TABLE projects ADD COLUMN signing STRING`,
+	`ALTER TABLE tasks ADD COLUMN digest STRING`,
+	`ALTER TABLE tasks ADD COLUMN signature STRING`,
+	`ALTER TABLE builds ADD COLUMN digest STRING`,
+	`ALTER TABLE builds ADD COLUMN signature STRING`,
+	`ALTER TABLE projects ADD COLUMN sbom STRING`,
+	`ALTER TABLE projects ADD COLUMN sbomAttach BOOLEAN`,
+	`ALTER TABLE projects ADD COLUMN tagPattern STRING`,
+	`CREATE TABLE IF NOT EXISTS webhooks(
+		project INTEGER PRIMARY KEY,
+		secret STRING
+	)`,
+	`ALTER TABLE projects ADD COLUMN pathFilter STRING`,
+	`CREATE TABLE IF NOT EXISTS deliveries(
+		id INTEGER PRIMARY KEY,
+		project INTEGER,
+		event STRING,
+		ref STRING,
+		revision STRING,
+		status STRING,
+		message STRING,
+		time STRING
+	)`,
+	`CREATE TABLE IF NOT EXISTS previews(
+		build INTEGER PRIMARY KEY,
+		project INTEGER,
+		host STRING,
+		number INTEGER,
+		sha STRING
+	)`,
+	`ALTER TABLE builds ADD COLUMN sha STRING`,
+	`ALTER TABLE users ADD COLUMN provider STRING`,
+	`ALTER TABLE users ADD COLUMN login STRING`,
+	`ALTER TABLE projects ADD COLUMN snapshot BOOLEAN`,
+	`CREATE TABLE IF NOT EXISTS snapshots(
+		task INTEGER PRIMARY KEY,
+		project INTEGER,
+		stage STRING,
+		size INTEGER,
+		time STRING
+	)`,
+	`ALTER TABLE projects ADD COLUMN sourceKind STRING`,
+	`ALTER TABLE tasks ADD COLUMN started STRING`,
+	`ALTER TABLE tasks ADD COLUMN finished STRING`,
+	`ALTER TABLE tasks ADD COLUMN exitCode INTEGER`,
+	`UPDATE tasks SET started = time, exitCode = CASE state WHEN 'SUCCESS' THEN 0 END WHERE started IS NULL`,
+	`CREATE TABLE IF NOT EXISTS log_lines(
+		task INTEGER,
+		project INTEGER,
+		number INTEGER,
+		text STRING
+	)`,
+	`CREATE INDEX IF NOT EXISTS log_lines_task ON log_lines(task)`,
+	`CREATE TABLE IF NOT EXISTS variants(
+		project INTEGER,
+		name STRING,
+		buildSpec STRING,
+		triggers STRING,
+		PRIMARY KEY(project, name)
+	)`,
+	`ALTER TABLE builds ADD COLUMN variant STRING`,
+	`ALTER TABLE tasks ADD COLUMN variant STRING`,
+	`CREATE INDEX IF NOT EXISTS log_lines_project ON log_lines(project)`,
+	`CREATE TABLE IF NOT EXISTS project_labels(
+		project INTEGER,
+		label STRING,
+		PRIMARY KEY(project, label)
+	)`,
+	`CREATE INDEX IF NOT EXISTS project_labels_label ON project_labels(label)`,
+	`UPDATE projects SET labels = NULL`,
+	`CREATE TABLE IF NOT EXISTS installs(
+		time STRING,
+		fresh INTEGER
+	)`,
+	`CREATE TABLE IF NOT EXISTS afters(
+		project INTEGER,
+		upstream INTEGER,
+		PRIMARY KEY(project, upstream)
+	)`,
+}
+
+// backfills run after the migration with the same number, for data that can't be written in SQL both databases accept.
+var backfills = map[int]func(){
+	76: installBackfill,
+	66: taskBackfill,
+	73: labelBackfill,
+}
+
+// installBackfill records whether racs was installed on an empty database, which is the only kind that is set up with
+// /setup. Servers from before it authenticated users without recording them, so they have no users but need no setup.
+func installBackfill() {
+	var projects int
+	db.QueryRow(`SELECT COUNT(*) FROM projects`).Scan(&projects)
+	fresh := 0
+	if migratedFrom == 0 && projects == 0 {
+		fresh = 1
+	}
+	db.Exec(`INSERT INTO installs(time, fresh) VALUES(datetime('now'), ?)`, fresh)
+}
+
+// labelBackfill moves project labels from the comma separated projects.labels into project_labels.
+func labelBackfill() {
+	rows, err := db.Query(`SELECT id, IFNULL(labels, '') FROM projects`)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	labels := make(map[int][]string)
+	for rows.Next() {
+		var id int
+		var joined string
+		rows.Scan(&id, &joined)
+		labels[id] = splitLabels(joined)
+	}
+	rows.Close()
+	for id, list := range labels {
+		labelsStore(id, list)
+	}
+}
+
+// taskBackfill works out when tasks from before finish times were recorded finished, from their start and duration.
+func taskBackfill() {
+	rows, err := db.Query(`SELECT id, time, duration FROM tasks WHERE finished IS NULL AND duration IS NOT NULL AND state != 'RUNNING'`)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	finished := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var started string
+		var duration float64
+		rows.Scan(&id, &started, &duration)
+		if t, err := time.Parse("2006-01-02 15:04:05", started); err == nil {
+			finished[id] = t.Add(time.Duration(duration * float64(time.Second))).Format("2006-01-02 15:04:05")
+		}
+	}
+	rows.Close()
+	for id, at := range finished {
+		db.Exec(`UPDATE tasks SET finished = ? WHERE id = ?`, at, id)
+	}
+}
+
+// migratedFrom is the schema version the database had when racs started.
+var migratedFrom int
+
+func migrate() {
+	db.Exec(`CREATE TABLE IF NOT EXISTS migrations(
+		version INTEGER PRIMARY KEY,
+		time STRING
+	)`)
+	var version int
+	db.QueryRow(`SELECT IFNULL(MAX(version), 0) FROM migrations`).Scan(&version)
+	if version > len(migrations) {
+		logger.Fatalf("Database schema version %d is newer than this version of racs (%d)", version, len(migrations))
+	}
+	migratedFrom = version
+	legacy := version == 0
+	for i := version; i < len(migrations); i++ {
+		_, err := db.Exec(migrations[i])
+		if err != nil {
+			// Databases created before migrations were tracked may already have some columns.
+			if !legacy || !strings.Contains(err.Error(), "duplicate column") {
+				logger.Fatalf("Migration %d failed: %v", i+1, err)
+			}
+		}
+		if backfill := backfills[i+1]; backfill != nil {
+			backfill()
+		}
+		db.Exec(`INSERT INTO migrations(version, time) VALUES(?, datetime('now'))`, i+1)
+		logger.Infof("Applied migration %d", i+1)
+	}
+}
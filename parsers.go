@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+type logParser struct {
+	stage   string
+	name    string
+	pattern *regexp.Regexp
+	mode    string
+}
+
+var stageStates = map[string]state{
+	"clean":   CLEANING,
+	"clone":   CLONING,
+	"prepare": PREPARING,
+	"pull":    PULLING,
+	"build":   BUILDING,
+	"test":    TESTING,
+	"package": PACKAGING,
+	"scan":    SCANNING,
+	"push":    PUSHING,
+}
+
+func projectParsers(pid int) []*logParser {
+	parsers := make([]*logParser, 0)
+	rows, err := db.Query(`SELECT stage, name, pattern, mode FROM parsers WHERE project = ? ORDER BY stage, name`, pid)
+	if err != nil {
+		logger.Error(err)
+		return parsers
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stage string
+		var name string
+		var pattern string
+		var mode string
+		rows.Scan(&stage, &name, &pattern, &mode)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logger.Warn(err)
+			continue
+		}
+		parsers = append(parsers, &logParser{stage, name, re, mode})
+	}
+	return parsers
+}
+
+func logParse(p *project, t *task) {
+	parsers := make([]*logParser, 0)
+	for _, parser := range projectParsers(p.id) {
+		if stageStates[parser.stage].String() == t.kind {
+			parsers = append(parsers, parser)
+		}
+	}
+	if len(parsers) == 0 {
+		return
+	}
+	file, err := os.Open(taskLogKey(t.id))
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	defer file.Close()
+	counts := make(map[string]int)
+	sums := make(map[string]float64)
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, parser := range parsers {
+			match := parser.pattern.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			counts[parser.name] += 1
+			value := match[0]
+			if len(match) > 1 {
+				value = match[1]
+			}
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				sums[parser.name] += f
+			}
+			if parser.mode != "first" || counts[parser.name] == 1 {
+				values[parser.name] = value
+			}
+		}
+	}
+	for _, parser := range parsers {
+		value, ok := values[parser.name]
+		switch parser.mode {
+		case "count":
+			value, ok = strconv.Itoa(counts[parser.name]), true
+		case "sum":
+			value, ok = strconv.FormatFloat(sums[parser.name], 'f', -1, 64), true
+		}
+		if ok {
+			p.setMetadata(t, parser.name, value)
+			db.Exec(`REPLACE INTO metadata(task, project, name, value) VALUES(?, ?, ?, ?)`, t.id, p.id, parser.name, value)
+		}
+	}
+}
+
+func handleProjectParsers(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	result := make([]interface{}, 0)
+	for _, parser := range projectParsers(id) {
+		result = append(result, map[string]interface{}{
+			"stage":   parser.stage,
+			"name":    parser.name,
+			"pattern": parser.pattern.String(),
+			"mode":    parser.mode,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectParsersSet(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/parsers/set", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	stage := params["stage"]
+	name := params["name"]
+	mode := params["mode"]
+	if mode == "" {
+		mode = "last"
+	}
+	_, err := regexp.Compile(params["pattern"])
+	if p == nil {
+		writeError(w, notFound("Project"))
+	} else if _, ok := stageStates[stage]; !ok {
+		writeError(w, invalidParam("stage", "Unknown stage %s", stage))
+	} else if !variableName.MatchString(name) {
+		writeError(w, invalidParam("name", "Invalid parser name %s", name))
+	} else if mode != "first" && mode != "last" && mode != "count" && mode != "sum" {
+		writeError(w, invalidParam("mode", "mode must be first, last, count or sum"))
+	} else if err != nil {
+		writeError(w, invalidParam("pattern", "%v", err))
+	} else {
+		db.Exec(`REPLACE INTO parsers(project, stage, name, pattern, mode) VALUES(?, ?, ?, ?, ?)`, p.id, stage, name, params["pattern"], mode)
+		projectRevise(p, u.Name)
+		redirect := params["redirect"]
+		if len(redirect) > 0 {
+			w.Header().Add("Location", redirect)
+			w.WriteHeader(303)
+		} else {
+			w.WriteHeader(200)
+			w.Write([]byte("OK"))
+		}
+	}
+}
+
+func handleProjectParsersDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/parsers/delete", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	db.Exec(`DELETE FROM parsers WHERE project = ? AND stage = ? AND name = ?`, p.id, params["stage"], params["name"])
+	projectRevise(p, u.Name)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func taskMetadata(pid int) map[int]map[string]string {
+	result := make(map[int]map[string]string)
+	rows, err := db.Query(`SELECT task, name, value FROM metadata WHERE project = ?`, pid)
+	if err != nil {
+		logger.Error(err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tid int
+		var name string
+		var value string
+		rows.Scan(&tid, &name, &value)
+		if result[tid] == nil {
+			result[tid] = make(map[string]string)
+		}
+		result[tid][name] = value
+	}
+	return result
+}
+
+func parserConfig(pid int, config map[string]string) {
+	for _, parser := range projectParsers(pid) {
+		config[fmt.Sprintf("parser:%s:%s", parser.stage, parser.name)] = parser.mode + " " + parser.pattern.String()
+	}
+}
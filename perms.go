@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	osuser "os/user"
+	"strconv"
+)
+
+var dirMode os.FileMode = 0755
+var fileMode os.FileMode = 0644
+var ownerGroup = -1
+
+func parseMode(value string, mode *os.FileMode) {
+	if len(value) == 0 {
+		return
+	}
+	m, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		logger.Fatalf("Invalid mode %s: %v", value, err)
+	}
+	*mode = os.FileMode(m) & os.ModePerm
+}
+
+func parseGroup(name string) {
+	if len(name) == 0 {
+		return
+	}
+	g, err := osuser.LookupGroup(name)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	ownerGroup, _ = strconv.Atoi(g.Gid)
+}
+
+func applyMode(path string, mode os.FileMode) {
+	err := os.Chmod(path, mode)
+	if err != nil {
+		logger.Warn(err)
+	}
+	if ownerGroup >= 0 {
+		err = os.Chown(path, -1, ownerGroup)
+		if err != nil {
+			logger.Warn(err)
+		}
+	}
+}
+
+func makeDir(path string) {
+	err := os.MkdirAll(path, dirMode)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	applyMode(path, dirMode)
+}
+
+func createFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileMode)
+	if err != nil {
+		return nil, err
+	}
+	applyMode(path, fileMode)
+	return file, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// pipelineProjects returns the project mappings of a pipeline file, which is either one project or a projects list.
+func pipelineProjects(root *yamlNode) []*yamlNode {
+	if list := root.fields["projects"]; root.fields != nil && list != nil {
+		return list.items
+	}
+	return []*yamlNode{root}
+}
+
+func pipelineScalar(n *yamlNode, key string, fallback string) string {
+	if n.fields != nil && n.fields[key] != nil && n.fields[key].scalar != nil {
+		return *n.fields[key].scalar
+	}
+	return fallback
+}
+
+// pipelineRef finds a project a pipeline file refers to, which may be one the file itself creates.
+func pipelineRef(ref string, named map[string]*project) *project {
+	if p := named[ref]; p != nil {
+		return p
+	}
+	return lintProjectRef(ref)
+}
+
+// pipelineApply creates or updates the projects of a pipeline file that has passed lintPipeline. Projects are matched by
+// name, and settings the file leaves out keep their values. Triggers and afters are set once every project exists, so
+// projects in the file can refer to each other.
+func pipelineApply(root *yamlNode, author string) ([]map[string]interface{}, error) {
+	docs := pipelineProjects(root)
+	names := make(map[string]bool)
+	for _, n := range docs {
+		names[pipelineScalar(n, "name", "")] = true
+	}
+	for _, n := range docs {
+		refs := make([]string, 0)
+		if triggers := n.fields["triggers"]; triggers != nil {
+			for _, item := range triggers.items {
+				refs = append(refs, pipelineScalar(item, "project", ""))
+			}
+		}
+		if after := n.fields["after"]; after != nil {
+			list, _ := after.strings()
+			refs = append(refs, list...)
+		}
+		for _, ref := range refs {
+			if !names[ref] && lintProjectRef(ref) == nil {
+				return nil, notFound("Project " + ref)
+			}
+		}
+	}
+	result := make([]map[string]interface{}, 0)
+	named := make(map[string]*project)
+	for _, n := range docs {
+		settings := make(map[string]string)
+		for _, key := range n.keys {
+			switch pipelineFields[key] {
+			case "string":
+				settings[key] = *n.fields[key].scalar
+			case "list":
+				values, _ := n.fields[key].strings()
+				settings[key] = strings.Join(values, ",")
+			}
+		}
+		p := lintProjectRef(settings["name"])
+		created := p == nil
+		if created {
+			p = projectCreate(settings["name"], settings["url"], settings["branch"], settings["destination"], settings["tag"], author)
+		}
+		params := projectSettings(p)
+		for key, value := range settings {
+			params[key] = value
+		}
+		p.lock.Lock()
+		p.applySettings(params)
+		p.lock.Unlock()
+		if specs := n.fields["specs"]; specs != nil {
+			for _, key := range specs.keys {
+				name, path := projectFile(p, key)
+				if uploadSlotFor(p, name) != specSlot {
+					logger.Warnf("Project %d pipeline spec %s isn't one of its specs", p.id, name)
+					continue
+				}
+				lock := specLock(p.id)
+				lock.Lock()
+				err := specWrite(path, *specs.fields[key].scalar)
+				lock.Unlock()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if variables := n.fields["variables"]; variables != nil {
+			for _, name := range variables.keys {
+				v := variables.fields[name]
+				value := pipelineScalar(variables, name, "")
+				if v.fields != nil {
+					value = pipelineScalar(v, "value", "")
+				}
+				secret, _ := strconv.ParseBool(pipelineScalar(v, "secret", "false"))
+				variable := &variable{name, value, pipelineScalar(v, "kind", "env"), secret}
+				p.setVariable(variable)
+				db.Exec(`REPLACE INTO variables(project, name, value, kind, secret) VALUES(?, ?, ?, ?, ?)`,
+					p.id, variable.name, variable.value, variable.kind, variable.secret)
+			}
+		}
+		if parsers := n.fields["parsers"]; parsers != nil {
+			for _, item := range parsers.items {
+				db.Exec(`REPLACE INTO parsers(project, stage, name, pattern, mode) VALUES(?, ?, ?, ?, ?)`, p.id,
+					pipelineScalar(item, "stage", ""), pipelineScalar(item, "name", ""), pipelineScalar(item, "pattern", ""),
+					pipelineScalar(item, "mode", "last"))
+			}
+		}
+		named[p.currentName()] = p
+		result = append(result, map[string]interface{}{
+			"id":      p.id,
+			"name":    p.currentName(),
+			"created": created,
+		})
+	}
+	for _, n := range docs {
+		p := named[pipelineScalar(n, "name", "")]
+		if triggers := n.fields["triggers"]; triggers != nil {
+			targets := make(map[*project]state)
+			for _, item := range triggers.items {
+				targets[pipelineRef(pipelineScalar(item, "project", ""), named)] = stageStates[pipelineScalar(item, "stage", "")]
+			}
+			if cycle := projectSetTriggers(p, targets); cycle != nil {
+				return nil, cycleError(cycle)
+			}
+		}
+		if after := n.fields["after"]; after != nil {
+			list, _ := after.strings()
+			upstreams := make(map[*project]bool)
+			for _, ref := range list {
+				upstreams[pipelineRef(ref, named)] = true
+			}
+			if cycle := projectSetAfter(p, upstreams); cycle != nil {
+				return nil, cycleError(cycle)
+			}
+		}
+	}
+	for _, p := range named {
+		projectRevise(p, author)
+	}
+	return result, nil
+}
+
+func handlePipelineApply(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/api/v1/pipeline/apply", params) {
+		return
+	}
+	content, ok := params["pipeline"]
+	if !ok {
+		body, _ := ioutil.ReadAll(r.Body)
+		content = string(body)
+	}
+	if l := lintPipeline(content); len(l.errors) > 0 {
+		writeLint(w, l)
+		return
+	}
+	root, _ := parseYAML(content)
+	applied, err := pipelineApply(root, u.Name)
+	if err != nil {
+		logger.Warnf("Pipeline applied by %s stopped: %v", u.Name, err)
+		writeError(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"projects": applied,
+	})
+	w.Write(j)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// remoteHead asks the project's source for its head, using a copy of the settings sources read so that they can be
+// changed meanwhile.
+func remoteHead(p *project) (string, error) {
+	p.lock.RLock()
+	source := &project{id: p.id, url: p.url, branch: p.branch, sourceKind: p.sourceKind}
+	p.lock.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	return sourceFor(source).Head(ctx, source)
+}
+
+// pollDue says whether it's time to poll the project, marking it polled if so.
+func pollDue(p *project) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.poll <= 0 || time.Since(p.polled) < time.Duration(p.poll)*time.Second {
+		return false
+	}
+	p.polled = time.Now()
+	return true
+}
+
+func pollRoutine() {
+	for {
+		time.Sleep(10 * time.Second)
+		if inMaintenance() {
+			continue
+		}
+		for _, p := range projectAll() {
+			if !pollDue(p) {
+				continue
+			}
+			head, err := remoteHead(p)
+			if err != nil {
+				logger.Warnf("Project %d poll failed: %v", p.id, err)
+				continue
+			}
+			p.lock.Lock()
+			previous := p.head
+			if len(head) > 0 {
+				p.head = head
+			}
+			p.lock.Unlock()
+			if len(head) == 0 || head == previous {
+				continue
+			}
+			logger.Infof("Project %d head changed %s -> %s", p.id, previous, head)
+			db.Exec(`UPDATE projects SET head = ? WHERE id = ?`, head, p.id)
+			if len(previous) > 0 {
+				build, _ := runCreate(p, "poll", "poll")
+				p.enqueue(taskRequest{PULLING, "", "", 0, build, NONE, "", ""})
+				variantsQueue(p, "poll", "", "")
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// previewRef is true for the refs of GitHub pull requests and GitLab merge requests.
+func previewRef(ref string) bool {
+	return strings.HasPrefix(ref, "refs/pull/") || strings.HasPrefix(ref, "refs/merge-requests/")
+}
+
+func previewDir(p *project, build int) string {
+	return fmt.Sprintf("%s/%d/previews/%d", projectAbs, p.id, build)
+}
+
+// workspaceDir is the workspace for a request. Previews each get their own, so that they can't change the project's
+// source or each other's while they wait in the queue, and so do variants.
+func workspaceDir(p *project, request taskRequest) string {
+	if previewRef(request.ref) {
+		return previewDir(p, request.build)
+	}
+	if len(request.variant) > 0 {
+		return variantDir(p, request.variant)
+	}
+	return fmt.Sprintf("%s/%d/workspace", projectAbs, p.id)
+}
+
+func previewCheckout(out io.Writer, p *project, workspace, ref string) error {
+	if err := cleanPath(out, workspace, fmt.Sprintf("%s/%d", projectAbs, p.id)); err != nil {
+		return err
+	}
+	source := workspace + "/source"
+	cmd := exec.Command("git", "clone", "-q", "--no-checkout", "--reference-if-able", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), p.url, source)
+	fmt.Fprintf(out, "\u001B[1m%s\u001B[0m\n", cmd.String())
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return checkoutRef(out, source, ref)
+}
+
+// previewFinish removes the workspace of a preview build.
+func previewFinish(p *project, build int) {
+	var number int
+	err := db.QueryRow(`SELECT number FROM previews WHERE build = ?`, build).Scan(&number)
+	if err != nil {
+		return
+	}
+	if err := cleanPath(ioutil.Discard, previewDir(p, build), fmt.Sprintf("%s/%d", projectAbs, p.id)); err != nil {
+		logger.Warn(err)
+	}
+}
+
+// webhookPreview queues a build and test of a GitHub pull request or GitLab merge request into the project's branch.
+func webhookPreview(w http.ResponseWriter, p *project, event string, payload map[string]interface{}) {
+	var host, action, base, sha, ref string
+	var number int
+	if event == "pull_request" {
+		pull, _ := payload["pull_request"].(map[string]interface{})
+		head, _ := pull["head"].(map[string]interface{})
+		target, _ := pull["base"].(map[string]interface{})
+		number, _ = strconv.Atoi(bundleText(payload["number"]))
+		host, action, base, sha = "github", bundleText(payload["action"]), bundleText(target["ref"]), bundleText(head["sha"])
+		ref = fmt.Sprintf("refs/pull/%d/head", number)
+		if action != "opened" && action != "reopened" && action != "synchronize" {
+			action = ""
+		}
+	} else {
+		attributes, _ := payload["object_attributes"].(map[string]interface{})
+		commit, _ := attributes["last_commit"].(map[string]interface{})
+		number, _ = strconv.Atoi(bundleText(attributes["iid"]))
+		host, action, base, sha = "gitlab", bundleText(attributes["action"]), bundleText(attributes["target_branch"]), bundleText(commit["id"])
+		ref = fmt.Sprintf("refs/merge-requests/%d/head", number)
+		// Updates without an oldrev change the merge request but not its commits.
+		if action != "open" && action != "reopen" && (action != "update" || len(bundleText(attributes["oldrev"])) == 0) {
+			action = ""
+		}
+	}
+	if len(action) == 0 || number == 0 {
+		webhookReply(w, p, 202, fmt.Sprintf("Ignored %s event", event))
+		return
+	}
+	if base != p.branch {
+		webhookReply(w, p, 202, fmt.Sprintf("Ignored %s into %s", ref, base))
+		return
+	}
+	build, err := runCreate(p, "preview", "webhook")
+	if err != nil {
+		logger.Error(err)
+		webhookReply(w, p, 500, "Failed to create build")
+		return
+	}
+	db.Exec(`INSERT INTO previews(build, project, host, number, sha) VALUES(?, ?, ?, ?, ?)`, build, p.id, host, number, sha)
+	db.Exec(`UPDATE builds SET sha = ? WHERE id = ?`, sha, build)
+	last := BUILDING
+	if len(p.specFiles()[2]) > 0 {
+		last = TESTING
+	}
+	p.enqueue(taskRequest{PULLING, fmt.Sprintf("pr-%d", number), "", 0, build, last, ref, ""})
+	webhookRecord(p, event, ref, sha, "queued", fmt.Sprintf("Preview build %d", build))
+	go buildStatus(p, build, "pending")
+	webhookReply(w, p, 200, fmt.Sprintf("Building preview of %s", ref))
+}
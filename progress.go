@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type stageProgress struct {
+	state   state
+	started time.Time
+	average time.Duration
+	percent int
+	emitted time.Time
+}
+
+var progressLock sync.Mutex
+var progresses = make(map[int]*stageProgress)
+
+var podmanStep = regexp.MustCompile(`STEP ([0-9]+)/([0-9]+)`)
+var gitProgress = regexp.MustCompile(`(Receiving objects|Resolving deltas):\s+([0-9]+)%`)
+
+type progressWriter struct {
+	out     io.Writer
+	project *project
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	percent := -1
+	if match := podmanStep.FindAllSubmatch(b, -1); match != nil {
+		last := match[len(match)-1]
+		step, _ := strconv.Atoi(string(last[1]))
+		total, _ := strconv.Atoi(string(last[2]))
+		if total > 0 {
+			percent = (step - 1) * 100 / total
+		}
+	} else if match := gitProgress.FindAllSubmatch(b, -1); match != nil {
+		last := match[len(match)-1]
+		percent, _ = strconv.Atoi(string(last[2]))
+		// Receiving objects takes most of a clone, so resolving deltas is the last 10%.
+		if string(last[1]) == "Receiving objects" {
+			percent = percent * 9 / 10
+		} else {
+			percent = 90 + percent/10
+		}
+	}
+	if percent >= 0 {
+		progressUpdate(w.project, percent)
+	}
+	return w.out.Write(b)
+}
+
+func progressStart(p *project, state state) {
+	var average float64
+	db.QueryRow(`SELECT IFNULL(AVG(duration), 0) FROM (SELECT duration FROM tasks
+		WHERE project = ? AND type = ? AND state = 'SUCCESS' AND duration IS NOT NULL ORDER BY id DESC LIMIT 5) recent`,
+		p.id, state.String()).Scan(&average)
+	progressLock.Lock()
+	progresses[p.id] = &stageProgress{state, time.Now(), time.Duration(average * float64(time.Second)), -1, time.Time{}}
+	progressLock.Unlock()
+	projectEvent(map[string]interface{}{
+		"event":    "project/progress",
+		"id":       p.id,
+		"progress": progressStatus(p),
+	})
+}
+
+func progressUpdate(p *project, percent int) {
+	progressLock.Lock()
+	progress := progresses[p.id]
+	emit := false
+	if progress != nil && percent != progress.percent {
+		progress.percent = percent
+		if time.Since(progress.emitted) > 2*time.Second {
+			progress.emitted = time.Now()
+			emit = true
+		}
+	}
+	progressLock.Unlock()
+	if emit {
+		projectEvent(map[string]interface{}{
+			"event":    "project/progress",
+			"id":       p.id,
+			"progress": progressStatus(p),
+		})
+	}
+}
+
+// progressFinish stops reporting the project's progress and returns how long its stage took.
+func progressFinish(p *project) time.Duration {
+	progressLock.Lock()
+	progress := progresses[p.id]
+	delete(progresses, p.id)
+	progressLock.Unlock()
+	if progress == nil {
+		return 0
+	}
+	return time.Since(progress.started)
+}
+
+func progressStatus(p *project) map[string]interface{} {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	progress := progresses[p.id]
+	if progress == nil {
+		return nil
+	}
+	elapsed := time.Since(progress.started)
+	percent := progress.percent
+	remaining := time.Duration(-1)
+	if percent > 0 {
+		remaining = elapsed * time.Duration(100-percent) / time.Duration(percent)
+	} else if progress.average > 0 {
+		percent = int(elapsed * 100 / progress.average)
+		if percent > 99 {
+			percent = 99
+		}
+		remaining = progress.average - elapsed
+		if remaining < 0 {
+			remaining = 0
+		}
+	}
+	status := map[string]interface{}{
+		"stage":   progress.state.String(),
+		"elapsed": int(elapsed.Seconds()),
+	}
+	if percent >= 0 {
+		status["percent"] = percent
+	}
+	if remaining >= 0 {
+		status["remaining"] = int(remaining.Seconds())
+	}
+	return status
+}
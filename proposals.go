@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var updateInterval int
+var updateTrial bool
+
+// trialLocks lets each project run one trial at a time, so that trials queue rather than pile up.
+var trialLocks = make(map[int]*sync.Mutex)
+var trialLocksLock sync.Mutex
+
+func trialLock(pid int) *sync.Mutex {
+	trialLocksLock.Lock()
+	defer trialLocksLock.Unlock()
+	if trialLocks[pid] == nil {
+		trialLocks[pid] = &sync.Mutex{}
+	}
+	return trialLocks[pid]
+}
+
+var specFrom = regexp.MustCompile(`^(\s*FROM\s+(?:--\S+\s+)*)([^\s:@$]+(?:/[^\s:@$]+)*):([^\s@$]+)(.*)$`)
+var specArg = regexp.MustCompile(`^(\s*ARG\s+)([A-Za-z0-9_]+)=([^\s$]+)(.*)$`)
+var updateSource = regexp.MustCompile(`^\s*#\s*racs-update:\s*github=([A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+)\s*$`)
+var versionTag = regexp.MustCompile(`^([^0-9]*)([0-9]+(?:\.[0-9]+)*)(.*)$`)
+
+func dependencyUpdate(spec string, line int, kind, name, old, new string) map[string]interface{} {
+	return map[string]interface{}{
+		"spec": spec,
+		"line": line,
+		"kind": kind,
+		"name": name,
+		"old":  old,
+		"new":  new,
+	}
+}
+
+type release struct {
+	prefix  string
+	numbers []int
+	suffix  string
+}
+
+func parseRelease(tag string) *release {
+	match := versionTag.FindStringSubmatch(tag)
+	if match == nil {
+		return nil
+	}
+	v := &release{match[1], nil, match[3]}
+	for _, part := range strings.Split(match[2], ".") {
+		n, _ := strconv.Atoi(part)
+		v.numbers = append(v.numbers, n)
+	}
+	return v
+}
+
+// newer reports whether v is a later release in the same series as current, e.g. 1.22-alpine after 1.21-alpine.
+func (v *release) newer(current *release) bool {
+	if v.prefix != current.prefix || v.suffix != current.suffix || len(v.numbers) != len(current.numbers) {
+		return false
+	}
+	for i := range v.numbers {
+		if v.numbers[i] != current.numbers[i] {
+			return v.numbers[i] > current.numbers[i]
+		}
+	}
+	return false
+}
+
+func latestTag(current string, tags []string) string {
+	latest := parseRelease(current)
+	if latest == nil {
+		return ""
+	}
+	result := ""
+	for _, tag := range tags {
+		if v := parseRelease(tag); v != nil && v.newer(latest) {
+			latest = v
+			result = tag
+		}
+	}
+	return result
+}
+
+func imageTags(image string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "podman", "search", "--list-tags", "--limit", "10000", "--format", "{{.Tag}}", image).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(output)), nil
+}
+
+func githubTags(repository string) ([]string, error) {
+	content, err := fetchRelease(fmt.Sprintf("https://api.github.com/repos/%s/tags?per_page=100", repository))
+	if err != nil {
+		return nil, err
+	}
+	var tags []map[string]interface{}
+	if err := json.Unmarshal(content, &tags); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, tag := range tags {
+		if name, ok := tag["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func projectSpecs(p *project) map[string]string {
+	specs := make(map[string]string)
+	for _, spec := range append(p.specFiles(), variantSpecs(p.id)...) {
+		// Specs in the workspace belong to the repository, so updates to them cannot be proposed here.
+		if len(spec) == 0 || strings.HasPrefix(strings.TrimPrefix(spec, "/"), "workspace/") {
+			continue
+		}
+		content, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/%s", projectAbs, p.id, spec))
+		if err == nil {
+			specs[spec] = string(content)
+		}
+	}
+	return specs
+}
+
+func specUpdates(spec, content string) (string, []map[string]interface{}) {
+	updates := make([]map[string]interface{}, 0)
+	lines := strings.Split(content, "\n")
+	source := ""
+	for i, line := range lines {
+		if match := updateSource.FindStringSubmatch(line); match != nil {
+			source = match[1]
+			continue
+		}
+		if match := specFrom.FindStringSubmatch(line); match != nil {
+			tags, err := imageTags(match[2])
+			if err != nil {
+				logger.Warnf("Tags of %s: %v", match[2], err)
+			} else if tag := latestTag(match[3], tags); len(tag) > 0 {
+				lines[i] = match[1] + match[2] + ":" + tag + match[4]
+				updates = append(updates, dependencyUpdate(spec, i+1, "image", match[2], match[3], tag))
+			}
+		} else if match := specArg.FindStringSubmatch(line); match != nil && len(source) > 0 {
+			tags, err := githubTags(source)
+			if err != nil {
+				logger.Warnf("Tags of %s: %v", source, err)
+			} else if tag := latestTag(match[3], tags); len(tag) > 0 {
+				lines[i] = match[1] + match[2] + "=" + tag + match[4]
+				updates = append(updates, dependencyUpdate(spec, i+1, "tool", match[2], match[3], tag))
+			}
+		}
+		source = ""
+	}
+	return strings.Join(lines, "\n"), updates
+}
+
+func proposeUpdates(p *project) (int, error) {
+	base := projectSpecs(p)
+	proposed := make(map[string]string)
+	updates := make([]map[string]interface{}, 0)
+	for spec, content := range base {
+		updated, changes := specUpdates(spec, content)
+		proposed[spec] = updated
+		updates = append(updates, changes...)
+	}
+	if len(updates) == 0 {
+		return 0, nil
+	}
+	j, _ := json.Marshal(proposed)
+	var id int
+	db.QueryRow(`SELECT id FROM proposals WHERE project = ? AND state = 'OPEN' AND specs = ?`, p.id, string(j)).Scan(&id)
+	if id != 0 {
+		return id, nil
+	}
+	db.Exec(`UPDATE proposals SET state = 'SUPERSEDED' WHERE project = ? AND state = 'OPEN'`, p.id)
+	baseJSON, _ := json.Marshal(base)
+	updatesJSON, _ := json.Marshal(updates)
+	err := db.QueryRow(`INSERT INTO proposals(project, time, state, base, specs, updates, trial)
+		VALUES(?, datetime('now'), 'OPEN', ?, ?, ?, '') RETURNING id`, p.id, string(baseJSON), string(j), string(updatesJSON)).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	logger.Infof("Project %d proposal %d updates %d dependencies", p.id, id, len(updates))
+	projectEvent(map[string]interface{}{
+		"event":    "project/proposal",
+		"id":       p.id,
+		"proposal": id,
+		"state":    "OPEN",
+	})
+	if updateTrial && !inMaintenance() {
+		go proposalTrial(p, id)
+	}
+	return id, nil
+}
+
+func proposalTrial(p *project, id int) {
+	var j string
+	if db.QueryRow(`SELECT specs FROM proposals WHERE id = ? AND project = ?`, id, p.id).Scan(&j) != nil {
+		return
+	}
+	specs := make(map[string]string)
+	json.Unmarshal([]byte(j), &specs)
+	db.Exec(`UPDATE proposals SET trial = 'QUEUED' WHERE id = ?`, id)
+	lock := trialLock(p.id)
+	lock.Lock()
+	defer lock.Unlock()
+	db.Exec(`UPDATE proposals SET trial = 'RUNNING', log = '' WHERE id = ?`, id)
+	projectEvent(map[string]interface{}{
+		"event":    "project/proposal",
+		"id":       p.id,
+		"proposal": id,
+		"trial":    "RUNNING",
+	})
+	buildSpec := p.specFiles()[0]
+	result := "SUCCESS"
+	var log strings.Builder
+	// Trials are held to the same disk space, quota and resource limits as the project's own builds.
+	if err := diskCheck(BUILDING); err != nil {
+		fmt.Fprintf(&log, "%v\n", err)
+		result = "ERROR"
+	} else if err := quotaCheck(p, BUILDING); err != nil {
+		fmt.Fprintf(&log, "%v\n", err)
+		result = "ERROR"
+	}
+	for spec, content := range specs {
+		if result != "SUCCESS" {
+			break
+		}
+		temp, err := ioutil.TempFile("uploads", "trial-")
+		if err != nil {
+			logger.Error(err)
+			result = "ERROR"
+			break
+		}
+		temp.WriteString(content)
+		temp.Close()
+		tag := fmt.Sprintf("trial-%d", id)
+		args := append([]string{"build", "-f", temp.Name(), "-t", tag}, imageLabels(p)...)
+		if spec != buildSpec {
+			// Test and package specs expect the workspace, which the trial must not change.
+			args = append(args, "-v", fmt.Sprintf("%s/%d/workspace:/workspace:ro", projectAbs, p.id))
+		}
+		env := []string{}
+		p.lock.RLock()
+		args = append(args, p.limitArgs(false)...)
+		args, env = p.variableArgs("arg", "--build-arg", args, env, true)
+		p.lock.RUnlock()
+		args = append(args, fmt.Sprintf("%s/%d/context", projectAbs, p.id))
+		fmt.Fprintf(&log, "$ podman build %s\n", spec)
+		cmd := exec.Command("podman", args...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout = &log
+		cmd.Stderr = &log
+		err = cmd.Run()
+		os.Remove(temp.Name())
+		exec.Command("podman", "rmi", "-f", tag).Run()
+		if err != nil {
+			fmt.Fprintf(&log, "%v\n", err)
+			result = "ERROR"
+			break
+		}
+	}
+	logger.Infof("Project %d proposal %d trial %s", p.id, id, result)
+	db.Exec(`UPDATE proposals SET trial = ?, log = ? WHERE id = ?`, result, log.String(), id)
+	projectEvent(map[string]interface{}{
+		"event":    "project/proposal",
+		"id":       p.id,
+		"proposal": id,
+		"trial":    result,
+	})
+}
+
+func proposalRoutine() {
+	if updateInterval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Duration(updateInterval) * time.Hour)
+		for _, p := range projectAll() {
+			if _, err := proposeUpdates(p); err != nil {
+				logger.Warnf("Project %d dependency check failed: %v", p.id, err)
+			}
+		}
+	}
+}
+
+func handleProjectProposals(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	rows, err := db.Query(`SELECT id, time, state, base, specs, updates, IFNULL(trial, '') FROM proposals WHERE project = ? ORDER BY id DESC`, p.id)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var proposal int
+		var time string
+		var state string
+		var baseJSON string
+		var specsJSON string
+		var updatesJSON string
+		var trial string
+		rows.Scan(&proposal, &time, &state, &baseJSON, &specsJSON, &updatesJSON, &trial)
+		base := map[string]string{}
+		json.Unmarshal([]byte(baseJSON), &base)
+		specs := map[string]string{}
+		json.Unmarshal([]byte(specsJSON), &specs)
+		old := map[string]string{}
+		new := map[string]string{}
+		for spec, content := range base {
+			old["spec:"+spec] = content
+		}
+		for spec, content := range specs {
+			new["spec:"+spec] = content
+		}
+		var updates []interface{}
+		json.Unmarshal([]byte(updatesJSON), &updates)
+		result = append(result, map[string]interface{}{
+			"proposal": proposal,
+			"time":     time,
+			"state":    state,
+			"trial":    trial,
+			"updates":  updates,
+			"changes":  configDiff(old, new),
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectProposalsCheck(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/proposals/check", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	proposal, err := proposeUpdates(p)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write([]byte(strconv.Itoa(proposal)))
+}
+
+func handleProjectProposalsTrial(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/proposals/trial", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	proposal, _ := strconv.Atoi(params["proposal"])
+	p := projectGet(id)
+	var state string
+	if p == nil || db.QueryRow(`SELECT state FROM proposals WHERE id = ? AND project = ?`, proposal, id).Scan(&state) != nil {
+		writeError(w, notFound("Proposal"))
+		return
+	}
+	go proposalTrial(p, proposal)
+	w.WriteHeader(200)
+	w.Write([]byte("OK"))
+}
+
+func handleProjectProposalsLog(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	proposal, _ := strconv.Atoi(params["proposal"])
+	var log string
+	if db.QueryRow(`SELECT IFNULL(log, '') FROM proposals WHERE id = ? AND project = ?`, proposal, id).Scan(&log) != nil {
+		writeError(w, notFound("Proposal"))
+		return
+	}
+	w.Header().Add("Content-Type", "text/plain")
+	w.Write([]byte(log))
+}
+
+func handleProjectProposalsAccept(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/proposals/accept", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	proposal, _ := strconv.Atoi(params["proposal"])
+	p := projectGet(id)
+	var baseJSON string
+	var specsJSON string
+	if p == nil || db.QueryRow(`SELECT base, specs FROM proposals WHERE id = ? AND project = ? AND state = 'OPEN'`,
+		proposal, id).Scan(&baseJSON, &specsJSON) != nil {
+		writeError(w, notFound("Open proposal"))
+		return
+	}
+	base := map[string]string{}
+	json.Unmarshal([]byte(baseJSON), &base)
+	current := projectSpecs(p)
+	for spec, content := range base {
+		if current[spec] != content {
+			writeError(w, conflict("%s has changed since the proposal was made", spec))
+			return
+		}
+	}
+	specs := map[string]string{}
+	json.Unmarshal([]byte(specsJSON), &specs)
+	for spec, content := range specs {
+		path := fmt.Sprintf("%s/%d/%s", projectAbs, p.id, spec)
+		file, err := createFile(path)
+		if err != nil {
+			logger.Error(err)
+			writeError(w, err)
+			return
+		}
+		file.WriteString(content)
+		file.Close()
+	}
+	db.Exec(`UPDATE proposals SET state = 'ACCEPTED' WHERE id = ?`, proposal)
+	projectRevise(p, u.Name)
+	projectEvent(map[string]interface{}{
+		"event":    "project/proposal",
+		"id":       p.id,
+		"proposal": proposal,
+		"state":    "ACCEPTED",
+	})
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleProjectProposalsReject(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/proposals/reject", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	proposal, _ := strconv.Atoi(params["proposal"])
+	db.Exec(`UPDATE proposals SET state = 'REJECTED' WHERE id = ? AND project = ? AND state = 'OPEN'`, proposal, id)
+	projectEvent(map[string]interface{}{
+		"event":    "project/proposal",
+		"id":       id,
+		"proposal": proposal,
+		"state":    "REJECTED",
+	})
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func ptyOpen() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("terminals are only supported on Linux")
+}
+
+func ptyResize(master *os.File, cols, rows int) error {
+	return nil
+}
+
+func ptyAttributes() *syscall.SysProcAttr {
+	return nil
+}
@@ -6,8 +6,6 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -23,10 +21,10 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/msteinert/pam"
 	"github.com/withmandala/go-log"
 )
@@ -64,10 +62,25 @@ const (
 	PUSHING         state = 22
 	PUSH_ERROR      state = 23
 	PUSH_SUCCESS    state = 24
+
+	PENDING_APPROVAL  state = 25
+	APPROVAL_REJECTED state = 26
+	APPROVAL_GRANTED  state = 27
+
+	TESTING      state = 28
+	TEST_ERROR   state = 29
+	TEST_SUCCESS state = 30
+
+	SCANNING     state = 31
+	SCAN_ERROR   state = 32
+	SCAN_SUCCESS state = 33
+
+	// DISK_FULL is the state of a project whose stage didn't start for lack of disk space.
+	DISK_FULL state = 34
 )
 
 func (s state) String() string {
-	return [28]string{
+	return [38]string{
 		"DELETING", "DELETE_ERROR", "DELETE_SUCCESS",
 		"NONE",
 		"CREATING", "CREATE_ERROR", "CREATE_SUCCESS",
@@ -78,14 +91,32 @@ func (s state) String() string {
 		"BUILDING", "BUILD_ERROR", "BUILD_SUCCESS",
 		"PACKAGING", "PACKAGE_ERROR", "PACKAGE_SUCCESS",
 		"PUSHING", "PUSH_ERROR", "PUSH_SUCCESS",
+		"PENDING_APPROVAL", "APPROVAL_REJECTED", "APPROVAL_GRANTED",
+		"TESTING", "TEST_ERROR", "TEST_SUCCESS",
+		"SCANNING", "SCAN_ERROR", "SCAN_SUCCESS",
+		"DISK_FULL",
 	}[s+3]
 }
 
+func (s state) running() bool {
+	return s == DELETING || (s > NONE && s != PENDING_APPROVAL && s != DISK_FULL && s%3 == 1)
+}
+
+func (s state) failed() bool {
+	return s == DELETE_ERROR || s == DISK_FULL || (s > NONE && s%3 == 2)
+}
+
 type task struct {
-	id    int
-	kind  string
-	state string
-	time  string
+	id       int
+	kind     string
+	state    string
+	time     string
+	revision int
+	metadata map[string]string
+	attempt  int
+	finished string
+	duration float64
+	exitCode int
 }
 
 type registry struct {
@@ -94,11 +125,18 @@ type registry struct {
 	user     string
 	password string
 	login    time.Time
+	provider string
 }
 
 type taskRequest struct {
 	state   state
 	trigger string
+	labels  string
+	attempt int
+	build   int
+	until   state
+	ref     string
+	variant string
 }
 
 type project struct {
@@ -111,6 +149,7 @@ type project struct {
 	tag         string
 	buildSpec   string
 	packageSpec string
+	caches      string
 	buildHash   []byte
 	state       state
 	version     int
@@ -119,6 +158,27 @@ type project struct {
 	triggers    map[*project]state
 	prepareDep  *project
 	packageDep  *project
+	variables   map[string]*variable
+	poll        int
+	head        string
+	polled      time.Time
+	hold        bool
+	testSpec    string
+	testReport  string
+	artifacts   string
+	cpus        string
+	memory      string
+	diskQuota   int
+	scanner     string
+	scanFail    string
+	signing     string
+	sbom        string
+	sbomAttach  bool
+	tagPattern  string
+	pathFilter  string
+	snapshot    bool
+	sourceKind  string
+	lock        sync.RWMutex
 }
 
 type broker struct {
@@ -128,10 +188,19 @@ type broker struct {
 	clients    map[chan []byte]bool
 }
 
-var db *sql.DB
+var db *database
 var registries = map[string]*registry{}
 var projects = map[int]*project{}
+
+// projectsLock guards projects and the triggers and afters between them. Each project's lock guards its state, tasks
+// and version, which its projectRoutine changes while handlers read them; the routine is the only writer of those, so
+// it reads them without the lock. Each project's lock also guards its settings and variables, which handlers change
+// while the routine reads them.
+var projectsLock sync.RWMutex
 var projectAbs, _ = filepath.Abs("projects")
+
+const eventBuffer = 256
+
 var clients = &broker{
 	make(chan []byte),
 	make(chan chan []byte),
@@ -139,10 +208,10 @@ var clients = &broker{
 	make(map[chan []byte]bool),
 }
 
-func registryCreate(name, url, user, password string) *registry {
-	db.Exec(`REPLACE INTO registries(name, url, user, password) VALUES(?, ?, ?, ?)`, name, url, user, password)
-	logger.Infof("Registry created %s %s %s ******", name, url, user)
-	r := &registry{name, url, user, password, time.Unix(0, 0)}
+func registryCreate(name, url, user, password, provider string) *registry {
+	db.Exec(`REPLACE INTO registries(name, url, user, password, provider) VALUES(?, ?, ?, ?, ?)`, name, url, user, password, provider)
+	logger.Infof("Registry created %s %s %s ****** %s", name, url, user, provider)
+	r := &registry{name, url, user, password, time.Unix(0, 0), provider}
 	registries[r.name] = r
 	return r
 }
@@ -152,6 +221,13 @@ func registryLogin(name string) string {
 	if r == nil {
 		return ""
 	}
+	if len(r.provider) > 0 {
+		err := providerLogin(r)
+		if err != nil {
+			logger.Error(err)
+		}
+		return r.url
+	}
 	if time.Since(r.login).Hours() > 1 {
 		if len(r.user) > 0 {
 			exec.Command("podman", "login", r.url, "-u", r.user, "-p", r.password).Run()
@@ -162,7 +238,30 @@ func registryLogin(name string) string {
 }
 
 func (p *project) buildFrom(state state, trigger string) {
-	p.queue <- taskRequest{state, trigger}
+	p.enqueue(taskRequest{state, trigger, "", 0, 0, NONE, "", ""})
+}
+
+func (p *project) enqueue(request taskRequest) {
+	p.queue <- request
+	queueEvent(p)
+}
+
+func queueEvent(p *project) {
+	projectEvent(map[string]interface{}{
+		"event":  "project/queue",
+		"id":     p.id,
+		"queued": len(p.queue),
+	})
+}
+
+func (p *project) buildNext(state state, request taskRequest) {
+	if request.until != NONE && request.state == request.until {
+		runFinish(p, request.build, "SUCCESS")
+		return
+	}
+	request.state = state
+	request.attempt = 0
+	p.enqueue(request)
 }
 
 func projectEvent(event map[string]interface{}) {
@@ -174,92 +273,216 @@ func projectRoutine(p *project) {
 	for {
 		logger.Infof("Project %d waiting for tasks", p.id)
 		request := <-p.queue
+		queueEvent(p)
 		state := request.state
 		trigger := request.trigger
 		logger.Infof("Project %d received task %s", p.id, state.String())
 		command := ""
 		args := []string{}
+		env := []string{}
+		var builtin func(out io.Writer) error
+		prepareDep, packageDep := p.dependencies()
+		p.lock.RLock()
 		switch state {
 		case CLEANING:
-			command = "rm"
-			args = []string{"-rfv", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id)}
+			command = "clean"
+			args = []string{fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id)}
+			builtin = func(out io.Writer) error {
+				return cleanPath(out, args[0], fmt.Sprintf("%s/%d", projectAbs, p.id))
+			}
 		case CLONING:
-			command = "git"
-			args = []string{"clone", "-v", "--recursive", "-b", p.branch, p.url, fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id)}
+			command, args, builtin = sourceFor(p).Clone(p, fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id))
 		case PREPARING:
 			command = "podman"
 			spec := fmt.Sprintf("%s/%d/%s", projectAbs, p.id, p.buildSpec)
-			args = []string{"build", "--squash-all", "-f", spec, "-t", fmt.Sprintf("builder-%d", p.id)}
-			if p.prepareDep != nil {
-				args = append(args, "--from", fmt.Sprintf("project-%d", p.prepareDep.id))
+			if v := projectVariant(p.id, request.variant); v != nil {
+				spec = fmt.Sprintf("%s/%d/%s", projectAbs, p.id, v.buildSpec)
+			}
+			args = append([]string{"build", "--squash-all", "-f", spec, "-t", imageName("builder", p, request)}, imageLabels(p)...)
+			args = append(args, p.limitArgs(false)...)
+			args, env = p.variableArgs("arg", "--build-arg", args, env, true)
+			if prepareDep != nil {
+				args = append(args, "--from", fmt.Sprintf("project-%d", prepareDep.id))
 			}
 			args = append(args, fmt.Sprintf("%s/%d/context", projectAbs, p.id))
 		case PULLING:
 			command = "git"
-			args = []string{"-C", fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id), "pull", "--recurse-submodules"}
+			source := fmt.Sprintf("%s/%d/workspace/source", projectAbs, p.id)
+			if previewRef(request.ref) || len(request.variant) > 0 {
+				workspace := workspaceDir(p, request)
+				ref := variantRef(p, request)
+				args = []string{"clone", "--no-checkout", p.url, workspace + "/source"}
+				builtin = func(out io.Writer) error {
+					return previewCheckout(out, p, workspace, ref)
+				}
+			} else if len(request.ref) > 0 {
+				args = []string{"-C", source, "checkout", "--detach", request.ref}
+				builtin = func(out io.Writer) error {
+					return checkoutRef(out, source, request.ref)
+				}
+			} else {
+				command, args, builtin = sourceFor(p).Pull(p, source)
+			}
+			if ref := variantRef(p, request); len(ref) > 0 && sourceFor(p) != (gitSource{}) {
+				builtin = func(out io.Writer) error {
+					return fmt.Errorf("%s needs a git source", ref)
+				}
+			}
 		case BUILDING:
 			command = "podman"
 			args = []string{"run", "--network=host", "--rm=true",
 				"-e", fmt.Sprintf("RACS_TRIGGER=%s", trigger),
-				"-v", fmt.Sprintf("%s/%d/workspace:/workspace", projectAbs, p.id),
-				"--read-only", fmt.Sprintf("builder-%d", p.id),
+				"-v", workspaceDir(p, request) + ":/workspace",
+			}
+			args = append(args, containerLabels(p)...)
+			args = append(args, p.limitArgs(true)...)
+			// Previews build code from anyone who can open a pull request, so they don't get secrets and can't change
+			// the caches that other builds use.
+			preview := previewRef(request.ref)
+			args, env = p.variableArgs("env", "-e", args, env, !preview)
+			for _, cache := range projectCaches(p) {
+				if preview {
+					args = append(args, "-v", fmt.Sprintf("%s:%s:ro", cacheDir(p, cache), cache))
+				} else {
+					args = append(args, "-v", fmt.Sprintf("%s:%s", cacheDir(p, cache), cache))
+				}
 			}
+			args = append(args, "--read-only", imageName("builder", p, request))
+		case TESTING:
+			command = "podman"
+			spec := fmt.Sprintf("%s/%d/%s", projectAbs, p.id, p.testSpec)
+			args = append([]string{"build", "-v", workspaceDir(p, request) + ":/workspace", "-f", spec, "-t", imageName("test", p, request)}, imageLabels(p)...)
+			args = append(args, p.limitArgs(false)...)
+			args, env = p.variableArgs("arg", "--build-arg", args, env, !previewRef(request.ref))
+			args = append(args, fmt.Sprintf("%s/%d/context", projectAbs, p.id))
 		case PACKAGING:
 			command = "podman"
 			spec := fmt.Sprintf("%s/%d/%s", projectAbs, p.id, p.packageSpec)
-			args = []string{"build", "-v", fmt.Sprintf("%s/%d/workspace:/workspace", projectAbs, p.id), "--squash", "-f", spec, "-t", fmt.Sprintf("project-%d", p.id)}
-			if p.packageDep != nil {
-				args = append(args, "--from", fmt.Sprintf("project-%d", p.packageDep.id))
+			args = append([]string{"build", "-v", workspaceDir(p, request) + ":/workspace", "--squash", "-f", spec, "-t", imageName("project", p, request)}, imageLabels(p)...)
+			args = append(args, p.limitArgs(false)...)
+			args, env = p.variableArgs("arg", "--build-arg", args, env, true)
+			if packageDep != nil {
+				args = append(args, "--from", fmt.Sprintf("project-%d", packageDep.id))
 			}
 			args = append(args, fmt.Sprintf("%s/%d/context", projectAbs, p.id))
+		case SCANNING:
+			command, args = scanCommand(p)
+			builtin = func(out io.Writer) error {
+				return scanRun(p, command, args, out)
+			}
 		case PUSHING:
 			url := registryLogin(p.destination)
 			if len(url) > 0 {
-				tag := strings.Replace(p.tag, "$VERSION", strconv.Itoa(p.version), -1)
+				tag := imageTag(p, request)
 				command = "podman"
-				args = []string{"push", fmt.Sprintf("project-%d", p.id), fmt.Sprintf("%s/%s", url, tag)}
+				os.Remove(pushDigest(p))
+				args = []string{"push", "--digestfile", pushDigest(p), imageName("project", p, request), fmt.Sprintf("%s/%s", url, tag)}
+				// The project's SBOM describes its own image, so it isn't attached to variants.
+				attach := len(p.sbom) > 0 && p.sbomAttach && len(request.variant) == 0
+				if len(p.signing) > 0 || attach {
+					builtin = func(out io.Writer) error {
+						return pushImage(p, command, args, fmt.Sprintf("%s/%s", url, tag), attach, out)
+					}
+				}
 			} else {
 				command = "echo"
 				args = []string{"no destination"}
 			}
 		case DELETING:
-			command = "rm"
-			args = []string{"-vrf", fmt.Sprintf("%s/%d", projectAbs, p.id)}
+			command = "clean"
+			args = []string{fmt.Sprintf("%s/%d", projectAbs, p.id)}
+			builtin = func(out io.Writer) error {
+				return cleanPath(out, args[0], projectAbs)
+			}
+		}
+		p.lock.RUnlock()
+		if err := diskCheck(state); err != nil {
+			logger.Warnf("Project %d can't start %s: %v", p.id, state.String(), err)
+			p.setState(DISK_FULL)
+			db.Exec(`UPDATE projects SET state = ? WHERE id = ?`, DISK_FULL.String(), p.id)
+			projectEvent(map[string]interface{}{
+				"event": "project/state",
+				"id":    p.id,
+				"state": DISK_FULL.String(),
+				"error": err.Error(),
+			})
+			runSettle(p, request)
+			continue
 		}
-		p.state = state
+		if err := quotaCheck(p, state); err != nil {
+			builtin = func(out io.Writer) error {
+				return err
+			}
+		}
+		p.setState(state)
 		if len(command) > 0 {
 			var id int
 			var time string
-			err := db.QueryRow(`INSERT INTO tasks(project, type, state, time)
-				VALUES(?, ?, 'RUNNING', datetime('now')) RETURNING id, time`, p.id, p.state.String()).Scan(&id, &time)
+			revision := projectRevise(p, runAuthor(request.build))
+			err := db.QueryRow(`INSERT INTO tasks(project, type, state, time, started, revision, branch, attempt, build, variant)
+				VALUES(?, ?, 'RUNNING', datetime('now'), datetime('now'), ?, ?, ?, ?, ?) RETURNING id, time`, p.id, p.state.String(), revision, p.branch, request.attempt, request.build, request.variant).Scan(&id, &time)
 			if err != nil {
 				logger.Fatal(err)
 			}
-			logger.Infof("Creating task %d:%d", p.id, id)
-			t := &task{id, p.state.String(), "RUNNING", time}
-			p.tasks = append(p.tasks, t)
-			if len(p.tasks) > 5 {
-				p.tasks = p.tasks[1:]
+			for _, label := range splitLabels(request.labels) {
+				db.Exec(`INSERT INTO task_labels(task, label) VALUES(?, ?)`, id, label)
 			}
+			logger.Infof("Creating task %d:%d", p.id, id)
+			t := &task{id, p.state.String(), "RUNNING", time, revision, make(map[string]string), request.attempt, "", 0, -1}
+			p.addTask(t)
 			projectEvent(map[string]interface{}{
-				"event":   "task/create",
-				"project": p.id,
-				"id":      t.id,
-				"type":    t.kind,
-				"time":    t.time,
-				"state":   "RUNNING",
+				"event":    "task/create",
+				"project":  p.id,
+				"id":       t.id,
+				"type":     t.kind,
+				"time":     t.time,
+				"state":    "RUNNING",
+				"revision": t.revision,
+				"attempt":  t.attempt,
+				"build":    request.build,
+				"variant":  request.variant,
 			})
 			taskRoot := fmt.Sprintf("tasks/%d", t.id)
-			os.Mkdir(taskRoot, 0777)
+			makeDir(taskRoot)
 			logger.Infof("Task %s %v", command, args)
-			cmd := exec.Command(command, args...)
-			out, _ := os.Create(fmt.Sprintf("%s/out.log", taskRoot))
-			out.WriteString("\u001B[1m")
-			out.WriteString(cmd.String())
-			out.WriteString("\u001B[0m\n")
-			cmd.Stdout = out
-			cmd.Stderr = out
-			err = cmd.Run()
+			out, _ := createLog(t.id)
+			progressStart(p, state)
+			writer := &progressWriter{out, p}
+			fault := chaosTake(p, state)
+			err = runHooks(p, "pre", state, request, writer)
+			if err == nil {
+				if fault != nil && fault.kind == "db" {
+					err = errors.New("chaos: injected database error")
+					fmt.Fprintln(out, err)
+				} else if builtin != nil {
+					out.WriteString("\u001B[1m")
+					out.WriteString(strings.Join(append([]string{command}, args...), " "))
+					out.WriteString("\u001B[0m\n")
+					err = builtin(out)
+					if err != nil {
+						fmt.Fprintln(out, err)
+					}
+				} else {
+					cmd := exec.Command(command, args...)
+					if len(env) > 0 {
+						cmd.Env = append(os.Environ(), env...)
+					}
+					out.WriteString("\u001B[1m")
+					out.WriteString(cmd.String())
+					out.WriteString("\u001B[0m\n")
+					cmd.Stdout = writer
+					cmd.Stderr = writer
+					err = chaosRun(fault, cmd)
+					if err != nil && fault != nil {
+						fmt.Fprintln(out, err)
+					}
+				}
+			}
+			if err == nil {
+				err = runHooks(p, "post", state, request, writer)
+			}
+			elapsed := progressFinish(p)
+			p.lock.Lock()
 			if err != nil {
 				t.state = "ERROR"
 				p.state += 1
@@ -267,35 +490,88 @@ func projectRoutine(p *project) {
 				t.state = "SUCCESS"
 				p.state += 2
 			}
+			t.finish(err, elapsed)
+			snapshot := p.snapshot
+			p.lock.Unlock()
 			out.Close()
+			if state == TESTING {
+				testIngest(p, t, request)
+			}
+			if state == SCANNING {
+				scanIngest(p, t)
+			}
+			if state == PUSHING && t.state == "SUCCESS" && command == "podman" {
+				pushRecord(p, t, request.build)
+			}
+			if state == BUILDING && t.state == "SUCCESS" && !previewRef(request.ref) && len(request.variant) == 0 {
+				artifactCollect(p, t)
+			}
+			if state == PACKAGING && t.state == "SUCCESS" && len(request.variant) == 0 {
+				sbomCollect(p, t)
+			}
+			if (state == BUILDING || state == PACKAGING) && t.state == "ERROR" && snapshot {
+				snapshotCollect(p, t, workspaceDir(p, request))
+			}
+			logParse(p, t)
+			logIndex(p, t)
+			taskAnnotate(p, t, request)
+			if state == PULLING && t.state == "SUCCESS" {
+				runCommit(p, request.build, t)
+			}
+			taskArchive(t)
 			logger.Infof("Task %d completed", t.id)
 			db.Exec(`UPDATE projects SET state = ? WHERE id = ?`, p.state.String(), p.id)
-			db.Exec(`UPDATE tasks SET state = ? WHERE id = ?`, t.state, t.id)
+			db.Exec(`UPDATE tasks SET state = ?, finished = ?, duration = ?, exitCode = ? WHERE id = ?`, t.state, t.finished, t.duration, t.exitCode, t.id)
 			projectEvent(map[string]interface{}{
 				"event": "project/state",
 				"id":    p.id,
 				"state": p.state.String(),
 			})
+			retry := t.state == "ERROR" && taskRetry(p, request)
 			projectEvent(map[string]interface{}{
-				"event":   "task/state",
-				"project": p.id,
-				"id":      t.id,
-				"state":   t.state,
+				"event":    "task/state",
+				"project":  p.id,
+				"id":       t.id,
+				"state":    t.state,
+				"metadata": t.metadata,
+				"finished": t.finished,
+				"duration": t.duration,
+				"exitCode": t.exitCode,
+				"retry":    retry,
+			})
+			if retry {
+				continue
+			}
+		} else {
+			db.Exec(`UPDATE projects SET state = ? WHERE id = ?`, p.state.String(), p.id)
+			projectEvent(map[string]interface{}{
+				"event": "project/state",
+				"id":    p.id,
+				"state": p.state.String(),
 			})
 		}
 		logger.Infof("Project %d finished task %s", p.id, state.String())
+		runSettle(p, request)
+		if len(request.variant) > 0 {
+			variantNext(p, request)
+			continue
+		}
+		p.lock.RLock()
+		buildSpec, testSpec, scanner, hold := p.buildSpec, p.testSpec, p.scanner, p.hold
+		tag := imageTag(p, request)
+		p.lock.RUnlock()
 		switch p.state {
 		case CREATE_SUCCESS:
-			p.buildFrom(CLEANING, trigger)
+			p.buildNext(CLEANING, request)
 		case CLEAN_SUCCESS:
-			p.buildFrom(CLONING, trigger)
+			p.buildNext(CLONING, request)
 		case CLONE_SUCCESS:
-			p.buildFrom(PREPARING, trigger)
+			p.buildNext(PREPARING, request)
 		case PREPARE_SUCCESS:
-			p.buildFrom(PULLING, trigger)
+			p.buildNext(PULLING, request)
 		case PULL_SUCCESS:
 			buildHash := []byte{}
-			f, err := os.Open(fmt.Sprintf("%s/%d/%s", projectAbs, p.id, p.buildSpec))
+			f, err := os.Open(fmt.Sprintf("%s/%d/%s", projectAbs, p.id, buildSpec))
 			if err == nil {
 				h := sha256.New()
 				io.Copy(h, f)
@@ -307,52 +583,131 @@ func projectRoutine(p *project) {
 			if !bytes.Equal(buildHash, p.buildHash) {
 				p.buildHash = buildHash
 				db.Exec(`UPDATE projects SET buildHash = ? WHERE id = ?`, buildHash, p.id)
-				p.buildFrom(PREPARING, trigger)
+				p.buildNext(PREPARING, request)
 			} else {
-				p.buildFrom(BUILDING, trigger)
+				p.buildNext(BUILDING, request)
 			}
 		case BUILD_SUCCESS:
-			p.buildFrom(PACKAGING, trigger)
+			if len(testSpec) > 0 {
+				p.buildNext(TESTING, request)
+			} else {
+				p.buildNext(PACKAGING, request)
+			}
+		case TEST_SUCCESS:
+			p.buildNext(PACKAGING, request)
 		case PACKAGE_SUCCESS:
+			p.lock.Lock()
 			p.version += 1
+			p.lock.Unlock()
 			db.Exec(`UPDATE projects SET version = ? WHERE id = ?`, p.version, p.id)
 			projectEvent(map[string]interface{}{
 				"event":   "project/version",
 				"id":      p.id,
 				"version": p.version,
 			})
-			p.buildFrom(PUSHING, trigger)
+			if len(scanner) > 0 {
+				p.buildNext(SCANNING, request)
+			} else if hold {
+				p.buildNext(PENDING_APPROVAL, request)
+			} else {
+				p.buildNext(PUSHING, request)
+			}
+		case SCAN_SUCCESS:
+			if hold {
+				p.buildNext(PENDING_APPROVAL, request)
+			} else {
+				p.buildNext(PUSHING, request)
+			}
+		case PENDING_APPROVAL:
+			approvalWait(p, request)
+		case APPROVAL_GRANTED:
+			p.buildNext(PUSHING, request)
 		case PUSH_SUCCESS:
-			tag := strings.Replace(p.tag, "$VERSION", strconv.Itoa(p.version), -1)
-			for p2, state2 := range p.triggers {
-				p2.buildFrom(state2, tag)
+			targets := p.triggerTargets()
+			after := p.afterTargets()
+			if len(targets)+len(after) > 0 && inMaintenance() {
+				logger.Warnf("Project %d didn't trigger other projects in maintenance mode", p.id)
+				break
+			}
+			for p2, state2 := range targets {
+				p2.enqueue(taskRequest{state2, tag, request.labels, 0, 0, NONE, "", ""})
+			}
+			for _, p2 := range after {
+				if _, triggered := targets[p2]; !triggered {
+					p2.enqueue(taskRequest{PREPARING, tag, request.labels, 0, 0, NONE, "", ""})
+				}
 			}
 		case DELETE_SUCCESS:
 			db.Exec(`DELETE FROM projects WHERE id = ?`, p.id)
+			db.Exec(`DELETE FROM task_labels WHERE task IN (SELECT id FROM tasks WHERE project = ?)`, p.id)
+			db.Exec(`DELETE FROM log_lines WHERE task IN (SELECT id FROM tasks WHERE project = ?)`, p.id)
 			db.Exec(`DELETE FROM tasks WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM revisions WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM variables WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM tests WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM vulnerabilities WHERE project = ?`, p.id)
+			os.Remove(sbomFile(p))
+			artifactDelete(p.id, `project = ?`, p.id)
+			snapshotDelete(p.id, `project = ?`, p.id)
+			db.Exec(`DELETE FROM deployments WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM parsers WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM retries WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM variants WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM proposals WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM builds WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM webhooks WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM deliveries WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM previews WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM metadata WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM project_labels WHERE project = ?`, p.id)
+			db.Exec(`DELETE FROM afters WHERE project = ? OR upstream = ?`, p.id, p.id)
+			projectsLock.Lock()
+			delete(afters, p)
+			for _, targets := range afters {
+				delete(targets, p)
+			}
 			delete(projects, p.id)
+			projectsLock.Unlock()
 			return
 		}
 	}
 }
 
-func projectCreate(name, url, branch, destination, tag string) *project {
+func projectCreate(name, url, branch, destination, tag, author string) *project {
 	var id int
 	db.QueryRow(`INSERT INTO projects(name, source, branch, destination, tag, buildSpec, packageSpec, state, version)
 		VALUES(?, ?, ?, ?, ?, 'BuildSpec', 'PackageSpec', 'CLONING', 0) RETURNING id`, name, url, branch, destination, tag).Scan(&id)
-	logger.Infof("Project created %s %s %s %s", id, name, url, branch)
-	os.Mkdir(fmt.Sprintf("%s/%d", projectAbs, id), 0777)
-	os.Mkdir(fmt.Sprintf("%s/%d/context", projectAbs, id), 0777)
-	os.Mkdir(fmt.Sprintf("%s/%d/workspace", projectAbs, id), 0777)
+	logger.Infof("Project created %d %s %s %s", id, name, url, branch)
+	makeDir(fmt.Sprintf("%s/%d", projectAbs, id))
+	makeDir(fmt.Sprintf("%s/%d/context", projectAbs, id))
+	makeDir(fmt.Sprintf("%s/%d/workspace", projectAbs, id))
+	makeDir(fmt.Sprintf("%s/%d/cache", projectAbs, id))
 	p := &project{
-		id, name, "", url, branch, destination, tag, "BuildSpec", "PackageSpec", []byte{},
+		id, name, "", url, branch, destination, tag, "BuildSpec", "PackageSpec", "", []byte{},
 		CREATE_SUCCESS, 0,
 		make([]*task, 0),
 		make(chan taskRequest, 10),
 		make(map[*project]state),
 		nil, nil,
+		make(map[string]*variable),
+		0, "", time.Unix(0, 0),
+		false,
+		"", "",
+		"",
+		"", "", 0,
+		"", "",
+		"",
+		"", false,
+		"",
+		"",
+		false,
+		"",
+		sync.RWMutex{},
 	}
+	projectsLock.Lock()
 	projects[p.id] = p
+	projectsLock.Unlock()
+	projectRevise(p, author)
 	go projectRoutine(p)
 	projectEvent(map[string]interface{}{
 		"event":       "project/create",
@@ -365,42 +720,191 @@ func projectCreate(name, url, branch, destination, tag string) *project {
 		"tag":         p.tag,
 		"buildSpec":   p.buildSpec,
 		"packageSpec": p.packageSpec,
+		"caches":      p.caches,
+		"poll":        p.poll,
+		"hold":        p.hold,
+		"testSpec":    p.testSpec,
+		"testReport":  p.testReport,
+		"artifacts":   p.artifacts,
 		"state":       p.state.String(),
 		"version":     p.version,
 	})
 	return p
 }
 
-var staticPath, _ = filepath.Abs("static")
+func projectGet(id int) *project {
+	projectsLock.RLock()
+	defer projectsLock.RUnlock()
+	return projects[id]
+}
 
-func loadStatic(path string) ([]byte, error) {
-	path = filepath.Clean(path)
-	if path == "." {
-		return nil, errors.New("Not found")
+// projectAll returns the projects in order of their ids.
+func projectAll() []*project {
+	projectsLock.RLock()
+	all := make([]*project, 0, len(projects))
+	for _, p := range projects {
+		all = append(all, p)
 	}
-	return ioutil.ReadFile(staticPath + path)
+	projectsLock.RUnlock()
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].id < all[j].id
+	})
+	return all
+}
+
+func (p *project) currentState() state {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.state
+}
+
+func (p *project) setState(s state) {
+	p.lock.Lock()
+	p.state = s
+	p.lock.Unlock()
+}
+
+// addTask adds a task to the project's recent tasks, which are its last five.
+func (p *project) addTask(t *task) {
+	p.lock.Lock()
+	p.tasks = append(p.tasks, t)
+	if len(p.tasks) > 5 {
+		p.tasks = p.tasks[1:]
+	}
+	p.lock.Unlock()
+}
+
+// finish records when the task finished, how long it took and its command's exit status, which is -1 when it failed
+// without one.
+func (t *task) finish(err error, elapsed time.Duration) {
+	t.finished = time.Now().UTC().Format("2006-01-02 15:04:05")
+	t.duration = elapsed.Seconds()
+	t.exitCode = 0
+	if err != nil {
+		t.exitCode = -1
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			t.exitCode = exit.ExitCode()
+		}
+	}
+}
+
+func (p *project) setMetadata(t *task, name, value string) {
+	p.lock.Lock()
+	t.metadata[name] = value
+	p.lock.Unlock()
+}
+
+// variableList copies the project's variables in order of their names.
+func (p *project) variableList() []*variable {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.sortedVariables()
+}
+
+// sortedVariables lists the project's variables in order of their names, with p.lock held.
+func (p *project) sortedVariables() []*variable {
+	list := make([]*variable, 0, len(p.variables))
+	for _, v := range p.variables {
+		v := *v
+		list = append(list, &v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+func (p *project) setVariable(v *variable) {
+	p.lock.Lock()
+	p.variables[v.name] = v
+	p.lock.Unlock()
+}
+
+func (p *project) deleteVariable(name string) {
+	p.lock.Lock()
+	delete(p.variables, name)
+	p.lock.Unlock()
+}
+
+func (p *project) currentVersion() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.version
+}
+
+func (p *project) currentName() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.name
+}
+
+// specFiles copies the names of the project's build, package and test specs, in that order.
+func (p *project) specFiles() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return []string{p.buildSpec, p.packageSpec, p.testSpec}
+}
+
+// triggerTargets copies the projects that the project triggers, with the stage each of them starts from.
+func (p *project) triggerTargets() map[*project]state {
+	projectsLock.RLock()
+	defer projectsLock.RUnlock()
+	targets := make(map[*project]state, len(p.triggers))
+	for t, s := range p.triggers {
+		targets[t] = s
+	}
+	return targets
+}
+
+// dependencies returns the projects whose images the project's prepare and package stages build from.
+func (p *project) dependencies() (*project, *project) {
+	projectsLock.RLock()
+	defer projectsLock.RUnlock()
+	return p.prepareDep, p.packageDep
+}
+
+// projectTasks copies the project's state and recent tasks, so that they agree with each other.
+func projectTasks(p *project) (state, []interface{}) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	tasks := make([]interface{}, 0)
+	for _, task := range p.tasks {
+		metadata := make(map[string]string)
+		for name, value := range task.metadata {
+			metadata[name] = value
+		}
+		tasks = append(tasks, map[string]interface{}{
+			"id":       task.id,
+			"type":     task.kind,
+			"state":    task.state,
+			"time":     task.time,
+			"started":  task.time,
+			"finished": task.finished,
+			"duration": task.duration,
+			"exitCode": task.exitCode,
+			"revision": task.revision,
+			"attempt":  task.attempt,
+			"metadata": metadata,
+		})
+	}
+	return p.state, tasks
 }
 
 func projectList() []map[string]interface{} {
 	result := make([]map[string]interface{}, 0)
-	for id, p := range projects {
-		tasks := make([]interface{}, 0)
-		for _, task := range p.tasks {
-			tasks = append(tasks, map[string]interface{}{
-				"id":    task.id,
-				"type":  task.kind,
-				"state": task.state,
-				"time":  task.time,
-			})
-		}
+	for _, p := range projectAll() {
+		state, tasks := projectTasks(p)
 		triggers := make([]interface{}, 0)
-		for target, state := range p.triggers {
+		for target, state := range p.triggerTargets() {
 			triggers = append(triggers, []interface{}{
 				target.id, state.String(),
 			})
 		}
+		progress := progressStatus(p)
+		p.lock.RLock()
 		result = append(result, map[string]interface{}{
-			"id":          id,
+			"id":          p.id,
 			"name":        p.name,
 			"labels":      p.labels,
 			"url":         p.url,
@@ -409,15 +913,33 @@ func projectList() []map[string]interface{} {
 			"tag":         p.tag,
 			"buildSpec":   p.buildSpec,
 			"packageSpec": p.packageSpec,
-			"state":       p.state.String(),
+			"caches":      p.caches,
+			"poll":        p.poll,
+			"hold":        p.hold,
+			"testSpec":    p.testSpec,
+			"testReport":  p.testReport,
+			"artifacts":   p.artifacts,
+			"cpus":        p.cpus,
+			"memory":      p.memory,
+			"diskQuota":   p.diskQuota,
+			"scanner":     p.scanner,
+			"scanFail":    p.scanFail,
+			"signing":     p.signing,
+			"sbom":        p.sbom,
+			"sbomAttach":  p.sbomAttach,
+			"tagPattern":  p.tagPattern,
+			"pathFilter":  p.pathFilter,
+			"snapshot":    p.snapshot,
+			"sourceKind":  p.sourceKind,
+			"state":       state.String(),
+			"progress":    progress,
 			"tasks":       tasks,
 			"version":     p.version,
+			"queued":      len(p.queue),
 			"triggers":    triggers,
 		})
+		p.lock.RUnlock()
 	}
-	sort.Slice(result, func(i, j int) bool {
-		return result[i]["id"].(int) < result[j]["id"].(int)
-	})
 	return result
 }
 
@@ -429,7 +951,7 @@ type user struct {
 }
 
 func renderLogin(w http.ResponseWriter, path string, params map[string]string) {
-	loginTemplate, _ := template.ParseFiles(staticPath + "/login.xhtml")
+	loginTemplate, _ := template.ParseFS(staticFS(), "login.xhtml")
 	w.Header().Add("Content-Type", "application/xhtml+xml")
 	var sb strings.Builder
 	sep := ""
@@ -443,6 +965,7 @@ func renderLogin(w http.ResponseWriter, path string, params map[string]string) {
 	err := loginTemplate.Execute(w, map[string]interface{}{
 		"action": path,
 		"params": sb.String(),
+		"oidc":   len(oidcIssuer) > 0,
 	})
 	if err != nil {
 		logger.Error(err)
@@ -471,6 +994,29 @@ func checkLogin(u *user, role string, w http.ResponseWriter, path string, params
 func handleUserLogin(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	username := params["username"]
 	password := params["password"]
+	u2 := user{username, []string{"admin", "user"}}
+	if len(ldapURL) > 0 {
+		groups, err := ldapLogin(username, password)
+		if err == nil {
+			u2, err = ssoUser(username, "ldap", groups)
+			if err != nil {
+				writeError(w, statusError(403, err.Error()))
+				return
+			}
+			userLogin(w, r, u2, params)
+			return
+		}
+		// Local users can still log in when LDAP doesn't know them.
+		logger.Warnf("LDAP login of %s failed: %v", username, err)
+	}
+	if u3, ok, err := userPassword(username, password); ok {
+		if err != nil {
+			writeError(w, statusError(401, "Wrong user name or password"))
+			return
+		}
+		userLogin(w, r, u3, params)
+		return
+	}
 	tr, err := pam.StartFunc("sudo", username, func(s pam.Style, msg string) (string, error) {
 		switch s {
 		case pam.PromptEchoOn:
@@ -490,27 +1036,14 @@ func handleUserLogin(w http.ResponseWriter, r *http.Request, u *user, params map
 	err = tr.Authenticate(0)
 	if err != nil {
 		logger.Error(err)
-		w.WriteHeader(401)
-		w.Write([]byte(err.Error()))
+		writeError(w, statusError(401, err.Error()))
 		return
 	}
-	u2 := user{username, []string{"admin", "user"}}
-	gcm, _ := cipher.NewGCM(ciph)
-	nonceSize := gcm.NonceSize()
-	nonce := make([]byte, nonceSize)
-	rand.Read(nonce)
-	in, _ := json.Marshal(u2)
-	en := gcm.Seal(nil, nonce, in, nil)
-	out := make([]byte, len(en)+nonceSize)
-	copy(out[:nonceSize], nonce)
-	copy(out[nonceSize:], en)
-	cookie := http.Cookie{
-		Name:    "RACS_TOKEN",
-		Value:   hex.EncodeToString(out),
-		Path:    "/",
-		Expires: time.Now().Add(24 * time.Hour),
-	}
-	http.SetCookie(w, &cookie)
+	userLogin(w, r, u2, params)
+}
+
+func userLogin(w http.ResponseWriter, r *http.Request, u2 user, params map[string]string) {
+	sessionStart(w, u2)
 	action := params["action"]
 	redirect := params["redirect"]
 	if len(action) > 0 {
@@ -525,7 +1058,7 @@ func handleUserLogin(w http.ResponseWriter, r *http.Request, u *user, params map
 		w.WriteHeader(303)
 	} else {
 		w.WriteHeader(200)
-		w.Write([]byte(username))
+		w.Write([]byte(u2.Name))
 	}
 }
 
@@ -554,6 +1087,16 @@ func handleUserCurrent(w http.ResponseWriter, r *http.Request, u *user, params m
 
 func handleProjectList(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	result := projectList()
+	if labels := splitLabels(params["label"]); len(labels) > 0 {
+		labelled := labelledProjects(labels)
+		filtered := make([]map[string]interface{}, 0)
+		for _, entry := range result {
+			if labelled[entry["id"].(int)] {
+				filtered = append(filtered, entry)
+			}
+		}
+		result = filtered
+	}
 	w.Header().Add("Content-Type", "application/json")
 	j, _ := json.Marshal(result)
 	w.Write(j)
@@ -569,36 +1112,44 @@ func handleProjectEvents(w http.ResponseWriter, r *http.Request, u *user, params
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	events := make(chan []byte)
+	events := make(chan []byte, eventBuffer)
 	clients.register <- events
 	defer func() {
 		clients.unregister <- events
 	}()
-	notify := w.(http.CloseNotifier).CloseNotify()
-	go func() {
-		<-notify
-		clients.unregister <- events
-	}()
 	j, _ := json.Marshal(map[string]interface{}{
 		"event":    "project/list",
 		"projects": projectList(),
 	})
 	fmt.Fprintf(w, "data: %s\n\n", j)
 	flusher.Flush()
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
 	for {
-		fmt.Fprintf(w, "data: %s\n\n", <-events)
-		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event := <-events:
+			if event == nil {
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			flusher.Flush()
+		}
 	}
 }
 
 func handleProjectStatus(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	id, _ := strconv.Atoi(params["id"])
-	p := projects[id]
+	p := projectGet(id)
 	if p == nil {
-		w.WriteHeader(500)
+		writeError(w, notFound("Project"))
 	} else {
-		w.Header().Add("Content-Type", "application/json")
-		j, _ := json.Marshal(map[string]interface{}{
+		p.lock.RLock()
+		status := map[string]interface{}{
 			"id":          id,
 			"name":        p.name,
 			"url":         p.url,
@@ -606,45 +1157,153 @@ func handleProjectStatus(w http.ResponseWriter, r *http.Request, u *user, params
 			"destination": p.destination,
 			"buildSpec":   p.buildSpec,
 			"packageSpec": p.packageSpec,
+			"caches":      p.caches,
+			"poll":        p.poll,
+			"hold":        p.hold,
+			"testSpec":    p.testSpec,
+			"testReport":  p.testReport,
+			"artifacts":   p.artifacts,
+			"scanner":     p.scanner,
+			"scanFail":    p.scanFail,
+			"signing":     p.signing,
+			"sbom":        p.sbom,
+			"sbomAttach":  p.sbomAttach,
+			"tagPattern":  p.tagPattern,
+			"pathFilter":  p.pathFilter,
+			"snapshot":    p.snapshot,
+			"sourceKind":  p.sourceKind,
 			"tag":         p.tag,
 			"labels":      p.labels,
-		})
+		}
+		p.lock.RUnlock()
+		status["state"] = p.currentState().String()
+		status["progress"] = progressStatus(p)
+		w.Header().Add("Content-Type", "application/json")
+		j, _ := json.Marshal(status)
 		w.Write(j)
 	}
 }
 
+// applySettings changes the project's settings, with p.lock held for writing.
+func (p *project) applySettings(params map[string]string) {
+	p.name = params["name"]
+	p.labels = strings.Join(splitLabels(params["labels"]), ",")
+	p.url = params["url"]
+	p.branch = params["branch"]
+	p.destination = params["destination"]
+	p.tag = params["tag"]
+	p.buildSpec = filepath.Clean(params["buildSpec"])
+	p.packageSpec = filepath.Clean(params["packageSpec"])
+	if value, ok := params["caches"]; ok {
+		p.caches = value
+	}
+	if value, ok := params["poll"]; ok {
+		p.poll, _ = strconv.Atoi(value)
+	}
+	if value, ok := params["hold"]; ok {
+		p.hold = value == "true"
+	}
+	if value, ok := params["testSpec"]; ok {
+		p.testSpec = value
+		if len(p.testSpec) > 0 {
+			p.testSpec = filepath.Clean(p.testSpec)
+		}
+	}
+	if value, ok := params["testReport"]; ok {
+		p.testReport = value
+	}
+	if value, ok := params["artifacts"]; ok {
+		p.artifacts = value
+	}
+	if value, ok := params["cpus"]; ok {
+		p.cpus = strings.TrimSpace(value)
+	}
+	if value, ok := params["memory"]; ok {
+		p.memory = strings.ToLower(strings.TrimSpace(value))
+	}
+	if value, ok := params["diskQuota"]; ok {
+		p.diskQuota, _ = strconv.Atoi(value)
+	}
+	if value, ok := params["scanner"]; ok {
+		p.scanner = strings.ToLower(strings.TrimSpace(value))
+	}
+	if value, ok := params["scanFail"]; ok {
+		p.scanFail = strings.ToLower(strings.TrimSpace(value))
+	}
+	if value, ok := params["signing"]; ok {
+		p.signing = strings.ToLower(strings.TrimSpace(value))
+	}
+	if value, ok := params["sbom"]; ok {
+		p.sbom = strings.ToLower(strings.TrimSpace(value))
+	}
+	if value, ok := params["sbomAttach"]; ok {
+		p.sbomAttach = value == "true"
+	}
+	if value, ok := params["tagPattern"]; ok {
+		p.tagPattern = strings.TrimSpace(value)
+	}
+	if value, ok := params["pathFilter"]; ok {
+		p.pathFilter = strings.TrimSpace(value)
+	}
+	if value, ok := params["snapshot"]; ok {
+		p.snapshot = value == "true"
+	}
+	if value, ok := params["sourceKind"]; ok {
+		p.sourceKind = strings.ToLower(strings.TrimSpace(value))
+	}
+	labelsStore(p.id, splitLabels(p.labels))
+	db.Exec(`UPDATE projects SET name = ?, source = ?, branch = ?, destination = ?, tag = ?,
+		buildSpec = ?, packageSpec = ?, caches = ?, poll = ?, hold = ?, testSpec = ?, testReport = ?, artifacts = ?,
+		cpus = ?, memory = ?, diskQuota = ?, scanner = ?, scanFail = ?, signing = ?, sbom = ?, sbomAttach = ?, tagPattern = ?, pathFilter = ?, snapshot = ?, sourceKind = ? WHERE id = ?`,
+		p.name, p.url, p.branch, p.destination, p.tag, p.buildSpec, p.packageSpec, p.caches, p.poll, p.hold,
+		p.testSpec, p.testReport, p.artifacts, p.cpus, p.memory, p.diskQuota, p.scanner, p.scanFail, p.signing, p.sbom, p.sbomAttach, p.tagPattern, p.pathFilter, p.snapshot, p.sourceKind, p.id)
+	projectEvent(map[string]interface{}{
+		"event":       "project/update",
+		"id":          p.id,
+		"name":        p.name,
+		"labels":      p.labels,
+		"url":         p.url,
+		"branch":      p.branch,
+		"destination": p.destination,
+		"buildSpec":   p.buildSpec,
+		"packageSpec": p.packageSpec,
+		"caches":      p.caches,
+		"poll":        p.poll,
+		"hold":        p.hold,
+		"testSpec":    p.testSpec,
+		"testReport":  p.testReport,
+		"artifacts":   p.artifacts,
+		"cpus":        p.cpus,
+		"memory":      p.memory,
+		"diskQuota":   p.diskQuota,
+		"scanner":     p.scanner,
+		"scanFail":    p.scanFail,
+		"signing":     p.signing,
+		"sbom":        p.sbom,
+		"sbomAttach":  p.sbomAttach,
+		"tagPattern":  p.tagPattern,
+		"pathFilter":  p.pathFilter,
+		"snapshot":    p.snapshot,
+		"sourceKind":  p.sourceKind,
+		"tag":         p.tag,
+	})
+}
+
 func handleProjectUpdate(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	if checkLogin(u, "admin", w, "/project/update", params) {
 		return
 	}
 	id, _ := strconv.Atoi(params["id"])
-	p := projects[id]
+	p := projectGet(id)
 	if p == nil {
-		w.WriteHeader(500)
+		writeError(w, notFound("Project"))
+	} else if !validLimits(params) || !validScan(params) || !validSigning(params) || !validSBOM(params) || !validSource(params) {
+		writeError(w, badRequest("Invalid resource limits, scanner, signing, SBOM format or source kind"))
 	} else {
-		p.name = params["name"]
-		p.labels = params["labels"]
-		p.url = params["url"]
-		p.branch = params["branch"]
-		p.destination = params["destination"]
-		p.tag = params["tag"]
-		p.buildSpec = filepath.Clean(params["buildSpec"])
-		p.packageSpec = filepath.Clean(params["packageSpec"])
-		db.Exec(`UPDATE projects SET name = ?, labels = ?, source = ?, branch = ?, destination = ?, tag = ?,
-			buildSpec = ?, packageSpec = ? WHERE id = ?`,
-			p.name, p.labels, p.url, p.branch, p.destination, p.tag, p.buildSpec, p.packageSpec, p.id)
-		projectEvent(map[string]interface{}{
-			"event":       "project/update",
-			"id":          p.id,
-			"name":        p.name,
-			"labels":      p.labels,
-			"url":         p.url,
-			"branch":      p.branch,
-			"destination": p.destination,
-			"buildSpec":   p.buildSpec,
-			"packageSpec": p.packageSpec,
-			"tag":         p.tag,
-		})
+		p.lock.Lock()
+		p.applySettings(params)
+		p.lock.Unlock()
+		projectRevise(p, u.Name)
 		redirect := params["redirect"]
 		if len(redirect) > 0 {
 			w.Header().Add("Location", redirect)
@@ -665,7 +1324,18 @@ func handleProjectCreate(w http.ResponseWriter, r *http.Request, u *user, params
 	branch := params["branch"]
 	destination := params["destination"]
 	tag := params["tag"]
-	p := projectCreate(name, url, branch, destination, tag)
+	if !validSource(params) {
+		writeError(w, invalidParam("sourceKind", "Unknown source kind %s", params["sourceKind"]))
+		return
+	}
+	p := projectCreate(name, url, branch, destination, tag, u.Name)
+	if len(params["sourceKind"]) > 0 {
+		kind := strings.ToLower(strings.TrimSpace(params["sourceKind"]))
+		p.lock.Lock()
+		p.sourceKind = kind
+		p.lock.Unlock()
+		db.Exec(`UPDATE projects SET sourceKind = ? WHERE id = ?`, kind, p.id)
+	}
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
 		w.Header().Add("Location", redirect)
@@ -699,21 +1369,35 @@ func handleProjectUpload(w http.ResponseWriter, r *http.Request, u *user, params
 		return
 	}
 	id, _ := strconv.Atoi(params["id"])
-	name := filepath.Clean(params["name"])
+	name := strings.TrimPrefix(filepath.Clean("/"+params["name"]), "/")
 	upload := filepath.Clean(params["upload"])
 	validUpload, _ := regexp.MatchString("^uploads/upload-[0-9]+$", upload)
-	p := projects[id]
+	p := projectGet(id)
 	if p == nil {
-		w.WriteHeader(500)
-	} else if name == "." {
-		w.WriteHeader(500)
+		writeError(w, notFound("Project"))
 	} else if !validUpload {
-		w.WriteHeader(500)
+		writeError(w, badRequest("No file uploaded"))
+	} else if slot := uploadSlotFor(p, name); slot == nil {
+		os.Remove(upload)
+		writeError(w, badRequest("Uploads must be a container spec (BuildSpec, PackageSpec or TestSpec) or a file under context/"))
+	} else if status, err := slot.check(upload); err != nil {
+		os.Remove(upload)
+		writeError(w, statusError(status, fmt.Sprintf("%s: %v", name, err)))
 	} else {
-		err := os.Rename(upload, fmt.Sprintf("%s/%d/%s", projectAbs, id, name))
+		path := fmt.Sprintf("%s/%d/%s", projectAbs, id, name)
+		makeDir(filepath.Dir(path))
+		if slot == specSlot {
+			lock := specLock(p.id)
+			lock.Lock()
+			defer lock.Unlock()
+		}
+		err := os.Rename(upload, path)
 		if err != nil {
 			logger.Error(err)
+		} else {
+			applyMode(path, fileMode)
 		}
+		projectRevise(p, u.Name)
 		redirect := params["redirect"]
 		if len(redirect) > 0 {
 			w.Header().Add("Location", redirect)
@@ -730,45 +1414,32 @@ func handleProjectTriggers(w http.ResponseWriter, r *http.Request, u *user, para
 		return
 	}
 	pid, _ := strconv.Atoi(params["id"])
-	p := projects[pid]
-	for target, state := range p.triggers {
-		switch state {
-		case PREPARING:
-			target.prepareDep = nil
-		case PACKAGING:
-			target.packageDep = nil
-		}
+	p := projectGet(pid)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
 	}
-	p.triggers = make(map[*project]state)
-	db.Exec(`DELETE FROM triggers WHERE project = ?`, p.id)
-	triggers := strings.FieldsFunc(params["triggers"], func(c rune) bool {
+	fields := strings.FieldsFunc(params["triggers"], func(c rune) bool {
 		return c == ','
 	})
-	for i := 0; i < len(triggers); i += 2 {
-		tid, _ := strconv.Atoi(triggers[i])
-		t := projects[tid]
-		s := NONE
-		switch triggers[i+1] {
-		case "clean":
-			s = CLEANING
-		case "clone":
-			s = CLONING
-		case "prepare":
-			s = PREPARING
-			t.prepareDep = p
-		case "pull":
-			s = PULLING
-		case "build":
-			s = BUILDING
-		case "package":
-			s = PACKAGING
-			t.packageDep = p
-		case "push":
-			s = PUSHING
+	triggers := make(map[*project]state)
+	for i := 0; i+1 < len(fields); i += 2 {
+		tid, _ := strconv.Atoi(fields[i])
+		t := projectGet(tid)
+		s, ok := stageStates[fields[i+1]]
+		if t == nil {
+			writeError(w, notFound(fmt.Sprintf("Project %d", tid)))
+			return
 		}
-		p.triggers[t] = s
-		db.Exec(`INSERT INTO triggers(project, target, state) VALUES(?, ?, ?)`, p.id, t.id, s.String())
+		if ok {
+			triggers[t] = s
+		}
+	}
+	if cycle := projectSetTriggers(p, triggers); cycle != nil {
+		writeCycle(w, cycle)
+		return
 	}
+	projectRevise(p, u.Name)
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
 		w.Header().Add("Location", redirect)
@@ -781,33 +1452,74 @@ func handleProjectTriggers(w http.ResponseWriter, r *http.Request, u *user, para
 
 func handleProjectBuild(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	id, _ := strconv.Atoi(params["id"])
-	stage := params["stage"]
-	p := projects[id]
-	switch stage {
-	case "clean":
-		p.buildFrom(CLEANING, "")
-	case "clone":
-		p.buildFrom(CLONING, "")
-	case "prepare":
-		p.buildFrom(PREPARING, "")
-	case "pull":
-		p.buildFrom(PULLING, "")
-	case "build":
-		p.buildFrom(BUILDING, "")
-	case "package":
-		p.buildFrom(PACKAGING, "")
-	case "push":
-		p.buildFrom(PUSHING, "")
+	p := projectGet(id)
+	state, ok := stageStates[params["stage"]]
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	} else if !ok {
+		writeError(w, invalidParam("stage", "Unknown stage %s", params["stage"]))
+		return
 	}
+	p.enqueue(taskRequest{state, "", params["labels"], 0, 0, NONE, "", ""})
 	w.WriteHeader(200)
 	w.Write([]byte("OK"))
 }
 
+func projectApproval(w http.ResponseWriter, u *user, params map[string]string, approved bool) {
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	if state := p.currentState(); state != PENDING_APPROVAL {
+		writeError(w, conflict("Project is %s", state.String()))
+		return
+	}
+	version := p.currentVersion()
+	db.Exec(`INSERT INTO approvals(project, version, user, time, approved) VALUES(?, ?, ?, datetime('now'), ?)`, p.id, version, u.Name, approved)
+	if approved {
+		logger.Infof("Project %d version %d approved by %s", p.id, version, u.Name)
+		p.enqueue(approvalRequest(p, APPROVAL_GRANTED))
+	} else {
+		logger.Infof("Project %d version %d rejected by %s", p.id, version, u.Name)
+		p.enqueue(approvalRequest(p, APPROVAL_REJECTED))
+	}
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleProjectApprove(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/approve", params) {
+		return
+	}
+	projectApproval(w, u, params, true)
+}
+
+func handleProjectReject(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/reject", params) {
+		return
+	}
+	projectApproval(w, u, params, false)
+}
+
 func handleProjectDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
 	confirm := params["confirm"]
 	if confirm == "YES" {
-		projects[id].buildFrom(DELETING, "")
+		p.buildFrom(DELETING, "")
 	}
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
@@ -819,19 +1531,58 @@ func handleProjectDelete(w http.ResponseWriter, r *http.Request, u *user, params
 	}
 }
 
-func handleTaskLogs(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
-	id, _ := strconv.Atoi(params["id"])
+func taskLog(id int, offset int64) (string, []byte) {
 	var state string
 	db.QueryRow(`SELECT state FROM tasks WHERE id = ?`, id).Scan(&state)
-	offset, _ := strconv.ParseInt(params["offset"], 10, 64)
-	file, _ := os.Open(fmt.Sprintf("tasks/%d/out.log", id))
+	file, err := os.Open(taskLogKey(id))
+	if os.IsNotExist(err) {
+		archived, err := store.Open(taskLogKey(id), offset)
+		if err != nil {
+			return state, []byte{}
+		}
+		defer archived.Close()
+		bytes, _ := ioutil.ReadAll(archived)
+		return state, bytes
+	}
+	if err != nil {
+		return state, []byte{}
+	}
+	defer file.Close()
 	file.Seek(offset, 0)
 	bytes, _ := ioutil.ReadAll(file)
+	return state, bytes
+}
+
+func handleTaskLogs(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	offset, _ := strconv.ParseInt(params["offset"], 10, 64)
+	state, bytes := taskLog(id, offset)
 	w.Header().Add("Content-Type", "text/plain")
 	w.Header().Add("X-Task-State", state)
 	w.Write(bytes)
 }
 
+func handleTaskLogsBatch(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	tasks := strings.FieldsFunc(params["tasks"], func(c rune) bool {
+		return c == ','
+	})
+	result := make([]map[string]interface{}, 0)
+	for i := 0; i+1 < len(tasks); i += 2 {
+		id, _ := strconv.Atoi(tasks[i])
+		offset, _ := strconv.ParseInt(tasks[i+1], 10, 64)
+		state, bytes := taskLog(id, offset)
+		result = append(result, map[string]interface{}{
+			"id":     id,
+			"state":  state,
+			"offset": offset + int64(len(bytes)),
+			"output": string(bytes),
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
 func handleRegistryCreate(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
 	if checkLogin(u, "admin", w, "/registry/create", params) {
 		return
@@ -840,7 +1591,12 @@ func handleRegistryCreate(w http.ResponseWriter, r *http.Request, u *user, param
 	url := params["url"]
 	user := params["user"]
 	password := params["password"]
-	reg := registryCreate(name, url, user, password)
+	provider := params["provider"]
+	if len(provider) > 0 && !providerName.MatchString(provider) {
+		writeError(w, invalidParam("provider", "Unknown provider %s", provider))
+		return
+	}
+	reg := registryCreate(name, url, user, password, provider)
 	redirect := params["redirect"]
 	if len(redirect) > 0 {
 		w.Header().Add("Location", redirect)
@@ -855,15 +1611,25 @@ func handleAction(path string, w http.ResponseWriter, r *http.Request, u *user,
 	switch path {
 	case "/user/current":
 		handleUserCurrent(w, r, u, params)
+	case "/user/sso":
+		handleUserSSO(w, r, u, params)
+	case "/user/oidc/login":
+		handleUserOIDCLogin(w, r, u, params)
+	case "/user/oidc/callback":
+		handleUserOIDCCallback(w, r, u, params)
 	case "/user/login":
 		handleUserLogin(w, r, u, params)
 	case "/user/logout":
 		handleUserLogout(w, r, u, params)
+	case "/setup":
+		handleSetup(w, r, u, params)
+	case "/setup/complete":
+		handleSetupComplete(w, r, u, params)
 	case "/project/list":
 		handleProjectList(w, r, u, params)
 	case "/project/status":
 		handleProjectStatus(w, r, u, params)
-	case "/project/events":
+	case "/events", "/project/events":
 		handleProjectEvents(w, r, u, params)
 	case "/project/update":
 		handleProjectUpdate(w, r, u, params)
@@ -877,10 +1643,192 @@ func handleAction(path string, w http.ResponseWriter, r *http.Request, u *user,
 		handleProjectBuild(w, r, u, params)
 	case "/project/delete":
 		handleProjectDelete(w, r, u, params)
+	case "/project/approve":
+		handleProjectApprove(w, r, u, params)
+	case "/project/reject":
+		handleProjectReject(w, r, u, params)
+	case "/project/caches":
+		handleProjectCaches(w, r, u, params)
+	case "/project/caches/clear":
+		handleProjectCachesClear(w, r, u, params)
+	case "/summary":
+		handleSummary(w, r, u, params)
+	case "/project/variables":
+		handleProjectVariables(w, r, u, params)
+	case "/project/variables/set":
+		handleProjectVariablesSet(w, r, u, params)
+	case "/project/variables/delete":
+		handleProjectVariablesDelete(w, r, u, params)
+	case "/webhook":
+		handleWebhook(w, r, u, params)
+	case "/project/webhook/secret":
+		handleProjectWebhookSecret(w, r, u, params)
+	case "/project/webhook/deliveries":
+		handleProjectWebhookDeliveries(w, r, u, params)
+	case "/project/sbom":
+		handleProjectSBOM(w, r, u, params)
+	case "/project/scan-results":
+		handleProjectScanResults(w, r, u, params)
+	case "/project/tests":
+		handleProjectTests(w, r, u, params)
+	case "/project/artifacts":
+		handleProjectArtifacts(w, r, u, params)
+	case "/project/artifacts/download":
+		handleProjectArtifactsDownload(w, r, u, params)
+	case "/project/environments":
+		handleProjectEnvironments(w, r, u, params)
+	case "/project/environments/history":
+		handleProjectEnvironmentHistory(w, r, u, params)
+	case "/project/deploy":
+		handleProjectDeploy(w, r, u, params)
+	case "/project/parsers":
+		handleProjectParsers(w, r, u, params)
+	case "/project/parsers/set":
+		handleProjectParsersSet(w, r, u, params)
+	case "/project/parsers/delete":
+		handleProjectParsersDelete(w, r, u, params)
+	case "/project/labels/add":
+		handleProjectLabelsAdd(w, r, u, params)
+	case "/project/labels/remove":
+		handleProjectLabelsRemove(w, r, u, params)
+	case "/labels/health":
+		handleLabelsHealth(w, r, u, params)
+	case "/task/labels/add":
+		handleTaskLabelsAdd(w, r, u, params)
+	case "/task/labels/remove":
+		handleTaskLabelsRemove(w, r, u, params)
+	case "/search":
+		handleSearch(w, r, u, params)
+	case "/search/builds":
+		handleSearchBuilds(w, r, u, params)
+	case "/search/logs":
+		handleSearchLogs(w, r, u, params)
+	case "/search/save":
+		handleSearchSave(w, r, u, params)
+	case "/search/saved":
+		handleSearchSaved(w, r, u, params)
+	case "/search/run":
+		handleSearchRun(w, r, u, params)
+	case "/search/delete":
+		handleSearchDelete(w, r, u, params)
+	case "/project/badge":
+		handleProjectBadge(w, r, u, params)
+	case "/chaos/inject":
+		handleChaosInject(w, r, u, params)
+	case "/chaos/list":
+		handleChaosList(w, r, u, params)
+	case "/chaos/clear":
+		handleChaosClear(w, r, u, params)
+	case "/project/after":
+		handleProjectAfter(w, r, u, params)
+	case "/project/graph":
+		handleProjectGraph(w, r, u, params)
+	case "/project/spec":
+		handleProjectSpec(w, r, u, params)
+	case "/project/files":
+		handleProjectFiles(w, r, u, params)
+	case "/project/files/download":
+		handleProjectFilesDownload(w, r, u, params)
+	case "/project/files/delete":
+		handleProjectFilesDelete(w, r, u, params)
+	case "/project/files/extract":
+		handleProjectFilesExtract(w, r, u, params)
+	case "/project/clone":
+		handleProjectClone(w, r, u, params)
+	case "/templates":
+		handleTemplates(w, r, u, params)
+	case "/template/save":
+		handleTemplateSave(w, r, u, params)
+	case "/template/create":
+		handleTemplateCreate(w, r, u, params)
+	case "/template/delete":
+		handleTemplateDelete(w, r, u, params)
+	case "/project/run":
+		handleProjectRun(w, r, u, params)
+	case "/project/build/status":
+		handleProjectBuildStatus(w, r, u, params)
+	case "/project/export":
+		handleProjectExport(w, r, u, params)
+	case "/project/import":
+		handleProjectImport(w, r, u, params)
+	case "/project/proposals":
+		handleProjectProposals(w, r, u, params)
+	case "/project/proposals/check":
+		handleProjectProposalsCheck(w, r, u, params)
+	case "/project/proposals/trial":
+		handleProjectProposalsTrial(w, r, u, params)
+	case "/project/proposals/log":
+		handleProjectProposalsLog(w, r, u, params)
+	case "/project/proposals/accept":
+		handleProjectProposalsAccept(w, r, u, params)
+	case "/project/proposals/reject":
+		handleProjectProposalsReject(w, r, u, params)
+	case "/admin/status":
+		handleAdminStatus(w, r, u, params)
+	case "/admin/prune/images":
+		handleAdminPruneImages(w, r, u, params)
+	case "/admin/maintenance":
+		handleAdminMaintenance(w, r, u, params)
+	case "/admin/maintenance/start":
+		handleAdminMaintenanceStart(w, r, u, params)
+	case "/admin/maintenance/stop":
+		handleAdminMaintenanceStop(w, r, u, params)
+	case "/admin/restart":
+		handleAdminRestart(w, r, u, params)
+	case "/admin/prune/workspaces":
+		handleAdminPruneWorkspaces(w, r, u, params)
+	case "/admin/audit":
+		handleAdminAudit(w, r, u, params)
+	case "/admin/containers":
+		handleAdminContainers(w, r, u, params)
+	case "/admin/containers/reap":
+		handleAdminContainersReap(w, r, u, params)
+	case "/api/v1/pipeline/lint":
+		handlePipelineLint(w, r, u, params)
+	case "/api/v1/pipeline/apply":
+		handlePipelineApply(w, r, u, params)
+	case "/project/retries":
+		handleProjectRetries(w, r, u, params)
+	case "/project/retries/set":
+		handleProjectRetriesSet(w, r, u, params)
+	case "/project/retries/delete":
+		handleProjectRetriesDelete(w, r, u, params)
+	case "/project/variants":
+		handleProjectVariants(w, r, u, params)
+	case "/project/variants/set":
+		handleProjectVariantsSet(w, r, u, params)
+	case "/project/variants/delete":
+		handleProjectVariantsDelete(w, r, u, params)
+	case "/project/history":
+		handleProjectHistory(w, r, u, params)
+	case "/project/stats":
+		handleProjectStats(w, r, u, params)
+	case "/project/snapshots":
+		handleProjectSnapshots(w, r, u, params)
+	case "/task/snapshot":
+		handleTaskSnapshot(w, r, u, params)
+	case "/task/shell":
+		handleTaskShell(w, r, u, params)
+	case "/task/shell/exec":
+		handleTaskShellExec(w, r, u, params)
+	case "/task/shell/stop":
+		handleTaskShellStop(w, r, u, params)
+	case "/project/terminal":
+		handleProjectTerminal(w, r, u, params)
+	case "/project/revision":
+		handleProjectRevision(w, r, u, params)
 	case "/task/logs":
 		handleTaskLogs(w, r, u, params)
+	case "/task/logs/segments":
+		handleTaskLogsSegments(w, r, u, params)
+	case "/task/logs/batch":
+		handleTaskLogsBatch(w, r, u, params)
 	case "/registry/create":
 		handleRegistryCreate(w, r, u, params)
+	case "/api/openapi.json":
+		handleAPIOpenAPI(w, r, u, params)
+	case "/api/docs":
+		handleAPIDocs(w, r, u, params)
 	default:
 		return false
 	}
@@ -890,75 +1838,177 @@ func handleAction(path string, w http.ResponseWriter, r *http.Request, u *user,
 func handleRoot(w http.ResponseWriter, r *http.Request) {
 	logger.Infof("%s %s %s", r.Method, r.RemoteAddr, r.URL.Path)
 	contentType := r.Header.Get("Content-Type")
+	u := user{"", []string{}}
+	if noLogin {
+		u.Name = "user"
+	}
+	cookie, _ := r.Cookie("RACS_TOKEN")
+	session := cookie != nil && unseal(cookie.Value, &u) == nil
+	if throttle(w, r, session) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, requestLimit(r.URL.Path, contentType))
 	params := make(map[string]string)
 	if strings.HasPrefix(contentType, "application/json") {
-		body, _ := ioutil.ReadAll(r.Body)
+		body, err := ioutil.ReadAll(r.Body)
+		if tooLarge(w, err) {
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
 		var j map[string]interface{}
-		json.Unmarshal(body, &j)
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&j); err != nil && len(bytes.TrimSpace(body)) > 0 {
+			// Webhooks read their own payloads.
+			if op := apiLookup(r.URL.Path, r.Method); op == nil || op.body != "application/json" {
+				writeError(w, badRequest("Invalid JSON body: %v", err))
+				return
+			}
+		}
 		for name, value := range j {
-			params[name] = fmt.Sprint(value)
+			switch value.(type) {
+			case nil:
+				params[name] = ""
+			case string, json.Number, bool:
+				params[name] = fmt.Sprint(value)
+			default:
+				nested, _ := json.Marshal(value)
+				params[name] = string(nested)
+			}
 		}
 	} else if strings.HasPrefix(contentType, "multipart/form-data") {
-		r.ParseMultipartForm(10000000)
-		for name, values := range r.MultipartForm.Value {
-			params[name] = values[0]
+		if tooLarge(w, r.ParseMultipartForm(10000000)) {
+			return
+		}
+		if r.MultipartForm != nil {
+			for name, values := range r.MultipartForm.Value {
+				params[name] = values[0]
+			}
 		}
 	} else {
-		r.ParseForm()
+		if tooLarge(w, r.ParseForm()) {
+			return
+		}
 		for name, values := range r.Form {
 			params[name] = values[0]
 		}
 	}
-	u := user{"", []string{}}
-	if noLogin {
-		u.Name = "user"
+	path := r.URL.Path
+	if match := badgePath.FindStringSubmatch(path); match != nil {
+		params["id"] = match[1]
+		path = "/project/badge"
 	}
-	cookie, err := r.Cookie("RACS_TOKEN")
-	if cookie != nil {
-		b, _ := hex.DecodeString(cookie.Value)
-		gcm, _ := cipher.NewGCM(ciph)
-		nonceSize := gcm.NonceSize()
-		nonce, in := b[:nonceSize], b[nonceSize:]
-		de, _ := gcm.Open(nil, nonce, in, nil)
-		json.Unmarshal(de, &u)
+	if setupRefuse(w, r, path, session) {
+		return
 	}
-	path := r.URL.Path
-	if handleAction(path, w, r, &u, params) {
+	if op := apiLookup(path, r.Method); op != nil {
+		if err := apiValidate(op, r, params); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if maintenanceRefuse(w, path) {
 		return
 	}
-	if path == "/" {
-		path = "/index.xhtml"
-	}
-	switch filepath.Ext(path) {
-	case ".xhtml":
-		contentType = "application/xhtml+xml"
-	case ".js":
-		contentType = "text/javascript"
-	case ".css":
-		contentType = "text/css"
-	case ".ico":
-		contentType = "image/png"
-	default:
-		contentType = ""
+	if auditActions[path] && (r.Method != "GET" || path != "/project/spec") {
+		sw := &statusWriter{w, 200}
+		handleAction(path, sw, r, &u, params)
+		auditRecord(path, r, &u, params, sw.status)
+		return
 	}
-	content, err := loadStatic(path)
-	if err != nil {
-		w.WriteHeader(404)
-		w.Write([]byte("Not found"))
-	} else {
-		w.Header().Add("Content-Type", contentType)
-		w.Write(content)
+	if handleAction(path, w, r, &u, params) {
+		return
 	}
+	serveStatic(w, r, path)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "update" {
+		mainUpdate(os.Args[2:])
+		return
+	}
+	if len(os.Args) == 2 && os.Args[1] == "-version" {
+		fmt.Println(racsVersion)
+		return
+	}
 	var sslCert, sslKey string
+	var dirModeValue, fileModeValue, group string
+	var storageKind string
+	s3 := &s3Storage{}
 	var port int
 	flag.StringVar(&sslCert, "ssl-cert", "", "SSL cert")
 	flag.StringVar(&sslKey, "ssl-key", "", "SSL key")
 	flag.BoolVar(&noLogin, "no-login", false, "Allow all actions without login")
 	flag.IntVar(&port, "port", 8080, "Web server port")
+	flag.IntVar(&updateInterval, "update-interval", 0, "Hours between checks for base image and tool updates in container specs (0 to disable)")
+	flag.BoolVar(&updateTrial, "update-trial", false, "Build proposed container spec updates before they are accepted")
+	flag.StringVar(&publicURL, "url", "", "External URL of racs, for links from commit statuses")
+	flag.StringVar(&githubToken, "github-token", "", "GitHub token for reporting commit statuses")
+	flag.StringVar(&gitlabToken, "gitlab-token", "", "GitLab token for reporting commit statuses")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "OIDC provider for single sign-on, e.g. https://accounts.example.com")
+	flag.StringVar(&oidcClientID, "oidc-client-id", "", "OIDC client ID")
+	flag.StringVar(&oidcClientSecret, "oidc-client-secret", "", "OIDC client secret")
+	flag.StringVar(&oidcScopes, "oidc-scopes", "openid profile email", "OIDC scopes to request")
+	flag.StringVar(&oidcGroupsClaim, "oidc-groups-claim", "groups", "ID token claim with the user's groups")
+	flag.StringVar(&ldapURL, "ldap-url", "", "LDAP server for logins, e.g. ldaps://ldap.example.com")
+	flag.StringVar(&ldapUserDN, "ldap-user-dn", "", "DN of LDAP users, with %s for the user name, e.g. uid=%s,ou=people,dc=example,dc=com")
+	flag.StringVar(&ldapGroupAttribute, "ldap-group-attribute", "memberOf", "LDAP attribute with the user's groups")
+	flag.StringVar(&ssoRoles, "sso-roles", "", "Roles of OIDC and LDAP groups, e.g. racs-admins=admin,developers=user")
+	flag.IntVar(&rateLimit, "rate-limit", 0, "Requests per minute from each address without a login token (0 for no limit)")
+	flag.IntVar(&tokenRateLimit, "token-rate-limit", 0, "Requests per minute with each login token (0 for no limit)")
+	flag.Int64Var(&uploadLimit, "upload-limit", 100, "Maximum size of uploads in MB")
+	flag.Int64Var(&bodyLimit, "body-limit", 1, "Maximum size of JSON and other request bodies in MB")
+	flag.IntVar(&terminalTimeout, "terminal-timeout", 30, "Minutes before web terminals are closed")
+	flag.StringVar(&cosignKey, "cosign-key", "", "Default cosign key for projects that sign with a key (path or KMS URI)")
+	flag.BoolVar(&chaosEnabled, "chaos", false, "Enable failure injection endpoints (testing only)")
+	flag.StringVar(&dirModeValue, "dir-mode", "0755", "Permissions for created directories (octal)")
+	flag.StringVar(&fileModeValue, "file-mode", "0644", "Permissions for created files (octal)")
+	flag.BoolVar(&imagePrune, "prune-images", false, "Remove the images of deleted projects and dangling racs images every minute")
+	flag.IntVar(&diskMinimum, "disk-minimum", 1024, "MB of free space needed to start a stage that writes to the workspace or images (0 to disable)")
+	flag.StringVar(&group, "group", "", "Group owner for created directories and files")
+	flag.StringVar(&staticDir, "static-dir", "", "Serve the web UI from this directory instead of the files built in, for development")
+	flag.StringVar(&dbDriver, "db-driver", "sqlite3", "Database driver (sqlite3 or postgres)")
+	flag.StringVar(&dbSource, "db", "file:main.db?cache=shared", "Database connection string")
+	flag.StringVar(&storageKind, "storage", "local", "Storage for task logs and artifacts (local or s3)")
+	flag.StringVar(&s3.endpoint, "s3-endpoint", "https://s3.amazonaws.com", "S3 endpoint URL")
+	flag.StringVar(&s3.bucket, "s3-bucket", "", "S3 bucket")
+	flag.StringVar(&s3.region, "s3-region", "us-east-1", "S3 region")
+	flag.StringVar(&configPath, "config", "racs.conf", "File of NAME = VALUE lines for flags not given on the command line")
+	flag.StringVar(&dataDir, "data", "", "Directory for the database, projects, task logs and uploads (defaults to the current directory)")
+	flag.StringVar(&adminUser, "admin-user", "admin", "Name of the admin user created on first start")
+	flag.StringVar(&adminPassword, "admin-password", os.Getenv("RACS_ADMIN_PASSWORD"), "Password of the admin user created on first start, instead of using /setup")
 	flag.Parse()
+	if err := configLoad(configPath); err != nil {
+		logger.Fatal(err)
+	}
+	switch storageKind {
+	case "local":
+	case "s3":
+		s3.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if len(s3.bucket) == 0 {
+			logger.Fatal("No S3 bucket")
+		}
+		store = s3
+	default:
+		logger.Fatalf("Unknown storage %s", storageKind)
+	}
+	if len(oidcIssuer) > 0 && len(publicURL) == 0 {
+		logger.Fatal("OIDC needs -url for the login callback")
+	}
+	if len(ldapURL) > 0 && !strings.Contains(ldapUserDN, "%s") {
+		logger.Fatalf("LDAP needs an -ldap-user-dn with %%s for the user name")
+	}
+	uploadLimit *= 1024 * 1024
+	bodyLimit *= 1024 * 1024
+	parseMode(dirModeValue, &dirMode)
+	parseMode(fileModeValue, &fileMode)
+	parseGroup(group)
+	if len(dataDir) > 0 {
+		if err := dataUse(dataDir); err != nil {
+			logger.Fatal(err)
+		}
+	}
 
 	key := make([]byte, 32)
 	rand.Read(key)
@@ -966,83 +2016,41 @@ func main() {
 
 	var err error
 
-	os.Mkdir("projects", 0777)
-	os.Mkdir("tasks", 0777)
-	os.Mkdir("uploads", 0777)
+	makeDir("projects")
+	makeDir("tasks")
+	makeDir("artifacts")
+	makeDir("templates")
+	os.Mkdir("uploads", 0700)
 	os.Setenv("GIT_TERMINAL_PROMPT", "0")
 
-	db, err = sql.Open("sqlite3", "file:main.db?cache=shared")
+	db, err = openDatabase(dbDriver, dbSource)
 	if err != nil {
 		logger.Fatal(err)
 	}
 	defer db.Close()
 	//db.SetMaxOpenConns(1)
 
-	stats := []string{
-		`CREATE TABLE IF NOT EXISTS users(
-			name STRING PRIMARY KEY,
-			passwd STRING,
-			salt STRING,
-			role STRING
-		)`,
-		`CREATE TABLE IF NOT EXISTS registries(
-			name STRING PRIMARY KEY,
-			url STRING,
-			user STRING,
-			password STRING
-		)`,
-		`CREATE TABLE IF NOT EXISTS projects(
-			id INTEGER PRIMARY KEY,
-			name STRING,
-			source STRING,
-			branch STRING,
-			destination STRING,
-			tag STRING,
-			buildSpec STRING,
-			packageSpec STRING,
-			state STRING,
-			version INTEGER
-		)`,
-		`ALTER TABLE projects ADD COLUMN buildHash BLOB`,
-		`ALTER TABLE projects ADD COLUMN labels STRING`,
-		`CREATE TABLE IF NOT EXISTS tasks(
-			id INTEGER PRIMARY KEY,
-			project INTEGER,
-			type STRING,
-			state STRING,
-			time STRING
-		)`,
-		`CREATE TABLE IF NOT EXISTS members(
-			project INTEGER,
-			user STRING,
-			role STRING
-		)`,
-		`CREATE TABLE IF NOT EXISTS triggers(
-			project INTEGER,
-			target INTEGER,
-			state STRING
-		)`,
-	}
-
-	for _, stat := range stats {
-		db.Exec(stat)
-	}
+	migrate()
+	setupStart()
 
 	states := make(map[string]state)
-	for state := DELETING; state <= PUSH_SUCCESS; state += 1 {
+	for state := DELETING; state <= DISK_FULL; state += 1 {
 		states[state.String()] = state
 	}
 
-	rows, err := db.Query(`SELECT name, url, user, password FROM registries`)
+	rows, err := db.Query(`SELECT name, url, user, password, IFNULL(provider, '') FROM registries`)
 	for rows.Next() {
 		var name string
 		var url string
 		var user string
 		var password string
-		rows.Scan(&name, &url, &user, &password)
-		registries[name] = &registry{name, url, user, password, time.Unix(0, 0)}
+		var provider string
+		rows.Scan(&name, &url, &user, &password, &provider)
+		registries[name] = &registry{name, url, user, password, time.Unix(0, 0), provider}
 	}
-	rows, err = db.Query(`SELECT id, name, labels, source, branch, destination, tag, buildSpec, packageSpec, buildHash, state, version FROM projects`)
+	labels := labelsAll()
+	rows, err = db.Query(`SELECT id, name, source, branch, destination, tag, buildSpec, packageSpec, IFNULL(caches, ''), buildHash, state, version, IFNULL(poll, 0), IFNULL(head, ''), IFNULL(hold, FALSE), IFNULL(testSpec, ''), IFNULL(testReport, ''), IFNULL(artifacts, ''),
+		IFNULL(cpus, ''), IFNULL(memory, ''), IFNULL(diskQuota, 0), IFNULL(scanner, ''), IFNULL(scanFail, ''), IFNULL(signing, ''), IFNULL(sbom, ''), IFNULL(sbomAttach, FALSE), IFNULL(tagPattern, ''), IFNULL(pathFilter, ''), IFNULL(snapshot, FALSE), IFNULL(sourceKind, '') FROM projects`)
 	for rows.Next() {
 		var id int
 		var name string
@@ -1052,37 +2060,95 @@ func main() {
 		var tag string
 		var buildSpec string
 		var packageSpec string
+		var caches string
 		var buildHash []byte
-		var labels string
 		var stateName string
 		var version int
-		rows.Scan(&id, &name, &labels, &source, &branch, &destination, &tag, &buildSpec, &packageSpec, &buildHash, &stateName, &version)
+		var poll int
+		var head string
+		var hold bool
+		var testSpec string
+		var testReport string
+		var artifacts string
+		var cpus string
+		var memory string
+		var diskQuota int
+		var scanner string
+		var scanFail string
+		var signing string
+		var sbom string
+		var sbomAttach bool
+		var tagPattern string
+		var pathFilter string
+		var snapshot bool
+		var sourceKind string
+		rows.Scan(&id, &name, &source, &branch, &destination, &tag, &buildSpec, &packageSpec, &caches, &buildHash, &stateName, &version, &poll, &head, &hold,
+			&testSpec, &testReport, &artifacts, &cpus, &memory, &diskQuota, &scanner, &scanFail, &signing, &sbom, &sbomAttach, &tagPattern, &pathFilter, &snapshot, &sourceKind)
 		p := &project{
-			id, name, labels, source, branch, destination, tag, buildSpec, packageSpec, buildHash,
+			id, name, strings.Join(labels[id], ","), source, branch, destination, tag, buildSpec, packageSpec, caches, buildHash,
 			states[stateName], version,
 			make([]*task, 0),
 			make(chan taskRequest, 10),
 			make(map[*project]state),
 			nil, nil,
+			make(map[string]*variable),
+			poll, head, time.Unix(0, 0),
+			hold,
+			testSpec, testReport,
+			artifacts,
+			cpus, memory, diskQuota,
+			scanner, scanFail,
+			signing,
+			sbom, sbomAttach,
+			tagPattern,
+			pathFilter,
+			snapshot,
+			sourceKind,
+			sync.RWMutex{},
 		}
+		projectsLock.Lock()
 		projects[p.id] = p
+		projectsLock.Unlock()
 		go projectRoutine(p)
 	}
-	rows, err = db.Query(`SELECT project, id, type, state, time FROM tasks ORDER BY id`)
+	rows, err = db.Query(`SELECT project, id, type, state, time, IFNULL(revision, 0), IFNULL(attempt, 0), IFNULL(finished, ''),
+		IFNULL(duration, 0), IFNULL(exitCode, -1) FROM tasks ORDER BY id`)
 	for rows.Next() {
 		var pid int
 		var id int
 		var kind string
 		var state string
 		var time string
-		rows.Scan(&pid, &id, &kind, &state, &time)
-		p := projects[pid]
+		var revision int
+		var attempt int
+		var finished string
+		var duration float64
+		var exitCode int
+		rows.Scan(&pid, &id, &kind, &state, &time, &revision, &attempt, &finished, &duration, &exitCode)
+		p := projectGet(pid)
 		if p != nil {
-			p.tasks = append(p.tasks, &task{id, kind, state, time})
-			if len(p.tasks) > 5 {
-				p.tasks = p.tasks[1:]
+			p.addTask(&task{id, kind, state, time, revision, make(map[string]string), attempt, finished, duration, exitCode})
+		}
+	}
+	for _, p := range projectAll() {
+		metadata := taskMetadata(p.id)
+		p.lock.Lock()
+		for _, t := range p.tasks {
+			if metadata[t.id] != nil {
+				t.metadata = metadata[t.id]
 			}
 		}
+		p.lock.Unlock()
+	}
+	rows, err = db.Query(`SELECT project, name, value, kind, secret FROM variables`)
+	for rows.Next() {
+		var pid int
+		var v variable
+		rows.Scan(&pid, &v.name, &v.value, &v.kind, &v.secret)
+		p := projectGet(pid)
+		if p != nil {
+			p.setVariable(&v)
+		}
 	}
 	rows, err = db.Query(`SELECT project, target, state FROM triggers`)
 	for rows.Next() {
@@ -1090,18 +2156,29 @@ func main() {
 		var tid int
 		var stateName string
 		rows.Scan(&pid, &tid, &stateName)
-		p := projects[pid]
-		t := projects[tid]
+		p := projectGet(pid)
+		t := projectGet(tid)
 		if p != nil && t != nil {
-			p.triggers[t] = states[stateName]
-			switch states[stateName] {
-			case PREPARING:
-				t.prepareDep = p
-			case PACKAGING:
-				t.packageDep = p
-			}
+			projectsLock.Lock()
+			setTrigger(p, t, states[stateName])
+			projectsLock.Unlock()
 		}
 	}
+	rows.Close()
+	rows, err = db.Query(`SELECT project, upstream FROM afters`)
+	for rows.Next() {
+		var pid int
+		var uid int
+		rows.Scan(&pid, &uid)
+		p := projectGet(pid)
+		upstream := projectGet(uid)
+		if p != nil && upstream != nil {
+			projectsLock.Lock()
+			setAfter(upstream, p)
+			projectsLock.Unlock()
+		}
+	}
+	rows.Close()
 
 	go func() {
 		for {
@@ -1112,22 +2189,26 @@ func main() {
 				delete(clients.clients, client)
 			case event := <-clients.events:
 				for client, _ := range clients.clients {
-					client <- event
+					select {
+					case client <- event:
+					default:
+						// A client that cannot keep up is dropped; it reconnects and gets a fresh project/list.
+						logger.Warn("Dropping slow event client")
+						delete(clients.clients, client)
+						close(client)
+					}
 				}
 			}
 		}
 	}()
 
-	go func() {
-		for {
-			logger.Info("Pruning images")
-			err := exec.Command("podman", "image", "prune", "-f", "--filter", "until=5m").Run()
-			if err != nil {
-				logger.Error(err)
-			}
-			time.Sleep(60 * time.Second)
-		}
-	}()
+	go pollRoutine()
+	go reapRoutine()
+	go proposalRoutine()
+
+	if imagePrune {
+		go pruneRoutine()
+	}
 
 	http.HandleFunc("/", handleRoot)
 	endpoint := fmt.Sprintf(":%d", port)
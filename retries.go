@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func taskRetry(p *project, request taskRequest) bool {
+	stage := stageName(request.state)
+	var count, backoff int
+	err := db.QueryRow(`SELECT count, backoff FROM retries WHERE project = ? AND stage = ?`, p.id, stage).Scan(&count, &backoff)
+	if err != nil || request.attempt >= count {
+		return false
+	}
+	delay := time.Duration(backoff) * time.Second << uint(request.attempt)
+	request.attempt += 1
+	logger.Infof("Project %d retrying %s in %v (attempt %d of %d)", p.id, request.state.String(), delay, request.attempt+1, count+1)
+	go func() {
+		time.Sleep(delay)
+		p.enqueue(request)
+	}()
+	return true
+}
+
+func handleProjectRetries(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	rows, err := db.Query(`SELECT stage, count, backoff FROM retries WHERE project = ? ORDER BY stage`, id)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var stage string
+		var count int
+		var backoff int
+		rows.Scan(&stage, &count, &backoff)
+		result = append(result, map[string]interface{}{
+			"stage":   stage,
+			"count":   count,
+			"backoff": backoff,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectRetriesSet(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/retries/set", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	stage := params["stage"]
+	count, err := strconv.Atoi(params["count"])
+	backoff, _ := strconv.Atoi(params["backoff"])
+	if len(params["backoff"]) == 0 {
+		backoff = 10
+	}
+	if p == nil {
+		writeError(w, notFound("Project"))
+	} else if _, ok := stageStates[stage]; !ok {
+		writeError(w, invalidParam("stage", "Unknown stage %s", stage))
+	} else if err != nil || count < 0 || count > 10 {
+		writeError(w, invalidParam("count", "count must be from 0 to 10"))
+	} else if backoff < 0 {
+		writeError(w, invalidParam("backoff", "backoff can't be negative"))
+	} else {
+		db.Exec(`REPLACE INTO retries(project, stage, count, backoff) VALUES(?, ?, ?, ?)`, p.id, stage, count, backoff)
+		projectRevise(p, u.Name)
+		redirect := params["redirect"]
+		if len(redirect) > 0 {
+			w.Header().Add("Location", redirect)
+			w.WriteHeader(303)
+		} else {
+			w.WriteHeader(200)
+			w.Write([]byte("OK"))
+		}
+	}
+}
+
+func handleProjectRetriesDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/retries/delete", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	db.Exec(`DELETE FROM retries WHERE project = ? AND stage = ?`, p.id, params["stage"])
+	projectRevise(p, u.Name)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func retryConfig(pid int, config map[string]string) {
+	rows, err := db.Query(`SELECT stage, count, backoff FROM retries WHERE project = ?`, pid)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stage string
+		var count int
+		var backoff int
+		rows.Scan(&stage, &count, &backoff)
+		config["retry:"+stage] = strconv.Itoa(count) + " " + strconv.Itoa(backoff)
+	}
+}
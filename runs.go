@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var runOrder = []state{CLEANING, CLONING, PREPARING, PULLING, BUILDING, TESTING, PACKAGING, SCANNING, PUSHING}
+
+// runStages parses run=full|from:STAGE|only:STAGE into the first stage to run and the last, NONE to run to the end.
+func runStages(p *project, run string) (state, state, error) {
+	if run == "" || run == "full" {
+		return CLEANING, NONE, nil
+	}
+	parts := strings.SplitN(run, ":", 2)
+	if len(parts) != 2 {
+		return NONE, NONE, fmt.Errorf("run must be full, from:STAGE or only:STAGE")
+	}
+	mode := parts[0]
+	stage, known := stageStates[parts[1]]
+	if !known || (mode != "from" && mode != "only") {
+		return NONE, NONE, fmt.Errorf("run must be full, from:STAGE or only:STAGE")
+	}
+	p.lock.RLock()
+	testSpec, scanner := p.testSpec, p.scanner
+	p.lock.RUnlock()
+	if stage == TESTING && len(testSpec) == 0 {
+		return NONE, NONE, fmt.Errorf("project has no test spec")
+	}
+	if stage == SCANNING && len(scanner) == 0 {
+		return NONE, NONE, fmt.Errorf("project has no scanner")
+	}
+	if mode == "only" {
+		return stage, stage, nil
+	}
+	return stage, NONE, nil
+}
+
+func runPlan(p *project, first, last state) []string {
+	p.lock.RLock()
+	testSpec, scanner := p.testSpec, p.scanner
+	p.lock.RUnlock()
+	stages := make([]string, 0)
+	started := false
+	for _, stage := range runOrder {
+		if stage == first {
+			started = true
+		}
+		if !started || (stage == TESTING && len(testSpec) == 0) || (stage == SCANNING && len(scanner) == 0) {
+			continue
+		}
+		stages = append(stages, stage.String())
+		if stage == last {
+			break
+		}
+	}
+	return stages
+}
+
+func runFinish(p *project, build int, result string) {
+	if build == 0 {
+		return
+	}
+	db.Exec(`UPDATE builds SET state = ?, finished = datetime('now') WHERE id = ? AND state = 'RUNNING'`, result, build)
+	if result == "SUCCESS" {
+		buildStatus(p, build, "success")
+	} else {
+		buildStatus(p, build, "failure")
+	}
+	previewFinish(p, build)
+	logger.Infof("Project %d build %d %s", p.id, build, result)
+	projectEvent(map[string]interface{}{
+		"event":   "build/state",
+		"project": p.id,
+		"id":      build,
+		"state":   result,
+	})
+}
+
+// runSettle finishes the request's build once the project has stopped without queueing its next stage.
+func runSettle(p *project, request taskRequest) {
+	switch {
+	case request.build == 0:
+	case p.state.failed() || p.state == APPROVAL_REJECTED:
+		runFinish(p, request.build, "ERROR")
+	case p.state == PUSH_SUCCESS:
+		runFinish(p, request.build, "SUCCESS")
+	}
+}
+
+var approvals = map[int]taskRequest{}
+var approvalLock sync.Mutex
+
+func approvalWait(p *project, request taskRequest) {
+	approvalLock.Lock()
+	defer approvalLock.Unlock()
+	approvals[p.id] = request
+}
+
+// approvalRequest continues the request that is waiting for approval, or the project's running build after a restart.
+func approvalRequest(p *project, state state) taskRequest {
+	approvalLock.Lock()
+	defer approvalLock.Unlock()
+	request, ok := approvals[p.id]
+	delete(approvals, p.id)
+	if !ok {
+		request = taskRequest{state, "", "", 0, runPending(p), NONE, "", ""}
+	}
+	request.state = state
+	request.attempt = 0
+	return request
+}
+
+func runCreate(p *project, run, author string) (int, error) {
+	var build int
+	err := db.QueryRow(`INSERT INTO builds(project, run, user, state, time) VALUES(?, ?, ?, 'RUNNING', datetime('now')) RETURNING id`,
+		p.id, run, author).Scan(&build)
+	return build, err
+}
+
+// runAuthor is who started a build, to record as the author of revisions found while it runs. Stages that aren't part
+// of a build are racs's own.
+func runAuthor(build int) string {
+	var author string
+	db.QueryRow(`SELECT IFNULL(user, '') FROM builds WHERE id = ?`, build).Scan(&author)
+	if len(author) == 0 {
+		return "racs"
+	}
+	return author
+}
+
+// runCommit records the commit a build pulled, and reports that it is being built once it is known.
+func runCommit(p *project, build int, t *task) {
+	if build == 0 {
+		return
+	}
+	var sha string
+	var previous string
+	db.QueryRow(`SELECT IFNULL(sha, '') FROM tasks WHERE id = ?`, t.id).Scan(&sha)
+	db.QueryRow(`SELECT IFNULL(sha, '') FROM builds WHERE id = ?`, build).Scan(&previous)
+	if len(sha) == 0 || sha == previous {
+		return
+	}
+	db.Exec(`UPDATE builds SET sha = ? WHERE id = ?`, sha, build)
+	buildStatus(p, build, "pending")
+}
+
+func runPending(p *project) int {
+	var build int
+	db.QueryRow(`SELECT id FROM builds WHERE project = ? AND state = 'RUNNING' ORDER BY id DESC LIMIT 1`, p.id).Scan(&build)
+	return build
+}
+
+func handleProjectRun(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	first, last, err := runStages(p, params["run"])
+	if err != nil {
+		writeError(w, badRequest("%v", err))
+		return
+	}
+	run := params["run"]
+	if len(run) == 0 {
+		run = "full"
+	}
+	if len(params["variants"]) > 0 {
+		runVariants(w, p, u, params, run)
+		return
+	}
+	build, err := runCreate(p, run, u.Name)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	stages := runPlan(p, first, last)
+	logger.Infof("Project %d build %d queued: %s", p.id, build, strings.Join(stages, ", "))
+	p.enqueue(taskRequest{first, "", params["labels"], 0, build, last, "", ""})
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(201)
+	j, _ := json.Marshal(map[string]interface{}{
+		"build":  build,
+		"stages": stages,
+	})
+	w.Write(j)
+}
+
+// runVariants builds each of the listed variants, with a build of its own so that their results are tracked separately.
+func runVariants(w http.ResponseWriter, p *project, u *user, params map[string]string, run string) {
+	if run != "full" {
+		writeError(w, invalidParam("run", "Variants can only be run in full"))
+		return
+	}
+	variants := make([]*variant, 0)
+	for _, name := range splitLabels(params["variants"]) {
+		v := projectVariant(p.id, name)
+		if v == nil {
+			writeError(w, invalidParam("variants", "Unknown variant %s", name))
+			return
+		}
+		variants = append(variants, v)
+	}
+	builds := make([]map[string]interface{}, 0)
+	for _, v := range variants {
+		build, err := variantCreate(p, v, u.Name, "", params["labels"], "")
+		if err != nil {
+			logger.Error(err)
+			writeError(w, err)
+			return
+		}
+		logger.Infof("Project %d build %d queued for variant %s", p.id, build, v.name)
+		builds = append(builds, map[string]interface{}{
+			"variant": v.name,
+			"build":   build,
+		})
+	}
+	p.lock.RLock()
+	testSpec, hold := p.testSpec, p.hold
+	p.lock.RUnlock()
+	stages := []string{PULLING.String(), PREPARING.String(), BUILDING.String()}
+	if len(testSpec) > 0 {
+		stages = append(stages, TESTING.String())
+	}
+	stages = append(stages, PACKAGING.String())
+	if !hold {
+		stages = append(stages, PUSHING.String())
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(201)
+	j, _ := json.Marshal(map[string]interface{}{
+		"builds": builds,
+		"stages": stages,
+	})
+	w.Write(j)
+}
+
+func handleProjectBuildStatus(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	build, _ := strconv.Atoi(params["build"])
+	var pid int
+	var run string
+	var author string
+	var state string
+	var time string
+	var finished string
+	var sha string
+	var digest string
+	var signature string
+	var variant string
+	err := db.QueryRow(`SELECT project, run, user, state, time, IFNULL(finished, ''), IFNULL(sha, ''), IFNULL(digest, ''), IFNULL(signature, ''), IFNULL(variant, '') FROM builds WHERE id = ?`, build).
+		Scan(&pid, &run, &author, &state, &time, &finished, &sha, &digest, &signature, &variant)
+	if err != nil {
+		writeError(w, notFound("Build"))
+		return
+	}
+	tasks := make([]map[string]interface{}, 0)
+	rows, err := db.Query(`SELECT id, type, state, time, IFNULL(attempt, 0), IFNULL(finished, ''), IFNULL(duration, 0), IFNULL(exitCode, -1)
+		FROM tasks WHERE build = ? ORDER BY id`, build)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			var kind string
+			var taskState string
+			var taskTime string
+			var attempt int
+			var taskFinished string
+			var duration float64
+			var exitCode int
+			rows.Scan(&id, &kind, &taskState, &taskTime, &attempt, &taskFinished, &duration, &exitCode)
+			tasks = append(tasks, map[string]interface{}{
+				"id":       id,
+				"type":     kind,
+				"state":    taskState,
+				"time":     taskTime,
+				"started":  taskTime,
+				"finished": taskFinished,
+				"duration": duration,
+				"exitCode": exitCode,
+				"attempt":  attempt,
+			})
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"build":     build,
+		"project":   pid,
+		"run":       run,
+		"user":      author,
+		"state":     state,
+		"time":      time,
+		"finished":  finished,
+		"sha":       sha,
+		"digest":    digest,
+		"signature": signature,
+		"variant":   variant,
+		"tasks":     tasks,
+	})
+	w.Write(j)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+type sbomFormat struct {
+	syft  string
+	path  string
+	media string
+}
+
+var sbomFormats = map[string]sbomFormat{
+	"cyclonedx": {"cyclonedx-json", "sbom.cdx.json", "application/vnd.cyclonedx+json"},
+	"spdx":      {"spdx-json", "sbom.spdx.json", "application/spdx+json"},
+}
+
+func validSBOM(params map[string]string) bool {
+	format := strings.ToLower(strings.TrimSpace(params["sbom"]))
+	_, ok := sbomFormats[format]
+	return len(format) == 0 || ok
+}
+
+// sbomFile is the SBOM of the last packaged image, kept until it is attached when the image is pushed.
+func sbomFile(p *project) string {
+	return fmt.Sprintf("%s/%d/sbom.json", projectAbs, p.id)
+}
+
+func sbomCollect(p *project, t *task) {
+	p.lock.RLock()
+	format, ok := sbomFormats[p.sbom]
+	version := p.version + 1
+	p.lock.RUnlock()
+	if !ok {
+		return
+	}
+	output, err := exec.Command("syft", fmt.Sprintf("podman:project-%d", p.id), "-q", "-o", format.syft+"="+sbomFile(p)).CombinedOutput()
+	if err != nil {
+		logger.Warnf("Project %d SBOM failed: %v %s", p.id, err, output)
+		return
+	}
+	artifactDelete(p.id, `project = ? AND version = ? AND path = ?`, p.id, version, format.path)
+	size, sum, err := storeArtifact(sbomFile(p), artifactKey(p.id, version, format.path))
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	db.Exec(`INSERT INTO artifacts(project, version, task, path, size, sha256, time) VALUES(?, ?, ?, ?, ?, ?, datetime('now'))`,
+		p.id, version, t.id, format.path, size, sum)
+	logger.Infof("Project %d stored %s for version %d", p.id, format.path, version)
+}
+
+// sbomAttach attaches the SBOM to a pushed image as an OCI referrer.
+func sbomAttach(p *project, image string, out io.Writer) error {
+	p.lock.RLock()
+	format := sbomFormats[p.sbom]
+	destination := p.destination
+	p.lock.RUnlock()
+	toolLogin("oras", destination)
+	cmd := exec.Command("oras", "attach", "--artifact-type", format.media, image, sbomFile(p)+":"+format.media)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	fmt.Fprintf(out, "\u001B[1m%s\u001B[0m\n", cmd.String())
+	return cmd.Run()
+}
+
+func handleProjectSBOM(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	query := `SELECT version, path FROM artifacts WHERE project = ? AND path IN (?, ?) ORDER BY version DESC LIMIT 1`
+	args := []interface{}{id, sbomFormats["cyclonedx"].path, sbomFormats["spdx"].path}
+	if len(params["version"]) > 0 {
+		version, _ := strconv.Atoi(params["version"])
+		query = `SELECT version, path FROM artifacts WHERE project = ? AND path IN (?, ?) AND version = ? LIMIT 1`
+		args = append(args, version)
+	}
+	var version int
+	var path string
+	err := db.QueryRow(query, args...).Scan(&version, &path)
+	if err != nil {
+		writeError(w, notFound("SBOM"))
+		return
+	}
+	handleProjectArtifactsDownload(w, r, u, map[string]string{
+		"id":      strconv.Itoa(id),
+		"version": strconv.Itoa(version),
+		"path":    path,
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var scanSeverities = []string{"CRITICAL", "HIGH", "MEDIUM", "LOW", "UNKNOWN"}
+
+type scanFinding struct {
+	id        string
+	pkg       string
+	installed string
+	fixed     string
+	severity  string
+	title     string
+}
+
+type trivyReport struct {
+	Results []struct {
+		Vulnerabilities []struct {
+			VulnerabilityID  string
+			PkgName          string
+			InstalledVersion string
+			FixedVersion     string
+			Severity         string
+			Title            string
+		}
+	}
+}
+
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			ID          string
+			Severity    string
+			Description string
+			Fix         struct {
+				Versions []string
+			}
+		}
+		Artifact struct {
+			Name    string
+			Version string
+		}
+	}
+}
+
+func validScan(params map[string]string) bool {
+	switch strings.ToLower(strings.TrimSpace(params["scanner"])) {
+	case "", "trivy", "grype":
+	default:
+		return false
+	}
+	fail := strings.ToUpper(strings.TrimSpace(params["scanFail"]))
+	return len(fail) == 0 || scanRank(fail) < len(scanSeverities)-1
+}
+
+func scanRank(severity string) int {
+	for i, s := range scanSeverities {
+		if s == severity {
+			return i
+		}
+	}
+	return len(scanSeverities) - 1
+}
+
+func scanSeverity(severity string) string {
+	severity = strings.ToUpper(severity)
+	if severity == "NEGLIGIBLE" {
+		return "LOW"
+	}
+	return scanSeverities[scanRank(severity)]
+}
+
+func scanReport(p *project) string {
+	return fmt.Sprintf("%s/%d/scan.json", projectAbs, p.id)
+}
+
+func scanCommand(p *project) (string, []string) {
+	image := fmt.Sprintf("project-%d", p.id)
+	if p.scanner == "grype" {
+		return "grype", []string{"podman:" + image, "-o", "json", "--file", scanReport(p)}
+	}
+	return "trivy", []string{"image", "--image-src", "podman", "--format", "json", "--output", scanReport(p), image}
+}
+
+func parseScan(scanner string, content []byte) ([]scanFinding, error) {
+	findings := make([]scanFinding, 0)
+	if scanner == "grype" {
+		var report grypeReport
+		if err := json.Unmarshal(content, &report); err != nil {
+			return nil, err
+		}
+		for _, match := range report.Matches {
+			v := match.Vulnerability
+			findings = append(findings, scanFinding{v.ID, match.Artifact.Name, match.Artifact.Version,
+				strings.Join(v.Fix.Versions, ", "), scanSeverity(v.Severity), v.Description})
+		}
+		return findings, nil
+	}
+	var report trivyReport
+	if err := json.Unmarshal(content, &report); err != nil {
+		return nil, err
+	}
+	for _, result := range report.Results {
+		for _, v := range result.Vulnerabilities {
+			findings = append(findings, scanFinding{v.VulnerabilityID, v.PkgName, v.InstalledVersion,
+				v.FixedVersion, scanSeverity(v.Severity), v.Title})
+		}
+	}
+	return findings, nil
+}
+
+func scanCounts(findings []scanFinding) map[string]int {
+	counts := make(map[string]int)
+	for _, severity := range scanSeverities {
+		counts[strings.ToLower(severity)] = 0
+	}
+	for _, finding := range findings {
+		counts[strings.ToLower(finding.severity)] += 1
+	}
+	return counts
+}
+
+// scanRun runs the project's scanner on its packaged image, failing if any finding is at or above the scanFail severity.
+func scanRun(p *project, command string, args []string, out io.Writer) error {
+	p.lock.RLock()
+	scanner, scanFail := p.scanner, p.scanFail
+	p.lock.RUnlock()
+	os.Remove(scanReport(p))
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(scanReport(p))
+	if err != nil {
+		return err
+	}
+	findings, err := parseScan(scanner, content)
+	if err != nil {
+		return err
+	}
+	counts := scanCounts(findings)
+	fmt.Fprintf(out, "%d vulnerabilities: %d critical, %d high, %d medium, %d low, %d unknown\n",
+		len(findings), counts["critical"], counts["high"], counts["medium"], counts["low"], counts["unknown"])
+	if len(scanFail) == 0 {
+		return nil
+	}
+	blocking := 0
+	for _, finding := range findings {
+		if scanRank(finding.severity) <= scanRank(strings.ToUpper(scanFail)) {
+			blocking += 1
+		}
+	}
+	if blocking > 0 {
+		return fmt.Errorf("%d vulnerabilities at or above %s severity", blocking, strings.ToLower(scanFail))
+	}
+	return nil
+}
+
+func scanIngest(p *project, t *task) {
+	content, err := ioutil.ReadFile(scanReport(p))
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	p.lock.RLock()
+	scanner := p.scanner
+	p.lock.RUnlock()
+	findings, err := parseScan(scanner, content)
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	db.Exec(`UPDATE tasks SET version = ? WHERE id = ?`, p.version, t.id)
+	for _, finding := range findings {
+		db.Exec(`INSERT INTO vulnerabilities(task, project, id, package, installed, fixed, severity, title) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+			t.id, p.id, finding.id, finding.pkg, finding.installed, finding.fixed, finding.severity, finding.title)
+	}
+	logger.Infof("Task %d recorded %d vulnerabilities", t.id, len(findings))
+}
+
+func handleProjectScanResults(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	tid, _ := strconv.Atoi(params["task"])
+	if tid == 0 {
+		db.QueryRow(`SELECT IFNULL(MAX(id), 0) FROM tasks WHERE project = ? AND type = 'SCANNING'`, id).Scan(&tid)
+	}
+	var state string
+	var version int
+	var build int
+	err := db.QueryRow(`SELECT state, IFNULL(version, 0), IFNULL(build, 0) FROM tasks WHERE id = ? AND project = ? AND type = 'SCANNING'`, tid, id).
+		Scan(&state, &version, &build)
+	if err != nil {
+		writeError(w, notFound("Scan"))
+		return
+	}
+	rows, err := db.Query(`SELECT id, package, installed, fixed, severity, title FROM vulnerabilities WHERE task = ?`, tid)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	findings := make([]scanFinding, 0)
+	for rows.Next() {
+		var finding scanFinding
+		rows.Scan(&finding.id, &finding.pkg, &finding.installed, &finding.fixed, &finding.severity, &finding.title)
+		findings = append(findings, finding)
+	}
+	vulnerabilities := make([]interface{}, 0)
+	for _, severity := range scanSeverities {
+		for _, finding := range findings {
+			if finding.severity == severity {
+				vulnerabilities = append(vulnerabilities, map[string]interface{}{
+					"id":        finding.id,
+					"package":   finding.pkg,
+					"installed": finding.installed,
+					"fixed":     finding.fixed,
+					"severity":  finding.severity,
+					"title":     finding.title,
+				})
+			}
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"task":            tid,
+		"build":           build,
+		"version":         version,
+		"state":           state,
+		"counts":          scanCounts(findings),
+		"vulnerabilities": vulnerabilities,
+	})
+	w.Write(j)
+}
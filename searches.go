@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var searchFields = []string{"project", "label", "state", "branch", "from", "to", "limit"}
+
+func taskLabels(ids []int) map[int][]string {
+	result := make(map[int][]string)
+	if len(ids) == 0 {
+		return result
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.Query(`SELECT task, label FROM task_labels WHERE task IN (?`+strings.Repeat(", ?", len(ids)-1)+`) ORDER BY label`, args...)
+	if err != nil {
+		logger.Error(err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var label string
+		rows.Scan(&id, &label)
+		result[id] = append(result[id], label)
+	}
+	return result
+}
+
+func searchBuilds(params map[string]string) ([]map[string]interface{}, error) {
+	query := `SELECT id, project, type, state, time, IFNULL(branch, '') FROM tasks WHERE 1 = 1`
+	args := make([]interface{}, 0)
+	if len(params["project"]) > 0 {
+		id, _ := strconv.Atoi(params["project"])
+		query += ` AND project = ?`
+		args = append(args, id)
+	}
+	if labels := splitLabels(params["label"]); len(labels) > 0 {
+		query += ` AND id IN (SELECT task FROM task_labels WHERE UPPER(label) IN (?` + strings.Repeat(", ?", len(labels)-1) + `))`
+		for _, label := range labels {
+			args = append(args, strings.ToUpper(label))
+		}
+	}
+	if len(params["state"]) > 0 {
+		query += ` AND state = ?`
+		args = append(args, strings.ToUpper(params["state"]))
+	}
+	if len(params["branch"]) > 0 {
+		query += ` AND branch = ?`
+		args = append(args, params["branch"])
+	}
+	if len(params["from"]) > 0 {
+		query += ` AND time >= ?`
+		args = append(args, params["from"])
+	}
+	if to := params["to"]; len(to) > 0 {
+		if len(to) == len("2006-01-02") {
+			to += " 23:59:59"
+		}
+		query += ` AND time <= ?`
+		args = append(args, to)
+	}
+	limit, _ := strconv.Atoi(params["limit"])
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]interface{}, 0)
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		var pid int
+		var kind string
+		var state string
+		var time string
+		var branch string
+		rows.Scan(&id, &pid, &kind, &state, &time, &branch)
+		name := ""
+		if p := projectGet(pid); p != nil {
+			name = p.currentName()
+		}
+		ids = append(ids, id)
+		result = append(result, map[string]interface{}{
+			"id":      id,
+			"project": pid,
+			"name":    name,
+			"type":    kind,
+			"state":   state,
+			"time":    time,
+			"branch":  branch,
+		})
+	}
+	rows.Close()
+	labels := taskLabels(ids)
+	for _, build := range result {
+		build["labels"] = labels[build["id"].(int)]
+		if build["labels"] == nil {
+			build["labels"] = []string{}
+		}
+	}
+	return result, nil
+}
+
+func writeSearch(w http.ResponseWriter, params map[string]string) {
+	result, err := searchBuilds(params)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleSearchBuilds(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	writeSearch(w, params)
+}
+
+func handleSearchSave(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/search/save", params) {
+		return
+	}
+	name := strings.TrimSpace(params["name"])
+	if len(name) == 0 {
+		writeError(w, invalidParam("name", "name is required"))
+		return
+	}
+	values := url.Values{}
+	for _, field := range searchFields {
+		if len(params[field]) > 0 {
+			values.Set(field, params[field])
+		}
+	}
+	db.Exec(`REPLACE INTO searches(name, user, query) VALUES(?, ?, ?)`, name, u.Name, values.Encode())
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleSearchSaved(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	rows, err := db.Query(`SELECT name, user, query FROM searches ORDER BY name`)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var name string
+		var owner string
+		var query string
+		rows.Scan(&name, &owner, &query)
+		filters := make(map[string]string)
+		values, _ := url.ParseQuery(query)
+		for field := range values {
+			filters[field] = values.Get(field)
+		}
+		result = append(result, map[string]interface{}{
+			"name":    name,
+			"user":    owner,
+			"filters": filters,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleSearchRun(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	var query string
+	err := db.QueryRow(`SELECT query FROM searches WHERE name = ?`, params["name"]).Scan(&query)
+	if err != nil {
+		writeError(w, notFound("Saved search"))
+		return
+	}
+	values, _ := url.ParseQuery(query)
+	filters := make(map[string]string)
+	for _, field := range searchFields {
+		filters[field] = values.Get(field)
+	}
+	writeSearch(w, filters)
+}
+
+func handleSearchDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/search/delete", params) {
+		return
+	}
+	db.Exec(`DELETE FROM searches WHERE name = ?`, params["name"])
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleTaskLabelsAdd(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/task/labels/add", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	existing := taskLabels([]int{id})[id]
+	for _, label := range splitLabels(params["label"]) {
+		if !containsFold(existing, label) {
+			db.Exec(`INSERT INTO task_labels(task, label) VALUES(?, ?)`, id, label)
+			existing = append(existing, label)
+		}
+	}
+	w.WriteHeader(200)
+	w.Write([]byte(strings.Join(existing, ",")))
+}
+
+func handleTaskLabelsRemove(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/task/labels/remove", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	for _, label := range splitLabels(params["label"]) {
+		db.Exec(`DELETE FROM task_labels WHERE task = ? AND UPPER(label) = ?`, id, strings.ToUpper(label))
+	}
+	w.WriteHeader(200)
+	w.Write([]byte(strings.Join(taskLabels([]int{id})[id], ",")))
+}
+
+func taskAnnotate(p *project, t *task, request taskRequest) {
+	state := request.state
+	// Variants are tagged with the version of the project's last build rather than a new one.
+	if state == PACKAGING && t.state == "SUCCESS" && len(request.variant) == 0 {
+		db.Exec(`UPDATE tasks SET version = ? WHERE id = ?`, p.version+1, t.id)
+	}
+	if state == CLEANING || state == DELETING {
+		return
+	}
+	revision, err := sourceFor(p).Revision(p, workspaceDir(p, request)+"/source")
+	if err == nil && len(revision) > 0 {
+		db.Exec(`UPDATE tasks SET sha = ? WHERE id = ?`, revision, t.id)
+	}
+}
+
+var shaPrefix = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+
+func tagVersion(p *project, q string) int {
+	p.lock.RLock()
+	tag, current := p.tag, p.version
+	p.lock.RUnlock()
+	if !strings.Contains(tag, "$VERSION") {
+		return 0
+	}
+	pattern := strings.Replace(regexp.QuoteMeta(tag), `\$VERSION`, `([0-9]+)`, -1)
+	patterns := []string{pattern}
+	if i := strings.LastIndex(pattern, ":"); i >= 0 {
+		patterns = append(patterns, pattern[i+1:])
+	}
+	for _, pattern := range patterns {
+		if match := regexp.MustCompile("^" + pattern + "$").FindStringSubmatch(q); match != nil {
+			version, _ := strconv.Atoi(match[1])
+			if version > 0 && version <= current {
+				return version
+			}
+		}
+	}
+	return 0
+}
+
+func searchTasks(query string, args ...interface{}) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0)
+	rows, err := db.Query(`SELECT id, project, type, state, time, IFNULL(sha, ''), IFNULL(version, 0) FROM tasks WHERE `+query+` ORDER BY id DESC LIMIT 20`, args...)
+	if err != nil {
+		logger.Error(err)
+		return result
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var pid int
+		var kind string
+		var state string
+		var time string
+		var sha string
+		var version int
+		rows.Scan(&id, &pid, &kind, &state, &time, &sha, &version)
+		build := map[string]interface{}{
+			"id":      id,
+			"project": pid,
+			"type":    kind,
+			"state":   state,
+			"time":    time,
+			"sha":     sha,
+		}
+		if version > 0 {
+			build["version"] = version
+		}
+		result = append(result, build)
+	}
+	return result
+}
+
+func handleSearch(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	q := strings.TrimSpace(params["q"])
+	result := make([]map[string]interface{}, 0)
+	if len(q) == 0 {
+		w.Header().Add("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+		return
+	}
+	lower := strings.ToLower(q)
+	for _, p := range projectAll() {
+		p.lock.RLock()
+		name, url, labels := p.name, p.url, p.labels
+		p.lock.RUnlock()
+		for _, field := range []struct{ name, value string }{{"name", name}, {"labels", labels}, {"url", url}} {
+			if strings.Contains(strings.ToLower(field.value), lower) {
+				result = append(result, map[string]interface{}{
+					"type":    "project",
+					"match":   field.name,
+					"project": p.id,
+					"name":    name,
+					"state":   p.currentState().String(),
+				})
+				break
+			}
+		}
+		if version := tagVersion(p, q); version > 0 {
+			tag := map[string]interface{}{
+				"type":    "tag",
+				"match":   "tag",
+				"project": p.id,
+				"name":    name,
+				"version": version,
+				"image":   projectImage(p, version),
+			}
+			if builds := searchTasks(`project = ? AND version = ?`, p.id, version); len(builds) > 0 {
+				tag["build"] = builds[0]
+			}
+			result = append(result, tag)
+		}
+	}
+	rows, err := db.Query(`SELECT DISTINCT project, version, image FROM deployments WHERE image = ? ORDER BY project, version`, q)
+	if err == nil {
+		for rows.Next() {
+			var pid int
+			var version int
+			var image string
+			rows.Scan(&pid, &version, &image)
+			result = append(result, map[string]interface{}{
+				"type":    "tag",
+				"match":   "deployment",
+				"project": pid,
+				"version": version,
+				"image":   image,
+			})
+		}
+		rows.Close()
+	}
+	builds := make([]map[string]interface{}, 0)
+	if shaPrefix.MatchString(q) {
+		for _, build := range searchTasks(`sha LIKE ?`, lower+"%") {
+			build["match"] = "sha"
+			builds = append(builds, build)
+		}
+	}
+	for _, build := range searchTasks(`id IN (SELECT task FROM task_labels WHERE UPPER(label) = ?)`, strings.ToUpper(q)) {
+		build["match"] = "label"
+		builds = append(builds, build)
+	}
+	for _, build := range builds {
+		build["type"] = "build"
+		if p := projectGet(build["project"].(int)); p != nil {
+			build["name"] = p.currentName()
+		}
+		result = append(result, build)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var configPath string
+var dataDir string
+var adminUser string
+var adminPassword string
+
+var userName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.@-]*$`)
+
+// setupToken is needed to finish setting up a server that has no users yet, so that only whoever can read its log can
+// become the first admin. It's empty once the server is set up.
+var setupToken string
+var setupLock sync.Mutex
+
+// configLoad sets the flags that weren't given on the command line from a file of NAME = VALUE lines.
+func configLoad(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s:%d: expected NAME = VALUE", path, line)
+		}
+		name := strings.TrimSpace(parts[0])
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, strings.TrimSpace(parts[1])); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// configWrite sets values in the config file, keeping its other lines.
+func configWrite(path string, values map[string]string) error {
+	lines := make([]string, 0)
+	if content, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			parts := strings.SplitN(line, "=", 2)
+			if _, ok := values[strings.TrimSpace(parts[0])]; ok && len(parts) == 2 {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	names := make([]string, 0)
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, name+" = "+values[name])
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// dataUse makes dir the working directory, where racs keeps its database, projects, task logs and uploads.
+func dataUse(dir string) error {
+	if len(staticDir) > 0 {
+		staticDir, _ = filepath.Abs(staticDir)
+	}
+	configPath, _ = filepath.Abs(configPath)
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	projectAbs, _ = filepath.Abs("projects")
+	return nil
+}
+
+// sqliteAbs makes the path of an SQLite database absolute, e.g. file:main.db?cache=shared.
+func sqliteAbs(source string) string {
+	prefix := ""
+	if strings.HasPrefix(source, "file:") {
+		prefix, source = "file:", strings.TrimPrefix(source, "file:")
+	}
+	parts := strings.SplitN(source, "?", 2)
+	parts[0], _ = filepath.Abs(parts[0])
+	return prefix + strings.Join(parts, "?")
+}
+
+func userCreate(name, password string, roles []string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`REPLACE INTO users(name, passwd, salt, role, provider) VALUES(?, ?, '', ?, 'local')`, name, string(hash), strings.Join(roles, ","))
+	return err
+}
+
+// userPassword checks the password of a user created by racs, which is false for users it doesn't have a password for.
+func userPassword(name, password string) (user, bool, error) {
+	var hash string
+	var roles string
+	err := db.QueryRow(`SELECT IFNULL(passwd, ''), IFNULL(role, '') FROM users WHERE name = ? AND provider = 'local'`, name).Scan(&hash, &roles)
+	if err != nil || len(hash) == 0 {
+		return user{}, false, nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return user{}, true, err
+	}
+	return user{name, strings.Split(roles, ",")}, true, nil
+}
+
+// setupStart creates the admin user from -admin-password when the server has no users yet and doesn't use single
+// sign-on, or opens /setup if it was also installed on an empty database.
+func setupStart() {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
+	// Single sign-on users are recorded when they first log in.
+	if count > 0 || noLogin || len(ldapURL) > 0 || len(oidcIssuer) > 0 {
+		return
+	}
+	var fresh bool
+	db.QueryRow(`SELECT COUNT(*) > 0 FROM installs WHERE fresh = 1`).Scan(&fresh)
+	if len(adminPassword) > 0 {
+		if err := userCreate(adminUser, adminPassword, []string{"admin", "user"}); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Infof("Created admin user %s", adminUser)
+		return
+	} else if !fresh {
+		// Upgraded servers log users in with PAM, which never records them.
+		return
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	setupLock.Lock()
+	setupToken = hex.EncodeToString(token)
+	setupLock.Unlock()
+	logger.Warnf("racs has no users, open %s/setup?token=%s to create the admin user", publicURL, setupToken)
+}
+
+func setupPending() bool {
+	setupLock.Lock()
+	defer setupLock.Unlock()
+	return len(setupToken) > 0
+}
+
+// setupRefuse sends the UI to /setup and refuses API requests until the server has been set up. Users PAM knows can
+// still log in and use it.
+func setupRefuse(w http.ResponseWriter, r *http.Request, path string, session bool) bool {
+	if path == "/setup" || path == "/setup/complete" || path == "/user/login" || session || !setupPending() {
+		return false
+	}
+	if path == "/" || path == "/index.xhtml" {
+		w.Header().Add("Location", "/setup")
+		w.WriteHeader(303)
+		return true
+	}
+	if apiLookup(path, r.Method) != nil {
+		writeError(w, statusError(503, "racs has not been set up, open /setup with the token from its log"))
+		return true
+	}
+	return false
+}
+
+func handleSetup(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if !setupPending() {
+		w.Header().Add("Location", "/")
+		w.WriteHeader(303)
+		return
+	}
+	setupTemplate, err := template.ParseFS(staticFS(), "setup.xhtml")
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	cwd, _ := os.Getwd()
+	w.Header().Add("Content-Type", "application/xhtml+xml")
+	err = setupTemplate.Execute(w, map[string]interface{}{
+		"token": params["token"],
+		"user":  adminUser,
+		"data":  cwd,
+		"url":   publicURL,
+	})
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+func handleSetupComplete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	setupLock.Lock()
+	defer setupLock.Unlock()
+	name := params["username"]
+	password := params["password"]
+	if len(setupToken) == 0 {
+		writeError(w, conflict("racs has already been set up"))
+		return
+	} else if !hmac.Equal([]byte(params["token"]), []byte(setupToken)) {
+		writeError(w, statusError(403, "The setup token is wrong, it is in racs's log"))
+		return
+	} else if !userName.MatchString(name) {
+		writeError(w, invalidParam("username", "username must be letters, digits, _, ., @ and -"))
+		return
+	} else if len(password) < 8 {
+		writeError(w, invalidParam("password", "password must be at least 8 characters"))
+		return
+	} else if len(params["registry"]) > 0 && len(params["registryURL"]) == 0 {
+		writeError(w, invalidParam("registryURL", "The registry needs a URL"))
+		return
+	}
+	config := make(map[string]string)
+	restart := false
+	if data := params["data"]; len(data) > 0 {
+		data, _ = filepath.Abs(data)
+		cwd, _ := os.Getwd()
+		if data != cwd && len(projectAll()) > 0 {
+			writeError(w, invalidParam("data", "The data directory can't be changed once there are projects"))
+			return
+		} else if data != cwd {
+			if err := os.MkdirAll(data, dirMode); err != nil {
+				writeError(w, invalidParam("data", "%v", err))
+				return
+			}
+			config["data"] = data
+			// The database stays where it is, so that the admin user is still there after the restart.
+			if dbDriver == "sqlite3" {
+				config["db"] = sqliteAbs(dbSource)
+			}
+			restart = true
+		}
+	}
+	if value := params["url"]; len(value) > 0 {
+		publicURL = strings.TrimSuffix(value, "/")
+		config["url"] = publicURL
+	}
+	if len(config) > 0 {
+		if err := configWrite(configPath, config); err != nil {
+			logger.Error(err)
+			writeError(w, err)
+			return
+		}
+	}
+	if err := userCreate(name, password, []string{"admin", "user"}); err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	if len(params["registry"]) > 0 {
+		registryCreate(params["registry"], params["registryURL"], params["registryUser"], params["registryPassword"], "")
+	}
+	setupToken = ""
+	logger.Infof("racs set up by %s", name)
+	sessionStart(w, user{name, []string{"admin", "user"}})
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(201)
+	j, _ := json.Marshal(map[string]interface{}{
+		"user":    name,
+		"config":  configPath,
+		"restart": restart,
+	})
+	w.Write(j)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var cosignKey string
+
+var variableKinds = map[string]bool{"env": true, "arg": true, "sign": true}
+
+func validSigning(params map[string]string) bool {
+	switch strings.ToLower(strings.TrimSpace(params["signing"])) {
+	case "", "key", "keyless":
+		return true
+	}
+	return false
+}
+
+func pushDigest(p *project) string {
+	return fmt.Sprintf("%s/%d/push.digest", projectAbs, p.id)
+}
+
+func pushSignature(p *project) string {
+	return fmt.Sprintf("%s/%d/push.signature", projectAbs, p.id)
+}
+
+// imageRepository strips the tag from an image reference, leaving the registry and repository.
+func imageRepository(image string) string {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
+
+// toolLogin logs a registry client other than podman into a registry with a user and password.
+func toolLogin(tool, name string) {
+	r := registries[name]
+	if r == nil || len(r.provider) > 0 || len(r.user) == 0 {
+		return
+	}
+	// The password is given on stdin rather than as an argument, where other users of the host could see it.
+	cmd := exec.Command(tool, "login", r.url, "-u", r.user, "--password-stdin")
+	cmd.Stdin = strings.NewReader(r.password)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logger.Warnf("%s login %s: %v %s", tool, r.url, err, out)
+	}
+}
+
+// pushImage pushes the package image, then signs the pushed digest and attaches the SBOM to it if the project asks for them.
+func pushImage(p *project, command string, args []string, image string, attach bool, out io.Writer) error {
+	os.Remove(pushSignature(p))
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	digest, err := ioutil.ReadFile(pushDigest(p))
+	if err != nil {
+		return err
+	}
+	pushed := imageRepository(image) + "@" + strings.TrimSpace(string(digest))
+	p.lock.RLock()
+	signing := p.signing
+	p.lock.RUnlock()
+	if len(signing) > 0 {
+		if err := signImage(p, pushed, out); err != nil {
+			return err
+		}
+	}
+	if attach {
+		return sbomAttach(p, pushed, out)
+	}
+	return nil
+}
+
+// signImage signs a pushed image with cosign, which pushes the signature to the same repository.
+func signImage(p *project, signed string, out io.Writer) error {
+	p.lock.RLock()
+	signing, destination := p.signing, p.destination
+	p.lock.RUnlock()
+	env := os.Environ()
+	key := cosignKey
+	for _, v := range p.variableList() {
+		if v.kind == "sign" {
+			env = append(env, v.name+"="+v.value)
+			if v.name == "COSIGN_PRIVATE_KEY" {
+				key = "env://COSIGN_PRIVATE_KEY"
+			}
+		}
+	}
+	sign := []string{"sign", "--yes"}
+	if signing == "key" {
+		if len(key) == 0 {
+			return fmt.Errorf("no signing key, set a COSIGN_PRIVATE_KEY sign variable or -cosign-key")
+		}
+		sign = append(sign, "--key", key)
+	}
+	sign = append(sign, signed)
+	toolLogin("cosign", destination)
+	cmd := exec.Command("cosign", sign...)
+	cmd.Env = env
+	cmd.Stdout = out
+	cmd.Stderr = out
+	fmt.Fprintf(out, "\u001B[1m%s\u001B[0m\n", cmd.String())
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	cmd = exec.Command("cosign", "triangulate", signed)
+	cmd.Env = env
+	signature, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Signature pushed to %s", signature)
+	return ioutil.WriteFile(pushSignature(p), signature, fileMode)
+}
+
+func pushRecord(p *project, t *task, build int) {
+	digest, err := ioutil.ReadFile(pushDigest(p))
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	p.lock.RLock()
+	signing := p.signing
+	p.lock.RUnlock()
+	signature := ""
+	if len(signing) > 0 {
+		content, _ := ioutil.ReadFile(pushSignature(p))
+		signature = strings.TrimSpace(string(content))
+	}
+	db.Exec(`UPDATE tasks SET digest = ?, signature = ? WHERE id = ?`, strings.TrimSpace(string(digest)), signature, t.id)
+	if build != 0 {
+		db.Exec(`UPDATE builds SET digest = ?, signature = ? WHERE id = ?`, strings.TrimSpace(string(digest)), signature, build)
+	}
+	logger.Infof("Task %d pushed %s %s", t.id, strings.TrimSpace(string(digest)), signature)
+}
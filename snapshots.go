@@ -0,0 +1,440 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const snapshotKeep = 5
+
+var debugShellTimeout = time.Hour
+
+var debugLock sync.Mutex
+var debugShells = make(map[int]time.Time)
+
+func snapshotKey(pid, tid int) string {
+	return fmt.Sprintf("snapshots/%d/%d.tar.gz", pid, tid)
+}
+
+func snapshotDelete(pid int, query string, args ...interface{}) {
+	rows, err := db.Query(`SELECT task FROM snapshots WHERE `+query, args...)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	tasks := make([]int, 0)
+	for rows.Next() {
+		var tid int
+		rows.Scan(&tid)
+		tasks = append(tasks, tid)
+	}
+	rows.Close()
+	for _, tid := range tasks {
+		if err := store.Delete(snapshotKey(pid, tid)); err != nil {
+			logger.Warn(err)
+		}
+	}
+	db.Exec(`DELETE FROM snapshots WHERE `+query, args...)
+}
+
+// snapshotWrite archives a workspace as a gzipped tar, keeping symlinks as links rather than following them.
+func snapshotWrite(workspace string, out io.Writer) error {
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(workspace, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(workspace, path)
+		if name == "." {
+			return nil
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, _ = os.Readlink(path)
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// snapshotCollect keeps the workspace of a failed build or package stage, and the project's last few snapshots.
+func snapshotCollect(p *project, t *task, workspace string) {
+	path := fmt.Sprintf("tasks/%d/snapshot.tar.gz", t.id)
+	out, err := createFile(path)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	err = snapshotWrite(workspace, out)
+	out.Close()
+	defer os.Remove(path)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	info, _ := os.Stat(path)
+	if err := store.Put(snapshotKey(p.id, t.id), path); err != nil {
+		logger.Error(err)
+		return
+	}
+	db.Exec(`INSERT INTO snapshots(task, project, stage, size, time) VALUES(?, ?, ?, ?, datetime('now'))`, t.id, p.id, t.kind, info.Size())
+	p.setMetadata(t, "snapshot", strconv.FormatInt(info.Size(), 10))
+	logger.Infof("Project %d kept a %d byte snapshot of task %d", p.id, info.Size(), t.id)
+	snapshotDelete(p.id, `project = ? AND task NOT IN (SELECT task FROM snapshots WHERE project = ? ORDER BY task DESC LIMIT ?)`,
+		p.id, p.id, snapshotKeep)
+}
+
+// archiveParents refuses a path whose existing parent directories, below target, include a symlink, which an earlier
+// entry could have made to write outside target.
+func archiveParents(target, path string) error {
+	rel, _ := filepath.Rel(target, filepath.Dir(path))
+	dir := target
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry %s is inside the symlink %s", path, dir)
+		}
+	}
+	return nil
+}
+
+// archiveExtract unpacks a tar or gzipped tar archive, refusing entries that would land outside the target directory
+// or be written through a symlink, and hard links to files outside it. Symlinks that point outside it are skipped.
+func archiveExtract(in io.Reader, target string) error {
+	target, _ = filepath.Abs(target)
+	buffered := bufio.NewReader(in)
+	var tr *tar.Reader
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		tr = tar.NewReader(gz)
+	} else {
+		tr = tar.NewReader(buffered)
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %s is outside %s", header.Name, target)
+		}
+		path := filepath.Join(target, name)
+		if err := archiveParents(target, path); err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			makeDir(path)
+		case tar.TypeSymlink:
+			link := header.Linkname
+			if !filepath.IsAbs(link) {
+				link = filepath.Join(filepath.Dir(path), link)
+			}
+			// Workspaces can hold links to the build container's own files, e.g. a virtualenv's python, which are
+			// left out rather than failing the whole archive.
+			if !withinDir(target, link) {
+				logger.Warnf("Skipped archive entry %s, it links to %s outside %s", header.Name, header.Linkname, target)
+				continue
+			}
+			makeDir(filepath.Dir(path))
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			link := filepath.Join(target, filepath.Clean(filepath.FromSlash(header.Linkname)))
+			if !withinDir(target, link) {
+				return fmt.Errorf("archive entry %s links to %s, outside %s", header.Name, header.Linkname, target)
+			}
+			if err := archiveParents(target, link); err != nil {
+				return err
+			}
+			if info, err := os.Lstat(link); err != nil || !info.Mode().IsRegular() {
+				return fmt.Errorf("archive entry %s links to %s, which isn't a file it has unpacked", header.Name, header.Linkname)
+			}
+			makeDir(filepath.Dir(path))
+			if err := os.Link(link, path); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			makeDir(filepath.Dir(path))
+			// A file replaces a symlink an earlier entry left at the same path, rather than being written through it.
+			if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				os.Remove(path)
+			}
+			out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func debugContainer(tid int) string {
+	return fmt.Sprintf("racs-debug-%d", tid)
+}
+
+func debugDir(p *project, tid int) string {
+	return fmt.Sprintf("%s/%d/debug/%d", projectAbs, p.id, tid)
+}
+
+// debugShell restores a snapshot and starts the project's builder image on it, with the snapshot mounted at /workspace
+// as the build stage sees it. The container is removed, and the restored workspace with it, when it times out.
+func debugShell(p *project, tid int) (time.Time, error) {
+	debugLock.Lock()
+	defer debugLock.Unlock()
+	if expires, ok := debugShells[tid]; ok {
+		return expires, nil
+	}
+	in, err := store.Open(snapshotKey(p.id, tid), 0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	dir := debugDir(p, tid)
+	root := fmt.Sprintf("%s/%d", projectAbs, p.id)
+	cleanPath(ioutil.Discard, dir, root)
+	makeDir(dir)
+	err = archiveExtract(in, dir)
+	in.Close()
+	if err != nil {
+		cleanPath(ioutil.Discard, dir, root)
+		return time.Time{}, err
+	}
+	args := []string{"run", "--rm=true", "--network=host", "--name", debugContainer(tid), "--label", "racs.debug=" + strconv.Itoa(tid),
+		"-v", dir + ":/workspace", "-w", "/workspace"}
+	p.lock.RLock()
+	args = append(args, p.limitArgs(true)...)
+	p.lock.RUnlock()
+	args = append(args, fmt.Sprintf("builder-%d", p.id), "sleep", strconv.Itoa(int(debugShellTimeout/time.Second)))
+	cmd := exec.Command("podman", args...)
+	if err := cmd.Start(); err != nil {
+		cleanPath(ioutil.Discard, dir, root)
+		return time.Time{}, err
+	}
+	expires := time.Now().Add(debugShellTimeout)
+	debugShells[tid] = expires
+	logger.Infof("Project %d started debug shell %s", p.id, debugContainer(tid))
+	go func() {
+		cmd.Wait()
+		debugLock.Lock()
+		delete(debugShells, tid)
+		debugLock.Unlock()
+		if err := cleanPath(ioutil.Discard, dir, root); err != nil {
+			logger.Warn(err)
+		}
+		logger.Infof("Project %d debug shell %s exited", p.id, debugContainer(tid))
+	}()
+	return expires, nil
+}
+
+// snapshotProject returns the project of a snapshotted task, or 0 if it has none.
+func snapshotProject(tid int) int {
+	var pid int
+	db.QueryRow(`SELECT project FROM snapshots WHERE task = ?`, tid).Scan(&pid)
+	return pid
+}
+
+func debugRunning(tid int) bool {
+	debugLock.Lock()
+	defer debugLock.Unlock()
+	_, ok := debugShells[tid]
+	return ok
+}
+
+// snapshotTask finds the project and stage of a snapshotted task.
+func snapshotTask(params map[string]string) (*project, int, string, error) {
+	tid, _ := strconv.Atoi(params["id"])
+	var pid int
+	var stage string
+	err := db.QueryRow(`SELECT project, stage FROM snapshots WHERE task = ?`, tid).Scan(&pid, &stage)
+	if err != nil || projectGet(pid) == nil {
+		return nil, 0, "", errors.New("Not found")
+	}
+	return projectGet(pid), tid, stage, nil
+}
+
+func handleProjectSnapshots(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	rows, err := db.Query(`SELECT task, stage, size, time FROM snapshots WHERE project = ? ORDER BY task DESC`, id)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]interface{}, 0)
+	for rows.Next() {
+		var tid int
+		var stage string
+		var size int64
+		var time string
+		rows.Scan(&tid, &stage, &size, &time)
+		result = append(result, map[string]interface{}{
+			"task":  tid,
+			"stage": stage,
+			"size":  size,
+			"time":  time,
+			"shell": debugRunning(tid),
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleTaskSnapshot(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/task/snapshot", params) {
+		return
+	}
+	p, tid, _, err := snapshotTask(params)
+	if err != nil {
+		writeError(w, statusError(404, err.Error()))
+		return
+	}
+	file, err := store.Open(snapshotKey(p.id, tid), 0)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, notFound("Snapshot"))
+		return
+	}
+	defer file.Close()
+	w.Header().Add("Content-Type", "application/gzip")
+	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="racs-task-%d-workspace.tar.gz"`, tid))
+	io.Copy(w, file)
+}
+
+func handleTaskShell(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/task/shell", params) {
+		return
+	}
+	p, tid, stage, err := snapshotTask(params)
+	if err != nil {
+		writeError(w, statusError(404, err.Error()))
+		return
+	}
+	expires, err := debugShell(p, tid)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"task":      tid,
+		"stage":     stage,
+		"container": debugContainer(tid),
+		"command":   fmt.Sprintf("podman exec -it %s /bin/sh", debugContainer(tid)),
+		"expires":   expires.UTC().Format("2006-01-02 15:04:05"),
+	})
+	w.Write(j)
+}
+
+// handleTaskShellExec runs a command in a debug shell, for developers without access to the racs host.
+func handleTaskShellExec(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/task/shell/exec", params) {
+		return
+	}
+	tid, _ := strconv.Atoi(params["id"])
+	if !debugRunning(tid) {
+		writeError(w, statusError(404, "No debug shell is running for this task"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+	w.Header().Add("Content-Type", "text/plain")
+	cmd := exec.CommandContext(ctx, "podman", "exec", "-w", "/workspace", debugContainer(tid), "/bin/sh", "-c", params["command"])
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			w.Header().Add("X-Exit-Code", strconv.Itoa(exit.ExitCode()))
+		} else {
+			writeError(w, err)
+			return
+		}
+	} else {
+		w.Header().Add("X-Exit-Code", "0")
+	}
+	w.Write(output)
+}
+
+func handleTaskShellStop(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/task/shell/stop", params) {
+		return
+	}
+	tid, _ := strconv.Atoi(params["id"])
+	if !debugRunning(tid) {
+		writeError(w, statusError(404, "No debug shell is running for this task"))
+		return
+	}
+	if err := exec.Command("podman", "rm", "-f", debugContainer(tid)).Run(); err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// sourceProvider fetches a project's source into its workspace. Clone and Pull return the command a stage shows and
+// runs, and a builtin to run in its place when a single command can't do the job.
+type sourceProvider interface {
+	Clone(p *project, source string) (string, []string, func(out io.Writer) error)
+	Pull(p *project, source string) (string, []string, func(out io.Writer) error)
+	Revision(p *project, source string) (string, error)
+	Head(ctx context.Context, p *project) (string, error)
+}
+
+var sourceKinds = map[string]sourceProvider{
+	"git":     gitSource{},
+	"hg":      hgSource{},
+	"svn":     svnSource{},
+	"tarball": tarballSource{},
+}
+
+func validSource(params map[string]string) bool {
+	kind := strings.ToLower(strings.TrimSpace(params["sourceKind"]))
+	_, ok := sourceKinds[kind]
+	return len(kind) == 0 || ok
+}
+
+func sourceFor(p *project) sourceProvider {
+	if provider, ok := sourceKinds[p.sourceKind]; ok {
+		return provider
+	}
+	return gitSource{}
+}
+
+func sourceOutput(name string, args ...string) (string, error) {
+	output, err := exec.Command(name, args...).Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+type gitSource struct{}
+
+func (gitSource) Clone(p *project, source string) (string, []string, func(out io.Writer) error) {
+	return "git", []string{"clone", "-v", "--progress", "--recursive", "-b", p.branch, p.url, source}, nil
+}
+
+func (gitSource) Pull(p *project, source string) (string, []string, func(out io.Writer) error) {
+	// A tag build leaves the source on a detached HEAD.
+	exec.Command("git", "-C", source, "checkout", "-q", p.branch).Run()
+	return "git", []string{"-C", source, "pull", "--recurse-submodules"}, nil
+}
+
+func (gitSource) Revision(p *project, source string) (string, error) {
+	return sourceOutput("git", "-C", source, "rev-parse", "HEAD")
+}
+
+func (gitSource) Head(ctx context.Context, p *project) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", "ls-remote", p.url, "refs/heads/"+p.branch).Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], nil
+}
+
+type hgSource struct{}
+
+func hgBranch(p *project) string {
+	if len(p.branch) == 0 {
+		return "default"
+	}
+	return p.branch
+}
+
+func (hgSource) Clone(p *project, source string) (string, []string, func(out io.Writer) error) {
+	return "hg", []string{"clone", "-u", hgBranch(p), p.url, source}, nil
+}
+
+func (hgSource) Pull(p *project, source string) (string, []string, func(out io.Writer) error) {
+	return "hg", []string{"-R", source, "pull", "-u", "-b", hgBranch(p)}, nil
+}
+
+func (hgSource) Revision(p *project, source string) (string, error) {
+	return sourceOutput("hg", "-R", source, "log", "-r", ".", "--template", "{node}")
+}
+
+func (hgSource) Head(ctx context.Context, p *project) (string, error) {
+	out, err := exec.CommandContext(ctx, "hg", "identify", "--debug", "-i", "-r", hgBranch(p), p.url).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// svnSource checks out the project's URL, which names the branch, e.g. https://svn.example.com/repo/trunk. Revisions
+// are the last revision that changed it.
+type svnSource struct{}
+
+func (svnSource) Clone(p *project, source string) (string, []string, func(out io.Writer) error) {
+	return "svn", []string{"checkout", "--non-interactive", p.url, source}, nil
+}
+
+func (svnSource) Pull(p *project, source string) (string, []string, func(out io.Writer) error) {
+	return "svn", []string{"update", "--non-interactive", source}, nil
+}
+
+func (svnSource) Revision(p *project, source string) (string, error) {
+	return sourceOutput("svn", "info", "--show-item", "last-changed-revision", source)
+}
+
+func (svnSource) Head(ctx context.Context, p *project) (string, error) {
+	out, err := exec.CommandContext(ctx, "svn", "info", "--non-interactive", "--show-item", "last-changed-revision", p.url).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// tarballSource downloads and unpacks a tar or gzipped tar archive. An archive with a single top level directory, as
+// from GitHub and GitLab, is unpacked from inside it. Revisions are the archive's SHA-256.
+type tarballSource struct{}
+
+var tarballClient = &http.Client{Timeout: 30 * time.Minute}
+
+func tarballRevision(p *project) string {
+	return fmt.Sprintf("%s/%d/tarball.sha256", projectAbs, p.id)
+}
+
+func tarballFetch(out io.Writer, p *project, url, source string) error {
+	if err := cleanPath(out, source, fmt.Sprintf("%s/%d", projectAbs, p.id)); err != nil {
+		return err
+	}
+	response, err := tarballClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return fmt.Errorf("download failed: %s", response.Status)
+	}
+	makeDir(source)
+	h := sha256.New()
+	if err := archiveExtract(io.TeeReader(response.Body, h), source); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(source)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		top := source + ".top"
+		if err := os.Rename(source, top); err != nil {
+			return err
+		}
+		if err := os.Rename(top+"/"+entries[0].Name(), source); err != nil {
+			return err
+		}
+		os.Remove(top)
+	}
+	revision := hex.EncodeToString(h.Sum(nil))
+	fmt.Fprintf(out, "unpacked %s, sha256 %s\n", url, revision)
+	return ioutil.WriteFile(tarballRevision(p), []byte(revision), fileMode)
+}
+
+func (tarballSource) Clone(p *project, source string) (string, []string, func(out io.Writer) error) {
+	url := p.url
+	return "fetch", []string{url, source}, func(out io.Writer) error {
+		return tarballFetch(out, p, url, source)
+	}
+}
+
+func (s tarballSource) Pull(p *project, source string) (string, []string, func(out io.Writer) error) {
+	return s.Clone(p, source)
+}
+
+func (tarballSource) Revision(p *project, source string) (string, error) {
+	revision, err := ioutil.ReadFile(tarballRevision(p))
+	return string(revision), err
+}
+
+// Head is the archive's ETag, or failing that when it was last modified, so that polling can tell when it changes.
+func (tarballSource) Head(ctx context.Context, p *project) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, "HEAD", p.url, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := tarballClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		return "", errors.New(response.Status)
+	}
+	if etag := response.Header.Get("ETag"); len(etag) > 0 {
+		return etag, nil
+	}
+	return response.Header.Get("Last-Modified"), nil
+}
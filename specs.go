@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var specInstructions = map[string]bool{
+	"ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true, "ENV": true, "EXPOSE": true,
+	"FROM": true, "HEALTHCHECK": true, "LABEL": true, "MAINTAINER": true, "ONBUILD": true, "RUN": true,
+	"SHELL": true, "STOPSIGNAL": true, "USER": true, "VOLUME": true, "WORKDIR": true,
+}
+
+// specLocks make each project's spec edits compare and write in one step, so that two edits of the same version can't
+// both succeed.
+var specLocks = make(map[int]*sync.Mutex)
+var specLocksLock sync.Mutex
+
+func specLock(pid int) *sync.Mutex {
+	specLocksLock.Lock()
+	defer specLocksLock.Unlock()
+	if specLocks[pid] == nil {
+		specLocks[pid] = &sync.Mutex{}
+	}
+	return specLocks[pid]
+}
+
+var specDirective = regexp.MustCompile(`^#\s*([a-zA-Z]+)\s*=\s*(\S+)\s*$`)
+var specHeredoc = regexp.MustCompile(`<<-?["']?([A-Za-z_][A-Za-z0-9_]*)["']?`)
+var specPort = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(/(tcp|udp|sctp))?$`)
+
+func specArgs(args string) []string {
+	fields := strings.Fields(args)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		fields = fields[1:]
+	}
+	return fields
+}
+
+func specInstruction(line int, instruction, args string, from bool) []lintIssue {
+	issues := make([]lintIssue, 0)
+	issue := func(format string, a ...interface{}) {
+		issues = append(issues, lintIssue{line, "", fmt.Sprintf(format, a...)})
+	}
+	fields := specArgs(args)
+	if len(strings.TrimSpace(args)) == 0 {
+		issue("%s requires arguments", instruction)
+		return issues
+	}
+	if !from && instruction != "FROM" && instruction != "ARG" {
+		issue("%s before the first FROM", instruction)
+	}
+	switch instruction {
+	case "FROM":
+		if len(fields) != 1 && (len(fields) != 3 || strings.ToUpper(fields[1]) != "AS") {
+			issue("FROM must be FROM IMAGE or FROM IMAGE AS NAME")
+		}
+	case "COPY", "ADD":
+		var list []string
+		if strings.HasPrefix(strings.Join(fields, " "), "[") {
+			if json.Unmarshal([]byte(strings.Join(fields, " ")), &list) != nil {
+				issue("%s has an invalid JSON array", instruction)
+			} else if len(list) < 2 {
+				issue("%s requires a source and a destination", instruction)
+			}
+		} else if len(fields) < 2 && !specHeredoc.MatchString(args) {
+			issue("%s requires a source and a destination", instruction)
+		}
+	case "SHELL":
+		var list []string
+		if json.Unmarshal([]byte(strings.TrimSpace(args)), &list) != nil || len(list) == 0 {
+			issue("SHELL must be a JSON array, e.g. [\"/bin/sh\", \"-c\"]")
+		}
+	case "ENV", "LABEL":
+		if !strings.Contains(fields[0], "=") && (instruction == "LABEL" || len(fields) < 2) {
+			issue("%s must be %s KEY=VALUE", instruction, instruction)
+		}
+	case "EXPOSE":
+		for _, port := range fields {
+			if !strings.Contains(port, "$") && !specPort.MatchString(port) {
+				issue("invalid port %s", port)
+			}
+		}
+	case "ONBUILD":
+		next := strings.ToUpper(fields[0])
+		if next == "ONBUILD" || next == "FROM" || next == "MAINTAINER" {
+			issue("ONBUILD cannot trigger %s", next)
+		} else if !specInstructions[next] {
+			issue("unknown instruction %s", next)
+		}
+	}
+	return issues
+}
+
+// specIssues checks the syntax of a container spec, reporting the line each instruction starts on.
+func specIssues(content string) []lintIssue {
+	issues := make([]lintIssue, 0)
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	escape := "\\"
+	directives := true
+	from := false
+	found := false
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if directives {
+			if match := specDirective.FindStringSubmatch(line); match != nil {
+				if strings.ToLower(match[1]) == "escape" {
+					if match[2] != "\\" && match[2] != "`" {
+						issues = append(issues, lintIssue{i + 1, "", "escape must be \\ or `"})
+					} else {
+						escape = match[2]
+					}
+				}
+				continue
+			}
+			directives = false
+		}
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		start := i
+		for strings.HasSuffix(line, escape) {
+			line = strings.TrimSuffix(line, escape)
+			i++
+			for i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "#") {
+				i++
+			}
+			if i >= len(lines) {
+				issues = append(issues, lintIssue{start + 1, "", "line continuation at the end of the file"})
+				break
+			}
+			line += " " + strings.TrimSpace(lines[i])
+		}
+		parts := strings.SplitN(line, " ", 2)
+		instruction := strings.ToUpper(strings.Fields(parts[0])[0])
+		args := ""
+		if len(parts) > 1 {
+			args = parts[1]
+		}
+		if !specInstructions[instruction] {
+			issues = append(issues, lintIssue{start + 1, "", fmt.Sprintf("unknown instruction %s", parts[0])})
+			continue
+		}
+		issues = append(issues, specInstruction(start+1, instruction, args, from)...)
+		if instruction == "FROM" {
+			from = true
+		}
+		found = true
+		if match := specHeredoc.FindStringSubmatch(args); match != nil && (instruction == "RUN" || instruction == "COPY" || instruction == "ADD") {
+			for i++; i < len(lines) && strings.TrimSpace(lines[i]) != match[1]; i++ {
+			}
+			if i >= len(lines) {
+				issues = append(issues, lintIssue{start + 1, "", fmt.Sprintf("heredoc %s is not terminated", match[1])})
+			}
+		}
+	}
+	if !found || !from {
+		issues = append(issues, lintIssue{len(lines), "", "container spec has no FROM instruction"})
+	}
+	return issues
+}
+
+func specETag(content []byte) string {
+	h := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(h[:16]) + `"`
+}
+
+// specWrite replaces a spec file with new content.
+func specWrite(path, content string) error {
+	makeDir(filepath.Dir(path))
+	file, err := createFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(content)
+	file.Close()
+	return err
+}
+
+func projectSpec(p *project, kind string) string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	switch kind {
+	case "build":
+		return p.buildSpec
+	case "package":
+		return p.packageSpec
+	case "test":
+		return p.testSpec
+	}
+	return ""
+}
+
+func handleProjectSpec(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	spec := projectSpec(p, params["spec"])
+	if len(spec) == 0 {
+		writeError(w, notFound("Spec"))
+		return
+	}
+	name, path := projectFile(p, spec)
+	current, err := ioutil.ReadFile(path)
+	exists := err == nil
+	if r.Method != "PUT" && r.Method != "POST" {
+		if !exists {
+			writeError(w, notFound("Spec"))
+			return
+		}
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Add("ETag", specETag(current))
+		if match := r.Header.Get("If-None-Match"); match == specETag(current) {
+			w.WriteHeader(304)
+			return
+		}
+		w.Write(current)
+		return
+	}
+	if checkLogin(u, "admin", w, "/project/spec", params) {
+		return
+	}
+	if uploadSlotFor(p, name) != specSlot {
+		writeError(w, conflict("%s is in the repository and cannot be edited here", name))
+		return
+	}
+	content, ok := params["content"]
+	if !ok {
+		body, _ := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, specLimit+1))
+		content = string(body)
+	}
+	lock := specLock(p.id)
+	lock.Lock()
+	defer lock.Unlock()
+	current, err = ioutil.ReadFile(path)
+	exists = err == nil
+	match := r.Header.Get("If-Match")
+	if len(match) == 0 {
+		match = params["etag"]
+	}
+	if exists && len(match) == 0 {
+		writeError(w, statusError(428, "If-Match is required to change an existing spec"))
+		return
+	}
+	if exists && match != "*" && match != specETag(current) {
+		w.Header().Add("ETag", specETag(current))
+		writeError(w, statusError(412, fmt.Sprintf("%s has changed since it was read", name)))
+		return
+	}
+	if len(content) > specLimit {
+		writeError(w, statusError(413, fmt.Sprintf("spec is over the limit of %d bytes", specLimit)))
+		return
+	}
+	if issues := specIssues(content); len(issues) > 0 {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(422)
+		j, _ := json.Marshal(map[string]interface{}{
+			"valid":  false,
+			"errors": lintIssues(issues),
+		})
+		w.Write(j)
+		return
+	}
+	if err := specWrite(path, content); err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	logger.Infof("Project %d spec %s edited by %s", p.id, name, u.Name)
+	projectRevise(p, u.Name)
+	w.Header().Add("ETag", specETag([]byte(content)))
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
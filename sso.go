@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var oidcIssuer string
+var oidcClientID string
+var oidcClientSecret string
+var oidcScopes string
+var oidcGroupsClaim string
+var ssoRoles string
+
+type oidcProvider struct {
+	issuer        string
+	authorization string
+	token         string
+}
+
+var oidcDiscovered *oidcProvider
+var oidcLock sync.Mutex
+
+type oidcState struct {
+	State    string
+	Nonce    string
+	Redirect string
+	Expires  int64
+}
+
+// seal encrypts a value with the server's session key, for cookies that only racs can read.
+func seal(value interface{}) string {
+	gcm, _ := cipher.NewGCM(ciph)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	in, _ := json.Marshal(value)
+	return hex.EncodeToString(gcm.Seal(nonce, nonce, in, nil))
+}
+
+func unseal(sealed string, value interface{}) error {
+	b, err := hex.DecodeString(sealed)
+	if err != nil {
+		return err
+	}
+	gcm, _ := cipher.NewGCM(ciph)
+	if len(b) < gcm.NonceSize() {
+		return errors.New("sealed value is too short")
+	}
+	de, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(de, value)
+}
+
+func sessionStart(w http.ResponseWriter, u user) {
+	http.SetCookie(w, &http.Cookie{
+		Name:    "RACS_TOKEN",
+		Value:   seal(u),
+		Path:    "/",
+		Expires: time.Now().Add(24 * time.Hour),
+	})
+}
+
+// ssoUser maps a single sign-on user's groups to roles with -sso-roles, e.g. racs-admins=admin,developers=user, and
+// records the user. Admins are also users. Without -sso-roles every user is an admin, as with local users. Names of
+// local users, who have a password in racs, are refused, so that single sign-on can't take over their accounts.
+func ssoUser(name, provider string, groups []string) (user, error) {
+	u := user{name, []string{"admin", "user"}}
+	var existing string
+	db.QueryRow(`SELECT IFNULL(provider, '') FROM users WHERE name = ?`, name).Scan(&existing)
+	if existing == "local" {
+		return u, fmt.Errorf("%s is a local racs user and can't log in with %s", name, provider)
+	}
+	if len(strings.TrimSpace(ssoRoles)) > 0 {
+		roles := make(map[string]bool)
+		for _, mapping := range strings.Split(ssoRoles, ",") {
+			parts := strings.SplitN(strings.TrimSpace(mapping), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			for _, group := range groups {
+				if group == parts[0] {
+					roles[parts[1]] = true
+				}
+			}
+		}
+		u.Roles = []string{}
+		if roles["admin"] {
+			u.Roles = append(u.Roles, "admin", "user")
+		} else if roles["user"] {
+			u.Roles = append(u.Roles, "user")
+		}
+		if len(u.Roles) == 0 {
+			return u, fmt.Errorf("%s is not in a group with a racs role", name)
+		}
+	}
+	_, err := db.Exec(`INSERT INTO users(name, role, provider, login) VALUES(?, ?, ?, datetime('now'))
+		ON CONFLICT(name) DO UPDATE SET role = excluded.role, login = excluded.login WHERE IFNULL(users.provider, '') != 'local'`,
+		name, strings.Join(u.Roles, ","), provider)
+	if err != nil {
+		return u, err
+	}
+	logger.Infof("User %s logged in with %s as %s", name, provider, strings.Join(u.Roles, ","))
+	return u, nil
+}
+
+func oidcDiscover() (*oidcProvider, error) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	if oidcDiscovered != nil {
+		return oidcDiscovered, nil
+	}
+	response, err := apiClient.Get(strings.TrimSuffix(oidcIssuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("OIDC discovery failed: %s", response.Status)
+	}
+	var config map[string]interface{}
+	if err := json.NewDecoder(response.Body).Decode(&config); err != nil {
+		return nil, err
+	}
+	provider := &oidcProvider{bundleText(config["issuer"]), bundleText(config["authorization_endpoint"]), bundleText(config["token_endpoint"])}
+	oidcDiscovered = provider
+	return provider, nil
+}
+
+func oidcRedirect() string {
+	return strings.TrimSuffix(publicURL, "/") + "/user/oidc/callback"
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func handleUserOIDCLogin(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if len(oidcIssuer) == 0 {
+		writeError(w, statusError(404, "Single sign-on is not configured"))
+		return
+	}
+	provider, err := oidcDiscover()
+	if err != nil {
+		logger.Error(err)
+		writeError(w, statusError(502, err.Error()))
+		return
+	}
+	redirect := params["redirect"]
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+	state := oidcState{randomHex(16), randomHex(16), redirect, time.Now().Add(10 * time.Minute).Unix()}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "RACS_OIDC",
+		Value:    seal(state),
+		Path:     "/user/oidc",
+		HttpOnly: true,
+		Expires:  time.Unix(state.Expires, 0),
+	})
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {oidcClientID},
+		"redirect_uri":  {oidcRedirect()},
+		"scope":         {oidcScopes},
+		"state":         {state.State},
+		"nonce":         {state.Nonce},
+	}
+	w.Header().Add("Location", provider.authorization+"?"+query.Encode())
+	w.WriteHeader(303)
+}
+
+// oidcClaims exchanges an authorization code for an ID token and returns its claims. The token comes straight from the
+// provider's token endpoint over TLS, which OIDC allows in place of checking its signature.
+func oidcClaims(provider *oidcProvider, code, nonce string) (map[string]interface{}, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {oidcRedirect()},
+	}
+	request, err := http.NewRequest("POST", provider.token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(oidcClientID), url.QueryEscape(oidcClientSecret))
+	response, err := apiClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("OIDC token request failed: %s %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	var token map[string]interface{}
+	json.Unmarshal(body, &token)
+	parts := strings.Split(bundleText(token["id_token"]), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("OIDC token response has no ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == oidcClientID
+	case []interface{}:
+		for _, a := range aud {
+			audience = audience || a == oidcClientID
+		}
+	}
+	expires, _ := claims["exp"].(float64)
+	switch {
+	case bundleText(claims["iss"]) != provider.issuer:
+		return nil, errors.New("ID token has the wrong issuer")
+	case !audience:
+		return nil, errors.New("ID token is for another client")
+	case int64(expires) < time.Now().Unix():
+		return nil, errors.New("ID token has expired")
+	case bundleText(claims["nonce"]) != nonce:
+		return nil, errors.New("ID token has the wrong nonce")
+	}
+	return claims, nil
+}
+
+func oidcUser(code, nonce string) (user, error) {
+	provider, err := oidcDiscover()
+	if err != nil {
+		return user{}, err
+	}
+	claims, err := oidcClaims(provider, code, nonce)
+	if err != nil {
+		return user{}, err
+	}
+	name := bundleText(claims["preferred_username"])
+	if len(name) == 0 {
+		name = bundleText(claims["email"])
+	}
+	if len(name) == 0 {
+		name = bundleText(claims["sub"])
+	}
+	groups := make([]string, 0)
+	switch value := claims[oidcGroupsClaim].(type) {
+	case string:
+		groups = append(groups, value)
+	case []interface{}:
+		for _, group := range value {
+			groups = append(groups, bundleText(group))
+		}
+	}
+	return ssoUser(name, "oidc", groups)
+}
+
+func handleUserOIDCCallback(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	var state oidcState
+	cookie, _ := r.Cookie("RACS_OIDC")
+	if cookie == nil || unseal(cookie.Value, &state) != nil || state.Expires < time.Now().Unix() || state.State != params["state"] {
+		writeError(w, badRequest("Invalid login state, please log in again"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "RACS_OIDC", Value: "", Path: "/user/oidc", Expires: time.Unix(0, 0)})
+	if len(params["error"]) > 0 {
+		writeError(w, statusError(401, params["error"]+": "+params["error_description"]))
+		return
+	}
+	u2, err := oidcUser(params["code"], state.Nonce)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, statusError(401, err.Error()))
+		return
+	}
+	sessionStart(w, u2)
+	w.Header().Add("Location", state.Redirect)
+	w.WriteHeader(303)
+}
+
+func handleUserSSO(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"oidc": len(oidcIssuer) > 0,
+		"ldap": len(ldapURL) > 0,
+	})
+	w.Write(j)
+}
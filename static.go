@@ -0,0 +1,69 @@
+package main
+
+import (
+	"embed"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// staticDir serves the UI from a directory instead of the files built into racs, to try out changes without rebuilding.
+var staticDir string
+
+func init() {
+	// Not every system's MIME types know .xhtml, and the UI must be served as XHTML to render.
+	mime.AddExtensionType(".xhtml", "application/xhtml+xml")
+	mime.AddExtensionType(".js", "text/javascript")
+	mime.AddExtensionType(".ico", "image/x-icon")
+}
+
+func staticFS() fs.FS {
+	if len(staticDir) > 0 {
+		return os.DirFS(staticDir)
+	}
+	root, _ := fs.Sub(staticFiles, "static")
+	return root
+}
+
+// staticName is the name of a URL path in the static files, or false for paths outside them.
+func staticName(urlPath string) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "index.xhtml"
+	}
+	return name, fs.ValidPath(name) && !strings.Contains(name, "\\")
+}
+
+// serveStatic serves a file of the UI, with its type from its extension or content and support for conditional and
+// range requests. Directories aren't listed.
+func serveStatic(w http.ResponseWriter, r *http.Request, urlPath string) {
+	name, ok := staticName(urlPath)
+	if !ok {
+		writeError(w, notFound("File"))
+		return
+	}
+	f, err := staticFS().Open(name)
+	if err != nil {
+		writeError(w, notFound("File"))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		writeError(w, notFound("File"))
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		writeError(w, notFound("File"))
+		return
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
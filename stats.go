@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type stageStats struct {
+	runs      int
+	succeeded int
+	retries   int
+	durations []float64
+	streak    int
+	longest   int
+}
+
+func (s *stageStats) record(succeeded bool) {
+	s.runs += 1
+	if succeeded {
+		s.succeeded += 1
+		s.streak = 0
+		return
+	}
+	s.streak += 1
+	if s.streak > s.longest {
+		s.longest = s.streak
+	}
+}
+
+func successRate(succeeded, runs int) float64 {
+	if runs == 0 {
+		return 0
+	}
+	return math.Round(float64(succeeded)/float64(runs)*1000) / 1000
+}
+
+// percentile is the nearest-rank percentile of durations, which must be sorted.
+func percentile(durations []float64, p float64) float64 {
+	if len(durations) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(durations)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return durations[rank]
+}
+
+func average(durations []float64) float64 {
+	if len(durations) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, d := range durations {
+		total += d
+	}
+	return total / float64(len(durations))
+}
+
+// statsBucket is the day of a task or build's time, or the Monday of its week.
+func statsBucket(timestamp, bucket string) string {
+	day := timestamp
+	if len(day) > 10 {
+		day = day[:10]
+	}
+	if bucket != "week" {
+		return day
+	}
+	t, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return day
+	}
+	return t.AddDate(0, 0, -(int(t.Weekday())+6)%7).Format("2006-01-02")
+}
+
+func handleProjectStats(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	if projectGet(id) == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	days, _ := strconv.Atoi(params["days"])
+	if days <= 0 || days > 365 {
+		days = 30
+	}
+	bucket := params["bucket"]
+	if bucket != "week" {
+		bucket = "day"
+	}
+	from := time.Now().UTC().AddDate(0, 0, -days).Format("2006-01-02 15:04:05")
+	rows, err := db.Query(`SELECT type, state, time, IFNULL(duration, 0), IFNULL(attempt, 0) FROM tasks
+		WHERE project = ? AND time >= ? AND state IN ('SUCCESS', 'ERROR') ORDER BY id`, id, from)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	stages := make(map[string]*stageStats)
+	trend := make(map[string]map[string]interface{})
+	trendEntry := func(key string) map[string]interface{} {
+		if trend[key] == nil {
+			trend[key] = map[string]interface{}{"date": key, "tasks": 0, "failed": 0, "builds": 0, "buildsFailed": 0, "duration": 0.0}
+		}
+		return trend[key]
+	}
+	for rows.Next() {
+		var kind string
+		var state string
+		var timestamp string
+		var duration float64
+		var attempt int
+		rows.Scan(&kind, &state, &timestamp, &duration, &attempt)
+		s := stages[kind]
+		if s == nil {
+			s = &stageStats{}
+			stages[kind] = s
+		}
+		s.record(state == "SUCCESS")
+		if attempt > 0 {
+			s.retries += 1
+		}
+		if duration > 0 && state == "SUCCESS" {
+			s.durations = append(s.durations, duration)
+		}
+		entry := trendEntry(statsBucket(timestamp, bucket))
+		entry["tasks"] = entry["tasks"].(int) + 1
+		entry["duration"] = entry["duration"].(float64) + duration
+		if state != "SUCCESS" {
+			entry["failed"] = entry["failed"].(int) + 1
+		}
+	}
+	rows.Close()
+	builds := &stageStats{}
+	rows, err = db.Query(`SELECT state, time FROM builds WHERE project = ? AND time >= ? AND state IN ('SUCCESS', 'ERROR') ORDER BY id`, id, from)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	for rows.Next() {
+		var state string
+		var timestamp string
+		rows.Scan(&state, &timestamp)
+		builds.record(state == "SUCCESS")
+		entry := trendEntry(statsBucket(timestamp, bucket))
+		entry["builds"] = entry["builds"].(int) + 1
+		if state != "SUCCESS" {
+			entry["buildsFailed"] = entry["buildsFailed"].(int) + 1
+		}
+	}
+	rows.Close()
+	stageList := make([]interface{}, 0)
+	for _, stage := range runOrder {
+		s := stages[stage.String()]
+		if s == nil {
+			continue
+		}
+		sort.Float64s(s.durations)
+		stageList = append(stageList, map[string]interface{}{
+			"stage":          stage.String(),
+			"runs":           s.runs,
+			"succeeded":      s.succeeded,
+			"failed":         s.runs - s.succeeded,
+			"retries":        s.retries,
+			"successRate":    successRate(s.succeeded, s.runs),
+			"averageSeconds": math.Round(average(s.durations)*10) / 10,
+			"p95Seconds":     math.Round(percentile(s.durations, 95)*10) / 10,
+			"failureStreak":  s.streak,
+			"longestStreak":  s.longest,
+		})
+	}
+	keys := make([]string, 0, len(trend))
+	for key := range trend {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	trendList := make([]interface{}, 0)
+	for _, key := range keys {
+		trendList = append(trendList, trend[key])
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"project": id,
+		"days":    days,
+		"bucket":  bucket,
+		"from":    from,
+		"stages":  stageList,
+		"builds": map[string]interface{}{
+			"runs":          builds.runs,
+			"succeeded":     builds.succeeded,
+			"failed":        builds.runs - builds.succeeded,
+			"successRate":   successRate(builds.succeeded, builds.runs),
+			"perDay":        math.Round(float64(builds.runs)/float64(days)*100) / 100,
+			"failureStreak": builds.streak,
+			"longestStreak": builds.longest,
+		},
+		"trend": trendList,
+	})
+	w.Write(j)
+}
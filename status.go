@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var startTime = time.Now()
+
+var racsImage = regexp.MustCompile(`^(?:localhost/)?(builder|test|project)-([0-9]+)$`)
+
+type image struct {
+	id      string
+	name    string
+	project int
+}
+
+func racsImages() ([]image, error) {
+	output, err := exec.Command("podman", "images", "--format", "{{.ID}} {{.Repository}}").Output()
+	if err != nil {
+		return nil, err
+	}
+	images := make([]image, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if match := racsImage.FindStringSubmatch(fields[1]); match != nil {
+			pid, _ := strconv.Atoi(match[2])
+			images = append(images, image{fields[0], fields[1], pid})
+		}
+	}
+	return images, nil
+}
+
+func databaseSize() int64 {
+	var size int64
+	var err error
+	if db.dialect == "postgres" {
+		err = db.QueryRow(`SELECT pg_database_size(current_database())`).Scan(&size)
+	} else {
+		err = db.QueryRow(`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&size)
+	}
+	if err != nil {
+		logger.Error(err)
+		return -1
+	}
+	return size
+}
+
+func handleAdminStatus(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/admin/status", params) {
+		return
+	}
+	running := 0
+	queued := 0
+	queues := make(map[string]int)
+	all := projectAll()
+	for _, p := range all {
+		if p.currentState().running() {
+			running += 1
+		}
+		if len(p.queue) > 0 {
+			queues[strconv.Itoa(p.id)] = len(p.queue)
+			queued += len(p.queue)
+		}
+	}
+	imageCount := -1
+	if images, err := racsImages(); err != nil {
+		logger.Error(err)
+	} else {
+		imageCount = len(images)
+	}
+	uptime := time.Since(startTime)
+	result := map[string]interface{}{
+		"go":         runtime.Version(),
+		"started":    startTime.UTC().Format("2006-01-02 15:04:05"),
+		"uptime":     int(uptime.Seconds()),
+		"projects":   len(all),
+		"running":    running,
+		"queued":     queued,
+		"queues":     queues,
+		"images":     imageCount,
+		"database":   databaseSize(),
+		"goroutines": runtime.NumGoroutine(),
+		"disk": map[string]interface{}{
+			"projects":  dirSize(projectAbs),
+			"tasks":     dirSize("tasks"),
+			"artifacts": dirSize("artifacts"),
+		},
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleAdminPruneImages(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/admin/prune/images", params) {
+		return
+	}
+	removed, dangling, err := pruneImages(0)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	logger.Infof("Pruned %d orphaned and %d dangling images", len(removed), dangling)
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"removed":  removed,
+		"dangling": dangling,
+	})
+	w.Write(j)
+}
+
+func handleAdminPruneWorkspaces(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/admin/prune/workspaces", params) {
+		return
+	}
+	entries, err := os.ReadDir(projectAbs)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	removed := make([]int, 0)
+	var freed int64
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() || projectGet(pid) != nil {
+			continue
+		}
+		// A project being created has its row before its directory and its entry in projects.
+		var count int
+		db.QueryRow(`SELECT COUNT(*) FROM projects WHERE id = ?`, pid).Scan(&count)
+		if count > 0 {
+			continue
+		}
+		path := fmt.Sprintf("%s/%d", projectAbs, pid)
+		size := dirSize(path)
+		if err := os.RemoveAll(path); err != nil {
+			logger.Error(err)
+			continue
+		}
+		freed += size
+		removed = append(removed, pid)
+	}
+	logger.Infof("Pruned %d orphaned workspaces, freeing %d bytes", len(removed), freed)
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"removed": removed,
+		"freed":   freed,
+	})
+	w.Write(j)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var githubToken string
+var gitlabToken string
+var publicURL string
+
+var repoURL = regexp.MustCompile(`^(?:([a-z+]+)://)?(?:[^@/]+@)?([^:/]+)(:[0-9]+)?[:/](.+?)(?:\.git)?/?$`)
+
+var apiClient = &http.Client{Timeout: 10 * time.Second}
+
+// repoPath splits a clone URL such as https://github.com/owner/repo.git or git@github.com:owner/repo.git into its host and repository path.
+// The host keeps the port of HTTP URLs, which is also the port of the API.
+func repoPath(source string) (string, string) {
+	match := repoURL.FindStringSubmatch(source)
+	if match == nil {
+		return "", ""
+	}
+	if match[1] == "http" || match[1] == "https" {
+		return match[2] + match[3], match[4]
+	}
+	return match[2], match[4]
+}
+
+// statusHost is github or gitlab. It's known for previews from the webhook that started them, otherwise it's guessed
+// from the project's URL, or from the one token the server has.
+func statusHost(p *project, build int) string {
+	var kind string
+	db.QueryRow(`SELECT host FROM previews WHERE build = ?`, build).Scan(&kind)
+	host, _ := repoPath(p.url)
+	switch {
+	case len(kind) > 0:
+		return kind
+	case strings.Contains(host, "github"):
+		return "github"
+	case strings.Contains(host, "gitlab"), len(githubToken) == 0:
+		return "gitlab"
+	}
+	return "github"
+}
+
+// buildStatus reports a build's state on the commit it built, linking to the build in racs if -url is set.
+func buildStatus(p *project, build int, state string) {
+	var sha string
+	db.QueryRow(`SELECT IFNULL(sha, '') FROM builds WHERE id = ?`, build).Scan(&sha)
+	descriptions := map[string]string{"pending": "Build %d running", "success": "Build %d passed", "failure": "Build %d failed"}
+	target := ""
+	if len(publicURL) > 0 {
+		target = fmt.Sprintf("%s/#build=%d", strings.TrimSuffix(publicURL, "/"), build)
+	}
+	commitStatus(p, statusHost(p, build), sha, state, fmt.Sprintf(descriptions[state], build), target)
+}
+
+// commitStatus sets the racs status of a commit on GitHub or GitLab. The state is pending, success or failure.
+func commitStatus(p *project, kind, sha, state, description, target string) {
+	host, repo := repoPath(p.url)
+	if len(host) == 0 || len(sha) == 0 {
+		return
+	}
+	var endpoint string
+	var body map[string]interface{}
+	switch kind {
+	case "github":
+		if len(githubToken) == 0 {
+			return
+		}
+		api := "https://api.github.com"
+		if host != "github.com" {
+			api = "https://" + host + "/api/v3"
+		}
+		endpoint = fmt.Sprintf("%s/repos/%s/statuses/%s", api, repo, sha)
+		body = map[string]interface{}{"state": state, "context": "racs", "description": description}
+	case "gitlab":
+		if len(gitlabToken) == 0 {
+			return
+		}
+		states := map[string]string{"pending": "running", "success": "success", "failure": "failed"}
+		endpoint = fmt.Sprintf("https://%s/api/v4/projects/%s/statuses/%s", host, url.PathEscape(repo), sha)
+		body = map[string]interface{}{"state": states[state], "name": "racs", "description": description}
+	default:
+		return
+	}
+	if len(target) > 0 {
+		body["target_url"] = target
+	}
+	j, _ := json.Marshal(body)
+	request, err := http.NewRequest("POST", endpoint, bytes.NewReader(j))
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if kind == "github" {
+		request.Header.Set("Accept", "application/vnd.github+json")
+		request.Header.Set("Authorization", "Bearer "+githubToken)
+	} else {
+		request.Header.Set("PRIVATE-TOKEN", gitlabToken)
+	}
+	response, err := apiClient.Do(request)
+	if err != nil {
+		logger.Warnf("Project %d commit status failed: %v", p.id, err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(response.Body)
+		logger.Warnf("Project %d commit status failed: %s %s", p.id, response.Status, strings.TrimSpace(string(message)))
+		return
+	}
+	logger.Infof("Project %d commit %s %s", p.id, sha, state)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type storage interface {
+	Put(key, path string) error
+	Open(key string, offset int64) (io.ReadCloser, error)
+	Delete(key string) error
+	Local(key string) string
+}
+
+type localStorage struct {
+	root string
+}
+
+func (s *localStorage) Local(key string) string {
+	path, _ := filepath.Abs(filepath.Join(s.root, filepath.FromSlash(key)))
+	return path
+}
+
+func (s *localStorage) Put(key, path string) error {
+	target := s.Local(key)
+	if source, _ := filepath.Abs(path); source == target {
+		return nil
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	makeDir(filepath.Dir(target))
+	out, err := createFile(target)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func (s *localStorage) Open(key string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(s.Local(key))
+	if err != nil {
+		return nil, err
+	}
+	file.Seek(offset, 0)
+	return file, nil
+}
+
+func (s *localStorage) Delete(key string) error {
+	err := os.Remove(s.Local(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+type s3Storage struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+func (s *s3Storage) Local(key string) string {
+	return ""
+}
+
+func awsEscape(path string) string {
+	var sb strings.Builder
+	for _, b := range []byte(path) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || strings.IndexByte("-._~/", b) >= 0 {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *s3Storage) request(method, key string, body io.Reader, size int64) (*http.Request, error) {
+	path := awsEscape("/" + s.bucket + "/" + key)
+	request, err := http.NewRequest(method, strings.TrimSuffix(s.endpoint, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.ContentLength = size
+	}
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	request.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	request.Header.Set("X-Amz-Date", amzDate)
+	canonical := strings.Join([]string{
+		method,
+		path,
+		"",
+		"host:" + request.URL.Host,
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD",
+		"x-amz-date:" + amzDate,
+		"",
+		"host;x-amz-content-sha256;x-amz-date",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		s.accessKey, scope, signature))
+	return request, nil
+}
+
+func (s *s3Storage) do(request *http.Request) (*http.Response, error) {
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", request.Method, request.URL.Path, response.Status)
+	}
+	return response, nil
+}
+
+func (s *s3Storage) Put(key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	request, err := s.request("PUT", key, file, info.Size())
+	if err != nil {
+		return err
+	}
+	response, err := s.do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Open(key string, offset int64) (io.ReadCloser, error) {
+	request, err := s.request("GET", key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == 416 {
+		response.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if response.StatusCode >= 300 {
+		response.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", request.URL.Path, response.Status)
+	}
+	return response.Body, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	request, err := s.request("DELETE", key, nil, 0)
+	if err != nil {
+		return err
+	}
+	response, err := s.do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+var store storage = &localStorage{"."}
+
+func taskLogKey(id int) string {
+	return fmt.Sprintf("tasks/%d/out.log", id)
+}
+
+// taskLinesKey is the index of when each line of a task's log started.
+func taskLinesKey(id int) string {
+	return fmt.Sprintf("tasks/%d/lines.log", id)
+}
+
+func taskArchive(t *task) {
+	path := taskLogKey(t.id)
+	if abs, _ := filepath.Abs(path); store.Local(path) == abs {
+		return
+	}
+	for _, key := range []string{path, taskLinesKey(t.id)} {
+		if err := store.Put(key, key); err != nil {
+			logger.Error(err)
+			return
+		}
+	}
+	os.RemoveAll(filepath.Dir(path))
+}
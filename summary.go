@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+func handleSummary(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	failing := 0
+	running := 0
+	queued := 0
+	for _, p := range projectAll() {
+		if p.currentState().failed() {
+			failing += 1
+		} else if p.currentState().running() {
+			running += 1
+		}
+		if len(p.queue) > 0 {
+			queued += 1
+		}
+	}
+	failures := make([]interface{}, 0)
+	rows, err := db.Query(`SELECT tasks.id, tasks.project, projects.name, tasks.type, tasks.time
+		FROM tasks JOIN projects ON projects.id = tasks.project
+		WHERE tasks.state = 'ERROR' ORDER BY tasks.id DESC LIMIT 5`)
+	if err == nil {
+		for rows.Next() {
+			var id int
+			var pid int
+			var name string
+			var kind string
+			var time string
+			rows.Scan(&id, &pid, &name, &kind, &time)
+			failures = append(failures, map[string]interface{}{
+				"id":      id,
+				"project": pid,
+				"name":    name,
+				"type":    kind,
+				"time":    time,
+			})
+		}
+		rows.Close()
+	} else {
+		logger.Error(err)
+	}
+	j, _ := json.Marshal(map[string]interface{}{
+		"projects": len(projectAll()),
+		"failing":  failing,
+		"running":  running,
+		"queued":   queued,
+		"failures": failures,
+	})
+	h := sha256.Sum256(j)
+	etag := "\"" + hex.EncodeToString(h[:8]) + "\""
+	w.Header().Add("Cache-Control", "public, max-age=5")
+	w.Header().Add("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(304)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(j)
+}
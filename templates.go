@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+var templateName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func templatePath(name string) string {
+	return "templates/" + name + ".tar.gz"
+}
+
+func handleTemplates(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	rows, err := db.Query(`SELECT name, user, time, project FROM templates ORDER BY name`)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var name string
+		var author string
+		var time string
+		var pid int
+		rows.Scan(&name, &author, &time, &pid)
+		result = append(result, map[string]interface{}{
+			"name":    name,
+			"user":    author,
+			"time":    time,
+			"project": pid,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleTemplateSave(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/template/save", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	name := params["template"]
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	if !templateName.MatchString(name) {
+		writeError(w, badRequest("Invalid template name"))
+		return
+	}
+	file, err := createFile(templatePath(name))
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	// Templates are shared between projects, so secrets and build history stay behind.
+	err = projectExport(p, file, false, false)
+	file.Close()
+	if err != nil {
+		logger.Error(err)
+		os.Remove(templatePath(name))
+		writeError(w, err)
+		return
+	}
+	db.Exec(`REPLACE INTO templates(name, user, time, project) VALUES(?, ?, datetime('now'), ?)`, name, u.Name, p.id)
+	logger.Infof("Project %d saved as template %s by %s", p.id, name, u.Name)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleTemplateCreate(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/template/create", params) {
+		return
+	}
+	name := params["template"]
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM templates WHERE name = ?`, name).Scan(&count)
+	if !templateName.MatchString(name) || count == 0 {
+		writeError(w, notFound("Template"))
+		return
+	}
+	file, err := os.Open(templatePath(name))
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer file.Close()
+	bundle, files, err := readBundle(file)
+	if err == nil {
+		var p *project
+		var skipped []string
+		p, skipped, err = projectImport(bundle, files, projectOverrides(params), u.Name)
+		if err == nil {
+			writeCreated(w, params, p, skipped)
+			return
+		}
+	}
+	for _, upload := range files {
+		os.Remove(upload)
+	}
+	writeError(w, badRequest("%v", err))
+}
+
+func handleTemplateDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/template/delete", params) {
+		return
+	}
+	name := params["template"]
+	if !templateName.MatchString(name) {
+		writeError(w, badRequest("Invalid template name"))
+		return
+	}
+	db.Exec(`DELETE FROM templates WHERE name = ?`, name)
+	os.Remove(templatePath(name))
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleProjectClone(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/clone", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	var buf bytes.Buffer
+	err := projectExport(p, &buf, params["secrets"] == "true", false)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	bundle, files, err := readBundle(&buf)
+	if err == nil {
+		var clone *project
+		var skipped []string
+		clone, skipped, err = projectImport(bundle, files, projectOverrides(params), u.Name)
+		if err == nil {
+			writeCreated(w, params, clone, skipped)
+			return
+		}
+	}
+	for _, upload := range files {
+		os.Remove(upload)
+	}
+	writeError(w, badRequest("%v", err))
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var terminalTimeout int
+
+// terminals counts the terminals open on each project's workspace, so that their containers aren't reaped.
+var terminals = make(map[int]int)
+var terminalsLock sync.Mutex
+
+func terminalOpen(pid int) bool {
+	terminalsLock.Lock()
+	defer terminalsLock.Unlock()
+	return terminals[pid] > 0
+}
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+type websocket struct {
+	conn net.Conn
+	in   *bufio.Reader
+	lock sync.Mutex
+}
+
+// websocketAccept upgrades a request to a WebSocket. Browsers send cookies with WebSocket requests from any site, so
+// requests from another origin are refused.
+func websocketAccept(w http.ResponseWriter, r *http.Request) (*websocket, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || len(key) == 0 {
+		return nil, errors.New("WebSocket upgrade required")
+	}
+	if origin := r.Header.Get("Origin"); len(origin) > 0 {
+		if o, err := url.Parse(origin); err != nil || o.Host != r.Host {
+			return nil, errors.New("WebSocket origin not allowed")
+		}
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("WebSocket not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocket{conn, rw.Reader, sync.Mutex{}}, nil
+}
+
+// read returns the next data message, answering pings along the way. A close message is returned as io.EOF.
+func (ws *websocket) read() (byte, []byte, error) {
+	message := make([]byte, 0)
+	var opcode byte
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(ws.in, header); err != nil {
+			return 0, nil, err
+		}
+		length := int64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			extended := make([]byte, 2)
+			if _, err := io.ReadFull(ws.in, extended); err != nil {
+				return 0, nil, err
+			}
+			length = int64(binary.BigEndian.Uint16(extended))
+		case 127:
+			extended := make([]byte, 8)
+			if _, err := io.ReadFull(ws.in, extended); err != nil {
+				return 0, nil, err
+			}
+			length = int64(binary.BigEndian.Uint64(extended))
+		}
+		if length < 0 || int64(len(message))+length > 1<<20 {
+			return 0, nil, errors.New("WebSocket message is too large")
+		}
+		mask := make([]byte, 4)
+		if header[1]&0x80 != 0 {
+			if _, err := io.ReadFull(ws.in, mask); err != nil {
+				return 0, nil, err
+			}
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.in, payload); err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch header[0] & 0x0f {
+		case 0x8:
+			ws.write(0x8, nil)
+			return 0, nil, io.EOF
+		case 0x9:
+			ws.write(0xa, payload)
+			continue
+		case 0xa:
+			continue
+		case 0x0:
+		default:
+			opcode = header[0] & 0x0f
+		}
+		message = append(message, payload...)
+		if header[0]&0x80 != 0 {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (ws *websocket) write(opcode byte, payload []byte) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) < 1<<16:
+		header = append(header, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		header = append(header, 127)
+		extended := make([]byte, 8)
+		binary.BigEndian.PutUint64(extended, uint64(len(payload)))
+		header = append(header, extended...)
+	}
+	ws.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err := ws.conn.Write(append(header, payload...))
+	return err
+}
+
+// terminalCommand is the command a terminal runs: a shell in a debug shell's container when a task is given, or
+// otherwise in a new container of the builder image on the project's workspace, as the build stage runs it.
+func terminalCommand(p *project, params map[string]string) ([]string, string, error) {
+	if len(params["task"]) > 0 {
+		tid, _ := strconv.Atoi(params["task"])
+		if !debugRunning(tid) {
+			return nil, "", errors.New("No debug shell is running for this task")
+		}
+		return []string{"exec", "-it", "-w", "/workspace", debugContainer(tid), "/bin/sh"}, "", nil
+	}
+	if state := p.currentState(); state.running() {
+		return nil, "", fmt.Errorf("Project is %s", state.String())
+	}
+	name := fmt.Sprintf("racs-terminal-%d-%d", p.id, time.Now().UnixNano())
+	args := []string{"run", "-it", "--rm=true", "--network=host", "--name", name, "--label", "racs.terminal=" + strconv.Itoa(p.id),
+		"-v", fmt.Sprintf("%s/%d/workspace:/workspace", projectAbs, p.id), "-w", "/workspace"}
+	p.lock.RLock()
+	args = append(args, p.limitArgs(true)...)
+	args, _ = p.variableArgs("env", "-e", args, []string{}, true)
+	p.lock.RUnlock()
+	for _, cache := range projectCaches(p) {
+		args = append(args, "-v", fmt.Sprintf("%s:%s", cacheDir(p, cache), cache))
+	}
+	args = append(args, "--read-only", fmt.Sprintf("builder-%d", p.id), "/bin/sh")
+	return args, name, nil
+}
+
+// handleProjectTerminal attaches a WebSocket to a shell on a pseudo-terminal. Binary messages are the terminal's input
+// and output, and text messages from the browser resize it, e.g. {"cols":80,"rows":24}.
+func handleProjectTerminal(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/terminal", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	args, container, err := terminalCommand(p, params)
+	if err != nil {
+		writeError(w, conflict("%v", err))
+		return
+	}
+	ws, err := websocketAccept(w, r)
+	if err != nil {
+		writeError(w, badRequest("%v", err))
+		return
+	}
+	defer ws.conn.Close()
+	start := time.Now()
+	auditRecord("/project/terminal", r, u, params, 101)
+	master, slave, err := ptyOpen()
+	if err != nil {
+		logger.Error(err)
+		ws.write(0x1, []byte(err.Error()))
+		return
+	}
+	defer master.Close()
+	if len(container) > 0 {
+		terminalsLock.Lock()
+		terminals[p.id] += 1
+		terminalsLock.Unlock()
+		defer func() {
+			terminalsLock.Lock()
+			terminals[p.id] -= 1
+			if terminals[p.id] == 0 {
+				delete(terminals, p.id)
+			}
+			terminalsLock.Unlock()
+		}()
+	}
+	cmd := exec.Command("podman", args...)
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = ptyAttributes()
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		logger.Error(err)
+		ws.write(0x1, []byte(err.Error()))
+		return
+	}
+	logger.Infof("User %s opened a terminal on project %d", u.Name, p.id)
+	done := make(chan bool)
+	go func() {
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := master.Read(buffer)
+			if n > 0 && ws.write(0x2, buffer[:n]) != nil {
+				break
+			}
+			if err != nil {
+				break
+			}
+		}
+		close(done)
+	}()
+	go func() {
+		for {
+			opcode, message, err := ws.read()
+			if err != nil {
+				break
+			}
+			if opcode == 0x1 {
+				var size map[string]int
+				if json.Unmarshal(message, &size) == nil && size["cols"] > 0 && size["rows"] > 0 {
+					ptyResize(master, size["cols"], size["rows"])
+				}
+				continue
+			}
+			master.Write(message)
+		}
+		cmd.Process.Kill()
+	}()
+	timeout := time.NewTimer(time.Duration(terminalTimeout) * time.Minute)
+	select {
+	case <-done:
+	case <-timeout.C:
+		ws.write(0x2, []byte("\r\nTerminal timed out\r\n"))
+		cmd.Process.Kill()
+	}
+	timeout.Stop()
+	cmd.Wait()
+	if len(container) > 0 {
+		// Killing podman leaves its container running.
+		exec.Command("podman", "rm", "-f", container).Run()
+	}
+	ws.write(0x8, []byte{0x03, 0xe8})
+	params["duration"] = strconv.Itoa(int(time.Since(start) / time.Second))
+	auditRecord("/project/terminal/close", r, u, params, 200)
+	logger.Infof("User %s closed a terminal on project %d", u.Name, p.id)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type testResult struct {
+	suite    string
+	class    string
+	name     string
+	status   string
+	duration float64
+	message  string
+}
+
+type junitCase struct {
+	Class   string  `xml:"classname,attr"`
+	Name    string  `xml:"name,attr"`
+	Time    float64 `xml:"time,attr"`
+	Failure *struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	} `xml:"failure"`
+	Error *struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	} `xml:"error"`
+	Skipped *struct{} `xml:"skipped"`
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Cases  []junitCase  `xml:"testcase"`
+	Suites []junitSuite `xml:"testsuite"`
+}
+
+func parseJUnit(content []byte) ([]testResult, error) {
+	var root junitSuite
+	err := xml.Unmarshal(content, &root)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]testResult, 0)
+	var walk func(suite junitSuite)
+	walk = func(suite junitSuite) {
+		for _, c := range suite.Cases {
+			result := testResult{suite.Name, c.Class, c.Name, "passed", c.Time, ""}
+			if c.Failure != nil {
+				result.status = "failed"
+				result.message = strings.TrimSpace(c.Failure.Message + "\n" + c.Failure.Text)
+			} else if c.Error != nil {
+				result.status = "error"
+				result.message = strings.TrimSpace(c.Error.Message + "\n" + c.Error.Text)
+			} else if c.Skipped != nil {
+				result.status = "skipped"
+			}
+			results = append(results, result)
+		}
+		for _, child := range suite.Suites {
+			walk(child)
+		}
+	}
+	walk(root)
+	return results, nil
+}
+
+var tapLine = regexp.MustCompile(`^(not )?ok\b\s*\d*\s*-?\s*([^#]*)(#\s*(\w+).*)?$`)
+
+func parseTAP(content []byte) []testResult {
+	results := make([]testResult, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		match := tapLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		result := testResult{"", "", strings.TrimSpace(match[2]), "passed", 0, ""}
+		directive := strings.ToUpper(match[4])
+		if directive == "SKIP" || directive == "TODO" {
+			result.status = "skipped"
+		} else if len(match[1]) > 0 {
+			result.status = "failed"
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func testIngest(p *project, t *task, request taskRequest) {
+	p.lock.RLock()
+	testReport := p.testReport
+	p.lock.RUnlock()
+	if len(testReport) == 0 {
+		return
+	}
+	workspace := workspaceDir(p, request)
+	report := filepath.Join(workspace, testReport)
+	if !workspaceFile(workspace, report) {
+		logger.Warnf("Project %d test report %s isn't a file in the workspace", p.id, testReport)
+		return
+	}
+	content, err := ioutil.ReadFile(report)
+	if err != nil {
+		logger.Warn(err)
+		return
+	}
+	var results []testResult
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("<")) {
+		results, err = parseJUnit(content)
+		if err != nil {
+			logger.Warn(err)
+			return
+		}
+	} else {
+		results = parseTAP(content)
+	}
+	for _, result := range results {
+		db.Exec(`INSERT INTO tests(task, project, suite, class, name, status, duration, message) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+			t.id, p.id, result.suite, result.class, result.name, result.status, result.duration, result.message)
+	}
+	logger.Infof("Task %d recorded %d test results", t.id, len(results))
+}
+
+func handleProjectTests(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	tid, _ := strconv.Atoi(params["task"])
+	if tid == 0 {
+		db.QueryRow(`SELECT IFNULL(MAX(task), 0) FROM tests WHERE project = ?`, id).Scan(&tid)
+	}
+	rows, err := db.Query(`SELECT suite, class, name, status, duration, message FROM tests WHERE project = ? AND task = ?`, id, tid)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	counts := map[string]int{"passed": 0, "failed": 0, "error": 0, "skipped": 0}
+	tests := make([]interface{}, 0)
+	for rows.Next() {
+		var result testResult
+		rows.Scan(&result.suite, &result.class, &result.name, &result.status, &result.duration, &result.message)
+		counts[result.status] += 1
+		tests = append(tests, map[string]interface{}{
+			"suite":    result.suite,
+			"class":    result.class,
+			"name":     result.name,
+			"status":   result.status,
+			"duration": result.duration,
+			"message":  result.message,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"task":   tid,
+		"counts": counts,
+		"tests":  tests,
+	})
+	w.Write(j)
+}
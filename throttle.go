@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rateLimit int
+var tokenRateLimit int
+var uploadLimit int64
+var bodyLimit int64
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+var rateWindows = map[string]*rateWindow{}
+var rateLock sync.Mutex
+
+// rateAllow counts a request against a key's limit per minute, returning false and the seconds until the minute
+// is over once the limit is reached.
+func rateAllow(key string, limit int) (bool, int) {
+	rateLock.Lock()
+	defer rateLock.Unlock()
+	now := time.Now()
+	if len(rateWindows) > 10000 {
+		for k, window := range rateWindows {
+			if now.Sub(window.start) >= time.Minute {
+				delete(rateWindows, k)
+			}
+		}
+	}
+	window := rateWindows[key]
+	if window == nil || now.Sub(window.start) >= time.Minute {
+		window = &rateWindow{now, 0}
+		rateWindows[key] = window
+	}
+	if window.count >= limit {
+		return false, int(time.Minute-now.Sub(window.start))/int(time.Second) + 1
+	}
+	window.count += 1
+	return true, 0
+}
+
+// throttle rejects a request with 429 if its session token, or its address if it has none, is over its rate limit.
+func throttle(w http.ResponseWriter, r *http.Request, session bool) bool {
+	key, limit := "", 0
+	if cookie, _ := r.Cookie("RACS_TOKEN"); session && cookie != nil {
+		key, limit = "token:"+cookie.Value, tokenRateLimit
+	} else {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		key, limit = "ip:"+ip, rateLimit
+	}
+	if limit <= 0 {
+		return false
+	}
+	allowed, retry := rateAllow(key, limit)
+	if allowed {
+		return false
+	}
+	logger.Warnf("Rate limited %s %s", r.RemoteAddr, r.URL.Path)
+	w.Header().Add("Retry-After", strconv.Itoa(retry))
+	writeError(w, statusError(429, "Too many requests"))
+	return true
+}
+
+// requestLimit is the largest request body accepted for a path. Archives and webhooks have their own limits.
+func requestLimit(path, contentType string) int64 {
+	switch {
+	case path == "/project/files/extract" || path == "/project/import":
+		return archiveLimit
+	case path == "/webhook":
+		return webhookLimit
+	case strings.HasPrefix(contentType, "multipart/form-data"):
+		return uploadLimit
+	}
+	return bodyLimit
+}
+
+func tooLarge(w http.ResponseWriter, err error) bool {
+	if err == nil || !strings.Contains(err.Error(), "request body too large") {
+		return false
+	}
+	writeError(w, statusError(413, "Request body too large"))
+	return true
+}
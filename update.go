@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// racsVersion is set when releases are built, with -ldflags "-X main.racsVersion=1.4.2".
+var racsVersion = "dev"
+
+func fetchRelease(url string) ([]byte, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: %s", url, response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// releaseCompare compares two versions such as 1.4.2 number by number, and is false if either isn't a version.
+func releaseCompare(a, b string) (int, bool) {
+	va, vb := parseRelease(strings.TrimPrefix(a, "v")), parseRelease(strings.TrimPrefix(b, "v"))
+	if va == nil || vb == nil || len(va.prefix) > 0 || len(vb.prefix) > 0 {
+		return 0, false
+	}
+	for i := 0; i < len(va.numbers) || i < len(vb.numbers); i++ {
+		na, nb := 0, 0
+		if i < len(va.numbers) {
+			na = va.numbers[i]
+		}
+		if i < len(vb.numbers) {
+			nb = vb.numbers[i]
+		}
+		if na != nb {
+			return na - nb, true
+		}
+	}
+	return 0, true
+}
+
+// binaryVersion asks a downloaded binary for its version. Its signature has been verified, so the version can be
+// trusted; binaries older than -version can't answer.
+func binaryVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s can't tell its version: %v", filepath.Base(path), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// updateCheck refuses to replace the running version with an older or the same one, unless forced.
+func updateCheck(current, release string, force bool) error {
+	if force || current == "dev" {
+		return nil
+	}
+	diff, ok := releaseCompare(release, current)
+	if !ok {
+		return fmt.Errorf("Can't compare release %q with version %s, use -force to update anyway", release, current)
+	} else if diff < 0 {
+		return fmt.Errorf("Release %s is older than version %s, use -force to downgrade", release, current)
+	} else if diff == 0 {
+		return fmt.Errorf("Already at version %s", current)
+	}
+	return nil
+}
+
+func selfUpdate(releaseURL, releaseKey string, force bool) error {
+	key, err := hex.DecodeString(releaseKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("Invalid release key")
+	}
+	name := fmt.Sprintf("racs-%s-%s", runtime.GOOS, runtime.GOARCH)
+	binary, err := fetchRelease(releaseURL + "/" + name)
+	if err != nil {
+		return err
+	}
+	signature, err := fetchRelease(releaseURL + "/" + name + ".sig")
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), binary, signature) {
+		return errors.New("Release signature verification failed")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return err
+	}
+	temp := executable + ".new"
+	err = ioutil.WriteFile(temp, binary, 0755)
+	if err != nil {
+		return err
+	}
+	release, err := binaryVersion(temp)
+	if err != nil && !force {
+		os.Remove(temp)
+		return fmt.Errorf("%v, use -force to update anyway", err)
+	}
+	if err := updateCheck(racsVersion, release, force); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	err = os.Rename(temp, executable)
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	logger.Infof("Updated %s from %s to %s", executable, racsVersion, release)
+	return nil
+}
+
+func mainUpdate(args []string) {
+	var releaseURL, releaseKey string
+	var force bool
+	flags := flag.NewFlagSet("update", flag.ExitOnError)
+	flags.StringVar(&releaseURL, "release-url", os.Getenv("RACS_RELEASE_URL"), "Base URL of racs releases")
+	flags.StringVar(&releaseKey, "release-key", os.Getenv("RACS_RELEASE_KEY"), "Ed25519 public key (hex) for release signatures")
+	flags.BoolVar(&force, "force", false, "Update to the release even if it is older than or the same as this version")
+	flags.Parse(args)
+	if len(releaseURL) == 0 {
+		logger.Fatal("No release URL")
+	}
+	err := selfUpdate(releaseURL, releaseKey, force)
+	if err != nil {
+		logger.Fatal(err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const specLimit = 64 * 1024
+const contextLimit = 100 * 1024 * 1024
+const archiveLimit = 1024 * 1024 * 1024
+
+type uploadSlot struct {
+	limit    int64
+	validate func(path string) error
+}
+
+var specSlot = &uploadSlot{specLimit, validateSpec}
+var contextSlot = &uploadSlot{contextLimit, nil}
+
+// uploadSlotFor returns the slot a project file may be uploaded to, or nil if the name is not an upload slot.
+func uploadSlotFor(p *project, name string) *uploadSlot {
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	switch name {
+	case "BuildSpec", "PackageSpec", "TestSpec":
+		return specSlot
+	}
+	for _, spec := range append(p.specFiles(), variantSpecs(p.id)...) {
+		spec = strings.TrimPrefix(filepath.Clean("/"+spec), "/")
+		if len(spec) > 0 && name == spec && !strings.HasPrefix(spec, "workspace/") && !strings.HasPrefix(spec, "context/") {
+			return specSlot
+		}
+	}
+	if strings.HasPrefix(name, "context/") {
+		return contextSlot
+	}
+	if hookName.MatchString(name) {
+		return hookSlot
+	}
+	return nil
+}
+
+func validateSpec(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(b) || strings.ContainsRune(string(b), 0) {
+		return fmt.Errorf("container spec is not a text file")
+	}
+	if issues := specIssues(string(b)); len(issues) > 0 {
+		return fmt.Errorf("line %d: %s", issues[0].line, issues[0].message)
+	}
+	return nil
+}
+
+func (s *uploadSlot) check(path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 500, err
+	}
+	if info.Size() > s.limit {
+		return 413, fmt.Errorf("file is %d bytes, over the limit of %d bytes", info.Size(), s.limit)
+	}
+	if s.validate != nil {
+		if err := s.validate(path); err != nil {
+			return 400, err
+		}
+	}
+	return 200, nil
+}
+
+func projectFile(p *project, name string) (string, string) {
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	return name, fmt.Sprintf("%s/%d/%s", projectAbs, p.id, name)
+}
+
+// extractFile stores one archive member in the project's context directory, returning an error if it is not a valid upload.
+func extractFile(p *project, name string, in io.Reader) error {
+	name, path := projectFile(p, name)
+	if !strings.HasPrefix(name, "context/") {
+		return fmt.Errorf("%s is outside the context directory", name)
+	}
+	temp, err := ioutil.TempFile("uploads", "upload-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(temp, io.LimitReader(in, contextLimit+1))
+	temp.Close()
+	if err == nil {
+		_, err = contextSlot.check(temp.Name())
+	}
+	if err == nil {
+		makeDir(filepath.Dir(path))
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	applyMode(path, fileMode)
+	return nil
+}
+
+func extractArchive(p *project, prefix string, archive string) (int, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	magic := make([]byte, 4)
+	io.ReadFull(file, magic)
+	file.Seek(0, io.SeekStart)
+	count := 0
+	var total int64
+	if bytes.Equal(magic, []byte("PK\x03\x04")) {
+		info, _ := file.Stat()
+		zr, err := zip.NewReader(file, info.Size())
+		if err != nil {
+			return 0, err
+		}
+		for _, member := range zr.File {
+			if !member.Mode().IsRegular() {
+				continue
+			}
+			total += int64(member.UncompressedSize64)
+			if total > archiveLimit {
+				return count, fmt.Errorf("archive is over the limit of %d bytes", archiveLimit)
+			}
+			rd, err := member.Open()
+			if err != nil {
+				return count, err
+			}
+			err = extractFile(p, prefix+"/"+member.Name, rd)
+			rd.Close()
+			if err != nil {
+				return count, err
+			}
+			count += 1
+		}
+		return count, nil
+	}
+	var in io.Reader = file
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, err
+		}
+		in = gz
+	}
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		total += header.Size
+		if total > archiveLimit {
+			return count, fmt.Errorf("archive is over the limit of %d bytes", archiveLimit)
+		}
+		if err := extractFile(p, prefix+"/"+header.Name, tr); err != nil {
+			return count, err
+		}
+		count += 1
+	}
+}
+
+func handleProjectFiles(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	root := fmt.Sprintf("%s/%d", projectAbs, p.id)
+	result := make([]map[string]interface{}, 0)
+	add := func(name string, info os.FileInfo) {
+		kind := "context"
+		switch uploadSlotFor(p, name) {
+		case specSlot:
+			kind = "spec"
+		case hookSlot:
+			kind = "hook"
+		}
+		result = append(result, map[string]interface{}{
+			"name": name,
+			"kind": kind,
+			"size": info.Size(),
+			"time": info.ModTime().UTC().Format("2006-01-02 15:04:05"),
+		})
+	}
+	entries, _ := os.ReadDir(root)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && info.Mode().IsRegular() && uploadSlotFor(p, entry.Name()) != nil {
+			add(entry.Name(), info)
+		}
+	}
+	for _, spec := range p.specFiles() {
+		name, path := projectFile(p, spec)
+		if strings.Contains(name, "/") && uploadSlotFor(p, name) == specSlot {
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+				add(name, info)
+			}
+		}
+	}
+	for _, dir := range []string{"context", "hooks"} {
+		filepath.Walk(root+"/"+dir, func(path string, info os.FileInfo, err error) error {
+			name := strings.TrimPrefix(path, root+"/")
+			if err == nil && info.Mode().IsRegular() && uploadSlotFor(p, name) != nil {
+				add(name, info)
+			}
+			return nil
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i]["name"].(string) < result[j]["name"].(string)
+	})
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectFilesDownload(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/files/download", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	name, path := projectFile(p, params["name"])
+	file, err := os.Open(path)
+	if uploadSlotFor(p, name) == nil || err != nil {
+		writeError(w, notFound("File"))
+		return
+	}
+	defer file.Close()
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(name)))
+	io.Copy(w, file)
+}
+
+func handleProjectFilesDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/files/delete", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	name, path := projectFile(p, params["name"])
+	if uploadSlotFor(p, name) == nil {
+		writeError(w, notFound("File"))
+		return
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		err = os.RemoveAll(path)
+	} else if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		writeError(w, notFound("File"))
+		return
+	}
+	logger.Infof("Project %d file %s deleted by %s", p.id, name, u.Name)
+	projectRevise(p, u.Name)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleProjectFilesExtract(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/files/extract", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	prefix, _ := projectFile(p, params["path"])
+	if prefix != "context" && !strings.HasPrefix(prefix, "context/") {
+		prefix = "context"
+	}
+	temp, err := ioutil.TempFile("uploads", "archive-")
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer os.Remove(temp.Name())
+	if r.MultipartForm != nil && len(r.MultipartForm.File["file"]) > 0 {
+		rd, err := r.MultipartForm.File["file"][0].Open()
+		if err == nil {
+			io.Copy(temp, rd)
+			rd.Close()
+		}
+	} else {
+		io.Copy(temp, io.LimitReader(r.Body, archiveLimit))
+	}
+	temp.Close()
+	count, err := extractArchive(p, prefix, temp.Name())
+	if count > 0 {
+		projectRevise(p, u.Name)
+	}
+	if err != nil {
+		writeError(w, badRequest("Extracted %d files: %v", count, err))
+		return
+	}
+	logger.Infof("Project %d extracted %d files into %s", p.id, count, prefix)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte(strconv.Itoa(count)))
+	}
+}
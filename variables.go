@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+type variable struct {
+	name   string
+	value  string
+	kind   string
+	secret bool
+}
+
+var variableName = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// variableArgs passes the project's variables of a kind to a command, with p.lock held. Secret variables are left out
+// unless secrets is set.
+func (p *project) variableArgs(kind, flag string, args, env []string, secrets bool) ([]string, []string) {
+	names := make([]string, 0)
+	for name, v := range p.variables {
+		if v.kind == kind && (secrets || !v.secret) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := p.variables[name]
+		if v.secret {
+			// Secret values are passed through the environment so they never appear in task logs.
+			args = append(args, flag, name)
+			env = append(env, name+"="+v.value)
+		} else {
+			args = append(args, flag, name+"="+v.value)
+		}
+	}
+	return args, env
+}
+
+func handleProjectVariables(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	result := make([]map[string]interface{}, 0)
+	for _, v := range p.variableList() {
+		value := v.value
+		if v.secret {
+			value = "******"
+		}
+		result = append(result, map[string]interface{}{
+			"name":   v.name,
+			"value":  value,
+			"kind":   v.kind,
+			"secret": v.secret,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectVariablesSet(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/variables/set", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	name := params["name"]
+	kind := params["kind"]
+	if kind == "" {
+		kind = "env"
+	}
+	if p == nil {
+		writeError(w, notFound("Project"))
+	} else if !variableName.MatchString(name) {
+		writeError(w, invalidParam("name", "Invalid variable name %s", name))
+	} else if !variableKinds[kind] {
+		writeError(w, invalidParam("kind", "kind must be env, arg or sign"))
+	} else {
+		v := &variable{name, params["value"], kind, params["secret"] == "true"}
+		p.setVariable(v)
+		db.Exec(`REPLACE INTO variables(project, name, value, kind, secret) VALUES(?, ?, ?, ?, ?)`, p.id, v.name, v.value, v.kind, v.secret)
+		projectRevise(p, u.Name)
+		redirect := params["redirect"]
+		if len(redirect) > 0 {
+			w.Header().Add("Location", redirect)
+			w.WriteHeader(303)
+		} else {
+			w.WriteHeader(200)
+			w.Write([]byte("OK"))
+		}
+	}
+}
+
+func handleProjectVariablesDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/variables/delete", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	name := params["name"]
+	p.deleteVariable(name)
+	db.Exec(`DELETE FROM variables WHERE project = ? AND name = ?`, p.id, name)
+	projectRevise(p, u.Name)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var variantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// variantTriggers are the automatic builds that can also build a variant.
+var variantTriggers = map[string]bool{"poll": true, "webhook": true, "tag": true}
+
+type variant struct {
+	name      string
+	buildSpec string
+	triggers  string
+}
+
+func projectVariants(pid int) []*variant {
+	variants := make([]*variant, 0)
+	rows, err := db.Query(`SELECT name, buildSpec, IFNULL(triggers, '') FROM variants WHERE project = ? ORDER BY name`, pid)
+	if err != nil {
+		logger.Error(err)
+		return variants
+	}
+	defer rows.Close()
+	for rows.Next() {
+		v := &variant{}
+		rows.Scan(&v.name, &v.buildSpec, &v.triggers)
+		variants = append(variants, v)
+	}
+	return variants
+}
+
+func projectVariant(pid int, name string) *variant {
+	v := &variant{name: name}
+	err := db.QueryRow(`SELECT buildSpec, IFNULL(triggers, '') FROM variants WHERE project = ? AND name = ?`, pid, name).Scan(&v.buildSpec, &v.triggers)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// variantSpecs are the build specs of a project's variants, which are uploaded and proposed like its own specs.
+func variantSpecs(pid int) []string {
+	specs := make([]string, 0)
+	for _, v := range projectVariants(pid) {
+		specs = append(specs, v.buildSpec)
+	}
+	return specs
+}
+
+func variantDir(p *project, name string) string {
+	return fmt.Sprintf("%s/%d/variants/%s", projectAbs, p.id, name)
+}
+
+// variantRef is the ref a request checks out, the project's branch for variants that weren't started from a tag.
+func variantRef(p *project, request taskRequest) string {
+	if len(request.ref) == 0 && len(request.variant) > 0 {
+		return "refs/heads/" + p.branch
+	}
+	return request.ref
+}
+
+// imageName is the local name of a project's builder, test or package image, e.g. builder-3 or builder-3-clang.
+func imageName(kind string, p *project, request taskRequest) string {
+	if len(request.variant) > 0 {
+		return fmt.Sprintf("%s-%d-%s", kind, p.id, request.variant)
+	}
+	return fmt.Sprintf("%s-%d", kind, p.id)
+}
+
+// variantNext queues a variant build's next stage. Variants are pulled into their own workspace before their builder is
+// prepared, and aren't scanned, held for approval or followed by downstream builds.
+func variantNext(p *project, request taskRequest) {
+	p.lock.RLock()
+	testSpec, hold := p.testSpec, p.hold
+	p.lock.RUnlock()
+	switch p.state {
+	case PULL_SUCCESS:
+		p.buildNext(PREPARING, request)
+	case PREPARE_SUCCESS:
+		p.buildNext(BUILDING, request)
+	case BUILD_SUCCESS:
+		if len(testSpec) > 0 {
+			p.buildNext(TESTING, request)
+		} else {
+			p.buildNext(PACKAGING, request)
+		}
+	case TEST_SUCCESS:
+		p.buildNext(PACKAGING, request)
+	case PACKAGE_SUCCESS:
+		if hold {
+			logger.Infof("Project %d didn't push variant %s, pushes are held for approval", p.id, request.variant)
+			runFinish(p, request.build, "SUCCESS")
+		} else {
+			p.buildNext(PUSHING, request)
+		}
+	}
+}
+
+// variantCreate starts a build of a variant.
+func variantCreate(p *project, v *variant, author, trigger, labels, ref string) (int, error) {
+	build, err := runCreate(p, "variant:"+v.name, author)
+	if err != nil {
+		return 0, err
+	}
+	db.Exec(`UPDATE builds SET variant = ? WHERE id = ?`, v.name, build)
+	p.enqueue(taskRequest{PULLING, trigger, labels, 0, build, NONE, ref, v.name})
+	return build, nil
+}
+
+// variantsQueue builds the variants that are built on a kind of automatic build, alongside the project's own build.
+func variantsQueue(p *project, kind, trigger, ref string) {
+	for _, v := range projectVariants(p.id) {
+		for _, name := range splitLabels(v.triggers) {
+			if name != kind {
+				continue
+			}
+			if _, err := variantCreate(p, v, kind, trigger, "", ref); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
+
+func handleProjectVariants(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	if projectGet(id) == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	result := make([]map[string]interface{}, 0)
+	for _, v := range projectVariants(id) {
+		variant := map[string]interface{}{
+			"name":      v.name,
+			"buildSpec": v.buildSpec,
+			"triggers":  splitLabels(v.triggers),
+		}
+		var build int
+		var state, time, finished, digest string
+		err := db.QueryRow(`SELECT id, state, time, IFNULL(finished, ''), IFNULL(digest, '') FROM builds
+			WHERE project = ? AND variant = ? ORDER BY id DESC LIMIT 1`, id, v.name).Scan(&build, &state, &time, &finished, &digest)
+		if err == nil {
+			variant["last"] = map[string]interface{}{
+				"build":    build,
+				"state":    state,
+				"time":     time,
+				"finished": finished,
+				"digest":   digest,
+			}
+		}
+		result = append(result, variant)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectVariantsSet(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/variants/set", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	name := params["name"]
+	spec := params["buildSpec"]
+	if len(spec) == 0 {
+		spec = "BuildSpec." + name
+	}
+	spec = strings.TrimPrefix(filepath.Clean("/"+spec), "/")
+	triggers := splitLabels(params["triggers"])
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	} else if !variantName.MatchString(name) {
+		writeError(w, invalidParam("name", "name must be lower case letters, digits, ., _ and -"))
+		return
+	} else if specs := p.specFiles(); spec == specs[1] || spec == specs[2] {
+		writeError(w, invalidParam("buildSpec", "%s is the project's package or test spec", spec))
+		return
+	}
+	for _, trigger := range triggers {
+		if !variantTriggers[trigger] {
+			writeError(w, invalidParam("triggers", "Unknown trigger %s, must be poll, webhook or tag", trigger))
+			return
+		}
+	}
+	db.Exec(`REPLACE INTO variants(project, name, buildSpec, triggers) VALUES(?, ?, ?, ?)`, p.id, name, spec, strings.Join(triggers, ","))
+	projectRevise(p, u.Name)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func handleProjectVariantsDelete(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/variants/delete", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	db.Exec(`DELETE FROM variants WHERE project = ? AND name = ?`, p.id, params["name"])
+	projectRevise(p, u.Name)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
+
+func variantConfig(pid int, config map[string]string) {
+	for _, v := range projectVariants(pid) {
+		config["variant:"+v.name] = strings.TrimSpace(v.buildSpec + " " + v.triggers)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const webhookLimit = 25 * 1024 * 1024
+
+var semverTag = regexp.MustCompile(`^v[0-9]+(\.[0-9]+)*([-+].*)?$`)
+
+// gitTagVersion turns a git tag into an image tag, dropping the v from semantic version tags such as v1.2.3.
+func gitTagVersion(tag string) string {
+	if semverTag.MatchString(tag) {
+		return tag[1:]
+	}
+	return tag
+}
+
+func imageTag(p *project, request taskRequest) string {
+	version := strconv.Itoa(p.version)
+	if strings.HasPrefix(request.ref, "refs/tags/") {
+		version = gitTagVersion(strings.TrimPrefix(request.ref, "refs/tags/"))
+	}
+	tag := strings.Replace(p.tag, "$VERSION", version, -1)
+	// Variants are tagged after the project's image, e.g. example/app:1.2-clang, or example/app:clang when it has no tag.
+	if len(request.variant) > 0 && strings.Contains(path.Base(tag), ":") {
+		tag += "-" + request.variant
+	} else if len(request.variant) > 0 {
+		tag += ":" + request.variant
+	}
+	return tag
+}
+
+func tagMatches(p *project, tag string) bool {
+	for _, pattern := range strings.Split(p.tagPattern, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if matched, _ := path.Match(pattern, tag); len(pattern) > 0 && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// globPattern compiles a path glob in which ** matches any number of directories, e.g. services/api/**.
+func globPattern(pattern string) *regexp.Regexp {
+	expression := "^"
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expression += "(.*/)?"
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expression += ".*"
+			i += 1
+		case pattern[i] == '*':
+			expression += "[^/]*"
+		case pattern[i] == '?':
+			expression += "[^/]"
+		default:
+			expression += regexp.QuoteMeta(pattern[i : i+1])
+		}
+	}
+	return regexp.MustCompile(expression + "$")
+}
+
+func pathMatches(p *project, paths []string) bool {
+	for _, pattern := range strings.Split(p.pathFilter, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) == 0 {
+			continue
+		}
+		glob := globPattern(pattern)
+		for _, name := range paths {
+			if glob.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pushedPaths lists the files changed by a push's commits. It returns false if the payload doesn't list all of them,
+// as GitLab does for pushes of more than 20 commits.
+func pushedPaths(payload map[string]interface{}) ([]string, bool) {
+	commits, _ := payload["commits"].([]interface{})
+	if len(commits) == 0 {
+		return nil, false
+	}
+	if total, ok := payload["total_commits_count"].(float64); ok && int(total) > len(commits) {
+		return nil, false
+	}
+	paths := make([]string, 0)
+	for _, commit := range commits {
+		c, _ := commit.(map[string]interface{})
+		for _, key := range []string{"added", "modified", "removed"} {
+			names, _ := c[key].([]interface{})
+			for _, name := range names {
+				paths = append(paths, bundleText(name))
+			}
+		}
+	}
+	return paths, true
+}
+
+// checkoutRef checks out a ref other than the project's branch, such as a tag, without leaving a local branch behind.
+func checkoutRef(out io.Writer, source, ref string) error {
+	for _, args := range [][]string{
+		{"-C", source, "fetch", "--force", "origin", ref},
+		{"-C", source, "checkout", "-q", "--detach", "FETCH_HEAD"},
+		{"-C", source, "submodule", "update", "--init", "--recursive"},
+	} {
+		cmd := exec.Command("git", args...)
+		fmt.Fprintf(out, "\u001B[1m%s\u001B[0m\n", cmd.String())
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func webhookVerified(p *project, r *http.Request, body []byte) bool {
+	var secret string
+	db.QueryRow(`SELECT secret FROM webhooks WHERE project = ?`, p.id).Scan(&secret)
+	if len(secret) == 0 {
+		return true
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); len(token) > 0 {
+		return hmac.Equal([]byte(token), []byte(secret))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(r.Header.Get("X-Hub-Signature-256")), []byte(expected))
+}
+
+func webhookReply(w http.ResponseWriter, p *project, status int, message string) {
+	logger.Infof("Project %d webhook: %s", p.id, message)
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
+
+func webhookRecord(p *project, event, ref, revision, status, message string) {
+	db.Exec(`INSERT INTO deliveries(project, event, ref, revision, status, message, time) VALUES(?, ?, ?, ?, ?, ?, datetime('now'))`,
+		p.id, event, ref, revision, status, message)
+}
+
+func handleWebhook(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, webhookLimit))
+	if !webhookVerified(p, r, body) {
+		webhookReply(w, p, 401, "Invalid signature")
+		return
+	}
+	event := r.Header.Get("X-GitHub-Event")
+	if len(event) == 0 {
+		event = r.Header.Get("X-Gitlab-Event")
+	}
+	switch event {
+	case "ping":
+		webhookReply(w, p, 200, "OK")
+		return
+	case "push", "Push Hook", "Tag Push Hook", "pull_request", "Merge Request Hook":
+	default:
+		webhookReply(w, p, 202, fmt.Sprintf("Ignored %s event", event))
+		return
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		webhookReply(w, p, 400, "Invalid payload")
+		return
+	}
+	if event == "pull_request" || event == "Merge Request Hook" {
+		webhookPreview(w, p, event, payload)
+		return
+	}
+	ref := bundleText(payload["ref"])
+	after := bundleText(payload["after"])
+	if payload["deleted"] == true || strings.Trim(after, "0") == "" {
+		webhookReply(w, p, 202, fmt.Sprintf("Ignored deleted %s", ref))
+		return
+	}
+	if strings.HasPrefix(ref, "refs/tags/") {
+		tag := strings.TrimPrefix(ref, "refs/tags/")
+		if !tagMatches(p, tag) {
+			webhookReply(w, p, 202, fmt.Sprintf("Ignored tag %s", tag))
+			return
+		}
+		build, _ := runCreate(p, "webhook", "webhook")
+		p.enqueue(taskRequest{PULLING, tag, "", 0, build, NONE, ref, ""})
+		variantsQueue(p, "tag", tag, ref)
+		webhookRecord(p, event, ref, after, "queued", "")
+		webhookReply(w, p, 200, fmt.Sprintf("Building tag %s", tag))
+	} else if ref == "refs/heads/"+p.branch {
+		// Pushes that may have changed other paths, or whose paths aren't all listed, are always built.
+		if paths, ok := pushedPaths(payload); len(p.pathFilter) > 0 && ok && !pathMatches(p, paths) {
+			message := fmt.Sprintf("Skipped %s, no changes in %s", p.branch, p.pathFilter)
+			webhookRecord(p, event, ref, after, "skipped", message)
+			webhookReply(w, p, 202, message)
+			return
+		}
+		build, _ := runCreate(p, "webhook", "webhook")
+		p.enqueue(taskRequest{PULLING, "", "", 0, build, NONE, "", ""})
+		variantsQueue(p, "webhook", "", "")
+		webhookRecord(p, event, ref, after, "queued", "")
+		webhookReply(w, p, 200, fmt.Sprintf("Building %s", p.branch))
+	} else {
+		webhookReply(w, p, 202, fmt.Sprintf("Ignored %s", ref))
+	}
+}
+
+func handleProjectWebhookDeliveries(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	id, _ := strconv.Atoi(params["id"])
+	status := params["status"]
+	query := `SELECT id, event, ref, revision, status, message, time FROM deliveries WHERE project = ? ORDER BY id DESC LIMIT 100`
+	args := []interface{}{id}
+	if len(status) > 0 {
+		query = `SELECT id, event, ref, revision, status, message, time FROM deliveries WHERE project = ? AND status = ? ORDER BY id DESC LIMIT 100`
+		args = append(args, status)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var id int
+		var event string
+		var ref string
+		var revision string
+		var status string
+		var message string
+		var time string
+		rows.Scan(&id, &event, &ref, &revision, &status, &message, &time)
+		result = append(result, map[string]interface{}{
+			"id":       id,
+			"event":    event,
+			"ref":      ref,
+			"revision": revision,
+			"status":   status,
+			"message":  message,
+			"time":     time,
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	j, _ := json.Marshal(result)
+	w.Write(j)
+}
+
+func handleProjectWebhookSecret(w http.ResponseWriter, r *http.Request, u *user, params map[string]string) {
+	if checkLogin(u, "admin", w, "/project/webhook/secret", params) {
+		return
+	}
+	id, _ := strconv.Atoi(params["id"])
+	p := projectGet(id)
+	if p == nil {
+		writeError(w, notFound("Project"))
+		return
+	}
+	if len(params["secret"]) == 0 {
+		db.Exec(`DELETE FROM webhooks WHERE project = ?`, p.id)
+	} else {
+		db.Exec(`REPLACE INTO webhooks(project, secret) VALUES(?, ?)`, p.id, params["secret"])
+	}
+	logger.Infof("Project %d webhook secret changed by %s", p.id, u.Name)
+	redirect := params["redirect"]
+	if len(redirect) > 0 {
+		w.Header().Add("Location", redirect)
+		w.WriteHeader(303)
+	} else {
+		w.WriteHeader(200)
+		w.Write([]byte("OK"))
+	}
+}
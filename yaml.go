@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlNode is a node of the small YAML subset used for pipeline files: block
+// mappings and sequences, flow sequences, quoted and plain scalars and
+// literal (|) or folded (>) block scalars.
+type yamlNode struct {
+	line   int
+	scalar *string
+	keys   []string
+	fields map[string]*yamlNode
+	items  []*yamlNode
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func yamlStrip(text string) string {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+		} else if c == '"' || c == '\'' {
+			quote = c
+		} else if c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t') {
+			return strings.TrimRight(text[:i], " \t")
+		}
+	}
+	return strings.TrimRight(text, " \t")
+}
+
+func yamlKey(text string) (string, string, bool) {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+		} else if c == '"' || c == '\'' {
+			quote = c
+		} else if c == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			key, _ := yamlUnquote(strings.TrimSpace(text[:i]))
+			return key, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func yamlUnquote(text string) (string, error) {
+	if strings.HasPrefix(text, `"`) {
+		return strconv.Unquote(text)
+	}
+	if strings.HasPrefix(text, "'") {
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", fmt.Errorf("unterminated string %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	}
+	return text, nil
+}
+
+func parseYAML(content string) (*yamlNode, error) {
+	parser := &yamlParser{}
+	for i, raw := range strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(raw, " "), "\t") {
+			return nil, fmt.Errorf("line %d: tabs cannot be used for indentation", i+1)
+		}
+		text := strings.TrimLeft(raw, " ")
+		parser.lines = append(parser.lines, yamlLine{i + 1, len(raw) - len(text), strings.TrimRight(text, " ")})
+	}
+	parser.skip()
+	if parser.pos >= len(parser.lines) {
+		return &yamlNode{line: 1, keys: []string{}, fields: map[string]*yamlNode{}}, nil
+	}
+	if text := parser.lines[parser.pos].text; text == "---" {
+		parser.pos += 1
+		parser.skip()
+	}
+	if parser.pos >= len(parser.lines) {
+		return &yamlNode{line: 1, keys: []string{}, fields: map[string]*yamlNode{}}, nil
+	}
+	node, err := parser.block(parser.lines[parser.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+	parser.skip()
+	if parser.pos < len(parser.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", parser.lines[parser.pos].number)
+	}
+	return node, nil
+}
+
+func (y *yamlParser) skip() {
+	for y.pos < len(y.lines) && len(yamlStrip(y.lines[y.pos].text)) == 0 {
+		y.pos += 1
+	}
+}
+
+func (y *yamlParser) block(indent int) (*yamlNode, error) {
+	line := y.lines[y.pos]
+	text := yamlStrip(line.text)
+	if text == "-" || strings.HasPrefix(text, "- ") {
+		return y.sequence(indent)
+	}
+	if _, _, ok := yamlKey(text); ok {
+		return y.mapping(indent)
+	}
+	y.pos += 1
+	return y.value(line.number, text, indent)
+}
+
+func (y *yamlParser) sequence(indent int) (*yamlNode, error) {
+	node := &yamlNode{line: y.lines[y.pos].number, items: []*yamlNode{}}
+	for y.skip(); y.pos < len(y.lines); y.skip() {
+		line := y.lines[y.pos]
+		text := yamlStrip(line.text)
+		if line.indent < indent || (line.indent == indent && !(text == "-" || strings.HasPrefix(text, "- "))) {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: expected a list item", line.number)
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(text, "-"), " ")
+		if len(rest) == 0 {
+			y.pos += 1
+			item, err := y.child(line.number, indent)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+			continue
+		}
+		// An item that starts a mapping is parsed as a mapping indented past the dash.
+		offset := len(line.text) - len(strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " "))
+		y.lines[y.pos] = yamlLine{line.number, indent + offset, line.text[offset:]}
+		item, err := y.block(indent + offset)
+		if err != nil {
+			return nil, err
+		}
+		node.items = append(node.items, item)
+	}
+	return node, nil
+}
+
+func (y *yamlParser) mapping(indent int) (*yamlNode, error) {
+	node := &yamlNode{line: y.lines[y.pos].number, keys: []string{}, fields: map[string]*yamlNode{}}
+	for y.skip(); y.pos < len(y.lines); y.skip() {
+		line := y.lines[y.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+		key, rest, ok := yamlKey(yamlStrip(line.text))
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", line.number)
+		}
+		if _, exists := node.fields[key]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key %s", line.number, key)
+		}
+		y.pos += 1
+		var value *yamlNode
+		var err error
+		if len(rest) == 0 {
+			value, err = y.child(line.number, indent)
+		} else {
+			value, err = y.value(line.number, rest, indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		node.keys = append(node.keys, key)
+		node.fields[key] = value
+	}
+	return node, nil
+}
+
+func (y *yamlParser) child(number, indent int) (*yamlNode, error) {
+	y.skip()
+	if y.pos < len(y.lines) {
+		line := y.lines[y.pos]
+		text := yamlStrip(line.text)
+		// Sequences may be indented at the same level as their parent key.
+		if line.indent > indent || (line.indent == indent && (text == "-" || strings.HasPrefix(text, "- "))) {
+			return y.block(line.indent)
+		}
+	}
+	empty := ""
+	return &yamlNode{line: number, scalar: &empty}, nil
+}
+
+func (y *yamlParser) value(number int, text string, indent int) (*yamlNode, error) {
+	if text == "|" || text == "|-" || text == ">" || text == ">-" {
+		lines := make([]string, 0)
+		block := -1
+		for ; y.pos < len(y.lines); y.pos++ {
+			line := y.lines[y.pos]
+			if len(line.text) == 0 {
+				lines = append(lines, "")
+				continue
+			}
+			if line.indent <= indent {
+				break
+			}
+			if block < 0 {
+				block = line.indent
+			}
+			if line.indent < block {
+				break
+			}
+			lines = append(lines, strings.Repeat(" ", line.indent-block)+line.text)
+		}
+		for len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		separator := "\n"
+		if text[0] == '>' {
+			separator = " "
+		}
+		value := strings.Join(lines, separator)
+		if !strings.HasSuffix(text, "-") && len(lines) > 0 {
+			value += "\n"
+		}
+		return &yamlNode{line: number, scalar: &value}, nil
+	}
+	if strings.HasPrefix(text, "[") {
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("line %d: unterminated list", number)
+		}
+		node := &yamlNode{line: number, items: []*yamlNode{}}
+		inner := strings.TrimSpace(text[1 : len(text)-1])
+		if len(inner) == 0 {
+			return node, nil
+		}
+		for _, item := range strings.Split(inner, ",") {
+			value, err := yamlUnquote(strings.TrimSpace(item))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", number, err)
+			}
+			node.items = append(node.items, &yamlNode{line: number, scalar: &value})
+		}
+		return node, nil
+	}
+	if strings.HasPrefix(text, "{") {
+		return nil, fmt.Errorf("line %d: flow mappings are not supported", number)
+	}
+	value, err := yamlUnquote(text)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", number, err)
+	}
+	return &yamlNode{line: number, scalar: &value}, nil
+}
+
+// strings returns a scalar or a list of scalars as a list, splitting scalars on commas.
+func (n *yamlNode) strings() ([]string, bool) {
+	if n.scalar != nil {
+		result := make([]string, 0)
+		for _, item := range strings.Split(*n.scalar, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				result = append(result, item)
+			}
+		}
+		return result, true
+	}
+	if n.items == nil {
+		return nil, false
+	}
+	result := make([]string, 0)
+	for _, item := range n.items {
+		if item.scalar == nil {
+			return nil, false
+		}
+		result = append(result, *item.scalar)
+	}
+	return result, true
+}